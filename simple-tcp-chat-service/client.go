@@ -13,6 +13,8 @@ type client struct {
 	conn     net.Conn
 	room     *room
 	commands chan<- command
+	// markup renders the markup of messages and colours names, for terminals that understand escape sequences.
+	markup bool
 }
 
 // todo: stop reading from the conn after quit.
@@ -25,7 +27,7 @@ func (c *client) readInput() {
 			return
 		}
 
-		msg = strings.Trim(msg, "\r\n")
+		msg = sanitize(strings.Trim(msg, "\r\n"))
 		args := strings.Split(msg, " ")
 		cmd := strings.TrimSpace(args[0])
 		switch cmd {
@@ -47,6 +49,12 @@ func (c *client) readInput() {
 				args:   args,
 				client: c,
 			}
+		case "/markup":
+			c.commands <- command{
+				id:     CMD_MARKUP,
+				args:   args,
+				client: c,
+			}
 		case "/rooms":
 			c.commands <- command{
 				id:     CMD_ROOMS,
@@ -70,3 +78,11 @@ func (c *client) err(err error) {
 func (c *client) msg(msg string) {
 	c.conn.Write([]byte("> " + msg + "\n"))
 }
+
+func (c *client) chat(from, text string) {
+	if c.markup {
+		c.msg(colorName(from) + ": " + render(text))
+		return
+	}
+	c.msg(from + ": " + text)
+}
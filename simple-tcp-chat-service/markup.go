@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The rules are those of pkg/markup of the redis chat service, so both chats escape and style text the same way.
+
+// sanitize turns tabs and line breaks into spaces and escapes the other control characters, invalid utf-8 and bidi
+// overrides, so a client can't send escape sequences that clear the screens of the others, move their cursor over
+// other lines or retitle their terminal.
+func sanitize(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				b.WriteString(`\x` + strconv.FormatUint(uint64(s[i]), 16))
+				continue
+			}
+			b.WriteRune(r)
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case unicode.IsControl(r) || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069'):
+			q := strconv.QuoteRuneToASCII(r)
+			b.WriteString(q[1 : len(q)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// styles are the markup characters and the escape sequences of their style: *bold*, _italics_ and `code`.
+var styles = map[byte]string{'*': "1", '_': "3", '`': "7"}
+
+// render turns the markup of a sanitized message into escape sequences. A marker opens before a non-space at the
+// start of a word and closes after a non-space at the end of one, so 2 * 3 * 4 and snake_case stay as they are. Bold
+// and italics nest, code spans are taken literally.
+func render(text string) string {
+	var b strings.Builder
+	open := make(map[byte]bool)
+	// sgr switches to the styles open, and to code inside a code span.
+	sgr := func(code bool) {
+		codes := []string{"0"}
+		for _, m := range []byte{'*', '_'} {
+			if open[m] {
+				codes = append(codes, styles[m])
+			}
+		}
+		if code {
+			codes = append(codes, styles['`'])
+		}
+		b.WriteString("\033[" + strings.Join(codes, ";") + "m")
+	}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '`':
+			if end := strings.IndexByte(text[i+1:], '`'); end > 0 {
+				sgr(true)
+				b.WriteString(text[i+1 : i+1+end])
+				sgr(false)
+				i += end + 2
+				continue
+			}
+		case c == '*' || c == '_':
+			if open[c] && closesAt(text, i) {
+				open[c] = false
+				sgr(false)
+				i++
+				continue
+			}
+			if !open[c] && opensAt(text, i) && closer(text, i) > 0 {
+				open[c] = true
+				sgr(false)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	// a closer inside a code span leaves its style open.
+	if open['*'] || open['_'] {
+		b.WriteString("\033[0m")
+	}
+	return b.String()
+}
+
+// opensAt reports whether the marker at i may open a span: it starts a word and is followed by a non-space.
+func opensAt(text string, i int) bool {
+	if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == text[i] {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return !isWord(r)
+}
+
+// closesAt reports whether the marker at i may close a span: it follows a non-space and ends a word.
+func closesAt(text string, i int) bool {
+	if i == 0 || text[i-1] == ' ' || text[i-1] == text[i] {
+		return false
+	}
+	if i+1 == len(text) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(text[i+1:])
+	return !isWord(r)
+}
+
+// closer returns where the span opened by the marker at i closes, or -1 if it doesn't.
+func closer(text string, i int) int {
+	for j := i + 2; j < len(text); j++ {
+		if text[j] == text[i] && closesAt(text, j) {
+			return j
+		}
+	}
+	return -1
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// colorName shows a name in one of six colours, the same name always in the same one.
+func colorName(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return "\033[" + strconv.Itoa(31+int(h.Sum32()%6)) + "m" + name + "\033[0m"
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+// The cases follow the tests of pkg/markup of the redis chat service, which has the same rules.
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"unicode", "héllo wörld ✓", "héllo wörld ✓"},
+		{"whitespace", "a\tb\nc\rd", "a b c d"},
+		{"escape sequence", "\x1b[2Jgone", `\x1b[2Jgone`},
+		{"window title", "\x1b]0;pwned\x07", `\x1b]0;pwned\a`},
+		{"bell", "\x07", `\a`},
+		{"delete", "a\x7fb", `a\x7fb`},
+		{"c1 control", "a\u009bb", `a\u009bb`},
+		{"bidi override", "\u202etxt.exe", `\u202etxt.exe`},
+		{"bidi isolate", "a\u2066b\u2069", `a\u2066b\u2069`},
+		{"invalid utf-8", "a\xffb", `a\xffb`},
+		{"escapes are kept", `C:\x1b`, `C:\x1b`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitize(tt.in); got != tt.want {
+				t.Fatalf("expected sanitize(%q) = %q, got %q", tt.in, tt.want, got)
+			}
+			// sanitized text stays as it is.
+			if got := sanitize(tt.want); got != tt.want {
+				t.Fatalf("expected sanitize(%q) to change nothing, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	const (
+		reset  = "\033[0m"
+		bold   = "\033[0;1m"
+		italic = "\033[0;3m"
+		both   = "\033[0;1;3m"
+		code   = "\033[0;7m"
+	)
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"empty", "", ""},
+		{"bold", "*bold*", bold + "bold" + reset},
+		{"italics", "_it_", italic + "it" + reset},
+		{"code", "`x := 1`", code + "x := 1" + reset},
+		{"in a sentence", "a *b* c", "a " + bold + "b" + reset + " c"},
+		{"nested", "*_both_*", bold + both + "both" + bold + reset},
+		{"overlapping", "*a _b* c_", bold + "a " + both + "b" + italic + " c" + reset},
+		{"two spans", "*a* and *b*", bold + "a" + reset + " and " + bold + "b" + reset},
+		{"code is literal", "`*x*`", code + "*x*" + reset},
+		{"code in bold", "*a `b` c*", bold + "a " + "\033[0;1;7m" + "b" + bold + " c" + reset},
+		{"closer in a code span", "*a `b*`", bold + "a " + "\033[0;1;7m" + "b*" + bold + reset},
+		{"arithmetic", "2 * 3 * 4", "2 * 3 * 4"},
+		{"snake case", "snake_case_name", "snake_case_name"},
+		{"unicode words", "é_x_ and _x_é", "é_x_ and _x_é"},
+		{"unicode inside", "*héllo*", bold + "héllo" + reset},
+		{"unterminated bold", "*bold", "*bold"},
+		{"unterminated italics", "some _text", "some _text"},
+		{"unterminated code", "`code", "`code"},
+		{"empty code", "``", "``"},
+		{"doubled marker", "**", "**"},
+		{"closer after a space", "*a *", "*a *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(tt.in); got != tt.want {
+				t.Fatalf("expected render(%q) = %q, got %q", tt.in, tt.want, got)
+			}
+		})
+	}
+}
@@ -15,3 +15,12 @@ func (r *room) broadcast(sender *client, msg string) {
 		c.msg(msg)
 	}
 }
+
+func (r *room) chat(sender *client, text string) {
+	for _, c := range r.members {
+		if c == sender {
+			continue
+		}
+		c.chat(sender.name, text)
+	}
+}
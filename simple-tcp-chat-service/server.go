@@ -37,6 +37,8 @@ func (s *server) run() {
 			s.listRooms(cmd.client)
 		case CMD_MSG:
 			s.msg(cmd.client, cmd.args)
+		case CMD_MARKUP:
+			s.markup(cmd.client, cmd.args)
 		case CMD_QUIT:
 			s.quit(cmd.client)
 			// default:
@@ -87,7 +89,16 @@ func (s *server) msg(c *client, args []string) {
 		return
 	}
 	msg := strings.Join(args[1:], " ")
-	c.room.broadcast(c, fmt.Sprintf("%s: %s", c.name, msg))
+	c.room.chat(c, msg)
+}
+
+func (s *server) markup(c *client, args []string) {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		c.err(fmt.Errorf("on or off is required as a parameter for /markup command"))
+		return
+	}
+	c.markup = args[1] == "on"
+	c.msg("markup " + args[1])
 }
 
 func (s *server) quit(c *client) {
@@ -0,0 +1,245 @@
+// chat is the command line client of the chat service.
+//
+//	chat [command] [flags]
+//
+// Without a command it joins the chat. Every flag can also be set with a SIMPLE_CHAT_<FLAG> environment variable or
+// in the config file, see package config.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	"github.com/shameerb/tcp-chat-redis/pkg/config"
+	"github.com/shameerb/tcp-chat-redis/pkg/terminal"
+)
+
+// Exit codes.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitUnavailable: the server could not be reached in time.
+	exitUnavailable = 3
+	// exitDenied: the server turned the user down, the password is wrong or the name is taken.
+	exitDenied = 4
+)
+
+// command is a subcommand of chat. setup registers its flags and returns what runs it with the arguments left.
+type command struct {
+	name  string
+	args  string
+	help  string
+	setup func(fs *flag.FlagSet, conn *connection) func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"join", "", "join the chat (the default command)", setupJoin},
+		{"send", "<message>", "post a message and exit", setupSend},
+		{"tail", "", "print the messages as they come in until interrupted", setupTail},
+		{"users", "", "list the online users", setupUsers},
+		{"profiles", "", "list the profiles of the config file", setupProfiles},
+		{"help", "", "show this help", setupHelp},
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	name := "join"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := lookup(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "chat: unknown command %q\n\n", name)
+		usage()
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("chat "+cmd.name, flag.ContinueOnError)
+	conn := newConnection(fs)
+	runCmd := cmd.setup(fs, conn)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: chat %s [flags] %s\n\n%s\n\nflags:\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if err := conn.resolve(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "chat: %s\n", err)
+		return exitUsage
+	}
+	return runCmd(fs.Args())
+}
+
+func lookup(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: chat [command] [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\n\"chat <command> -h\" lists the flags of a command. Flags can be set with %s<FLAG> environment variables\n"+
+		"or in %s.\n", config.EnvPrefix, config.DefaultPath())
+}
+
+// connection holds the flags of the server to talk to and the user to talk as, shared by every command.
+type connection struct {
+	configPath    *string
+	profile       *string
+	user          *string
+	password      *string
+	serverAddr    *string
+	useTLS        *bool
+	tlsCA         *string
+	tlsCert       *string
+	tlsKey        *string
+	tlsServerName *string
+
+	file *config.File
+}
+
+func newConnection(fs *flag.FlagSet) *connection {
+	return &connection{
+		configPath:    fs.String("config", config.DefaultPath(), "config file"),
+		profile:       fs.String("profile", "", "server profile of the config file to use"),
+		user:          fs.String("user", "", "username of the client"),
+		password:      fs.String("password", "", "password of the user, if the server requires one"),
+		serverAddr:    fs.String("server_addr", "localhost:3000", "server address => host:port"),
+		useTLS:        fs.Bool("tls", false, "connect to the server over TLS. Implied by the other tls flags"),
+		tlsCA:         fs.String("tls_ca", "", "CA bundle to verify the server certificate with (system roots if empty)"),
+		tlsCert:       fs.String("tls_cert", "", "client certificate for mutual TLS"),
+		tlsKey:        fs.String("tls_key", "", "client certificate key for mutual TLS"),
+		tlsServerName: fs.String("tls_server_name", "", "override the server name expected in the server certificate"),
+	}
+}
+
+// resolve fills in the flags not given on the command line from the environment, then the profile, then the top
+// level of the config file.
+func (c *connection) resolve(fs *flag.FlagSet) error {
+	if err := config.ApplyEnv(fs); err != nil {
+		return err
+	}
+	file, err := config.Load(*c.configPath)
+	if err != nil {
+		return err
+	}
+	c.file = file
+	if *c.profile == "" {
+		*c.profile, _ = file.Get("", "profile")
+	}
+	sections := []string{""}
+	if *c.profile != "" {
+		section := "profile " + *c.profile
+		if !file.HasSection(section) {
+			return fmt.Errorf("no profile %q in %s", *c.profile, file.Path)
+		}
+		sections = []string{section, ""}
+	}
+	return file.Apply(fs, sections...)
+}
+
+// options are the client options of the flags.
+func (c *connection) options() ([]client.Option, error) {
+	opts := []client.Option{
+		client.WithServerAddr(*c.serverAddr),
+		client.WithUser(*c.user),
+		client.WithPassword(*c.password),
+	}
+	if *c.useTLS || *c.tlsCA != "" || *c.tlsCert != "" || *c.tlsKey != "" || *c.tlsServerName != "" {
+		cfg, err := common.ClientTLSConfig(*c.tlsCA, *c.tlsCert, *c.tlsKey, *c.tlsServerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls config: %w", err)
+		}
+		opts = append(opts, client.WithTLS(cfg))
+	}
+	return opts, nil
+}
+
+func setupJoin(fs *flag.FlagSet, conn *connection) func([]string) int {
+	plain := fs.Bool("plain", false, "read and write plain lines instead of the full screen ui")
+	markup := fs.Bool("markup", false, "show the markup of messages styled (*bold*, _italics_, code spans in backquotes) and names in colour")
+	identity := fs.String("identity", filepath.Join(config.Dir(), "identity"), "key pair direct messages are encrypted with, created if missing")
+	knownKeys := fs.String("known_keys", filepath.Join(config.Dir(), "known_keys"), "file the keys of the other users are pinned in")
+	return func(args []string) int {
+		if len(args) > 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		opts, err := conn.options()
+		if err != nil {
+			log.Print(err)
+			return exitError
+		}
+		key, err := client.LoadIdentity(*identity)
+		if err != nil {
+			log.Printf("failed to load the identity key: %s", err)
+			return exitError
+		}
+		opts = append(opts, client.WithIdentity(key), client.WithKeyStore(client.NewFileKeyStore(*knownKeys)))
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := terminal.Run(ctx, terminal.Settings{LineMode: *plain, Markup: *markup}, opts...); err != nil {
+			log.Printf("failed to start the client: %s", err)
+			return exitError
+		}
+		return exitOK
+	}
+}
+
+func setupProfiles(fs *flag.FlagSet, conn *connection) func([]string) int {
+	return func([]string) int {
+		profiles := conn.file.Profiles()
+		if len(profiles) == 0 {
+			fmt.Printf("no profiles in %s\n", conn.file.Path)
+			return exitOK
+		}
+		sort.Strings(profiles)
+		for _, name := range profiles {
+			addr, ok := conn.file.Get("profile "+name, "server_addr")
+			if !ok {
+				addr, _ = conn.file.Get("", "server_addr")
+			}
+			mark := " "
+			if name == *conn.profile {
+				mark = "*"
+			}
+			fmt.Printf("%s %-16s %s\n", mark, name, addr)
+		}
+		return exitOK
+	}
+}
+
+func setupHelp(*flag.FlagSet, *connection) func([]string) int {
+	return func([]string) int {
+		usage()
+		return exitOK
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"github.com/shameerb/tcp-chat-redis/pkg/terminal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// The scripting commands never read stdin: the username comes from the flags, the environment, the config file or
+// the client certificate, and they fail instead of asking.
+
+// open connects and opens a session, waiting at most timeout for the server.
+func open(conn *connection, timeout time.Duration) (*client.Client, int) {
+	opts, err := conn.options()
+	if err != nil {
+		log.Print(err)
+		return nil, exitError
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := client.Dial(ctx, opts...)
+	if err != nil {
+		if errors.Is(err, client.ErrNoUser) {
+			log.Print("-user is required")
+			return nil, exitUsage
+		}
+		log.Printf("could not connect to %s: %s", *conn.serverAddr, err)
+		return nil, exitCode(err)
+	}
+	return c, exitOK
+}
+
+// exitCode tells failures to reach the server and refusals by the server apart from other errors.
+func exitCode(err error) int {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return exitUnavailable
+	case codes.Unauthenticated, codes.PermissionDenied, codes.AlreadyExists:
+		return exitDenied
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return exitUnavailable
+	}
+	return exitError
+}
+
+// closeSession ends the session, turning a failure into the exit code if everything else went well.
+func closeSession(c *client.Client, code int) int {
+	if err := c.Close(); err != nil {
+		log.Printf("could not disconnect: %s", err)
+		if code == exitOK {
+			return exitCode(err)
+		}
+	}
+	return code
+}
+
+func setupSend(fs *flag.FlagSet, conn *connection) func([]string) int {
+	room := fs.String("room", "", "room to post to (the default room if empty)")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the server")
+	return func(args []string) int {
+		text := strings.Join(args, " ")
+		if strings.TrimSpace(text) == "" {
+			fs.Usage()
+			return exitUsage
+		}
+		c, code := open(conn, *timeout)
+		if c == nil {
+			return code
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		id, err := c.Send(ctx, *room, text)
+		if err != nil {
+			log.Printf("could not send the message: %s", err)
+			return closeSession(c, exitCode(err))
+		}
+		fmt.Println(id)
+		return closeSession(c, exitOK)
+	}
+}
+
+func setupTail(fs *flag.FlagSet, conn *connection) func([]string) int {
+	room := fs.String("room", "", "only print the messages of this room (and direct messages)")
+	asJSON := fs.Bool("json", false, "print every event as a line of JSON")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the server")
+	return func(args []string) int {
+		if len(args) > 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		c, code := open(conn, *timeout)
+		if c == nil {
+			return code
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		return tail(ctx, c, *room, *asJSON)
+	}
+}
+
+// tail prints the events of c until ctx is done or the client closes.
+func tail(ctx context.Context, c *client.Client, room string, asJSON bool) int {
+	for {
+		select {
+		case <-ctx.Done():
+			return closeSession(c, exitOK)
+		case ev, ok := <-c.Messages():
+			if !ok {
+				log.Print("stopped tailing: the client closed")
+				return exitUnavailable
+			}
+			if ev.GetKind() == pb.Event_TYPING || (room != "" && ev.GetRoom() != room && ev.GetRecipient() == "") {
+				continue
+			}
+			if err := printEvent(ev, asJSON); err != nil {
+				log.Printf("stopped tailing: %s", err)
+				return closeSession(c, exitError)
+			}
+		}
+	}
+}
+
+func setupUsers(fs *flag.FlagSet, conn *connection) func([]string) int {
+	asJSON := fs.Bool("json", false, "print every user as a line of JSON")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the server")
+	return func(args []string) int {
+		if len(args) > 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		c, code := open(conn, *timeout)
+		if c == nil {
+			return code
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		users, err := c.Users(ctx)
+		if err != nil {
+			log.Printf("could not list the users: %s", err)
+			return closeSession(c, exitCode(err))
+		}
+		for _, u := range users {
+			if !*asJSON {
+				fmt.Println(markup.Sanitize(u.GetName()))
+				continue
+			}
+			b, err := protojson.Marshal(u)
+			if err != nil {
+				log.Print(err)
+				return closeSession(c, exitError)
+			}
+			fmt.Printf("%s\n", b)
+		}
+		return closeSession(c, exitOK)
+	}
+}
+
+func printEvent(ev *pb.Event, asJSON bool) error {
+	if !asJSON {
+		_, err := fmt.Println(terminal.Render(ev))
+		return err
+	}
+	b, err := protojson.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", b)
+	return err
+}
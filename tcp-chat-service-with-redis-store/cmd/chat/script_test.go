@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/config"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// These tests run the commands against a server in the test process, listening on a loopback port since the
+// commands dial the address of their flags.
+
+// timeout bounds how long a test waits for the server or for output.
+const timeout = 5 * time.Second
+
+// newServer starts a server and returns its address.
+func newServer(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	s := server.NewServer(miniredis.RunT(t).Addr(), "", server.WithListener(lis))
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start the server: %s", err)
+	}
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// connect opens a session for user, closed at the end of the test.
+func connect(t *testing.T, addr, user string) *client.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := client.Dial(ctx, client.WithServerAddr(addr), client.WithUser(user))
+	if err != nil {
+		t.Fatalf("could not connect as %s: %s", user, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// captureStdout sends the lines written to os.Stdout to the channel returned until the func returned puts
+// os.Stdout back, which closes the channel once the lines are read.
+func captureStdout(t *testing.T) (<-chan string, func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create a pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	lines := make(chan string, 100)
+	go func() {
+		defer r.Close()
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	var once sync.Once
+	restore := func() {
+		once.Do(func() {
+			os.Stdout = stdout
+			w.Close()
+		})
+	}
+	t.Cleanup(restore)
+	return lines, restore
+}
+
+// chat runs a command with an empty config file and returns its exit code and output.
+func chat(t *testing.T, name string, args ...string) (int, []string) {
+	t.Helper()
+	cfg := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(cfg, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lines, restore := captureStdout(t)
+	code := run(append([]string{name, "-config", cfg}, args...))
+	restore()
+	var out []string
+	for line := range lines {
+		out = append(out, line)
+	}
+	return code, out
+}
+
+// unreachable is an address nothing listens on.
+func unreachable(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestExitCodes(t *testing.T) {
+	addr := newServer(t)
+	connect(t, addr, "alice")
+	down := unreachable(t)
+	t.Setenv(config.EnvName("user"), "")
+	tests := []struct {
+		name string
+		cmd  string
+		args []string
+		want int
+	}{
+		{"send", "send", []string{"-server_addr", addr, "-user", "bot", "hello"}, exitOK},
+		{"users", "users", []string{"-server_addr", addr, "-user", "bot"}, exitOK},
+		{"unknown command", "shout", nil, exitUsage},
+		{"unknown flag", "send", []string{"-loud", "hello"}, exitUsage},
+		{"no message", "send", []string{"-server_addr", addr, "-user", "bot"}, exitUsage},
+		{"blank message", "send", []string{"-server_addr", addr, "-user", "bot", " "}, exitUsage},
+		{"no user", "send", []string{"-server_addr", addr, "hello"}, exitUsage},
+		{"arguments to users", "users", []string{"-server_addr", addr, "-user", "bot", "all"}, exitUsage},
+		{"arguments to tail", "tail", []string{"-server_addr", addr, "-user", "bot", "all"}, exitUsage},
+		{"send to no server", "send", []string{"-server_addr", down, "-user", "bot", "-timeout", "300ms", "hello"}, exitUnavailable},
+		{"users of no server", "users", []string{"-server_addr", down, "-user", "bot", "-timeout", "300ms"}, exitUnavailable},
+		{"tail of no server", "tail", []string{"-server_addr", down, "-user", "bot", "-timeout", "300ms"}, exitUnavailable},
+		{"name taken", "send", []string{"-server_addr", addr, "-user", "alice", "hello"}, exitDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := chat(t, tt.cmd, tt.args...); code != tt.want {
+				t.Fatalf("expected exit code %d, got %d", tt.want, code)
+			}
+		})
+	}
+}
+
+func TestSendPrintsTheID(t *testing.T) {
+	addr := newServer(t)
+	alice := connect(t, addr, "alice")
+	code, out := chat(t, "send", "-server_addr", addr, "-user", "bot", "hello", "world")
+	if code != exitOK || len(out) != 1 {
+		t.Fatalf("expected exit code 0 and the id, got %d and %q", code, out)
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-alice.Messages():
+			if ev.GetKind() != pb.Event_TEXT || ev.GetSender() != "bot" {
+				continue
+			}
+			if ev.GetId() != out[0] || ev.GetBody() != "hello world" {
+				t.Fatalf("expected message %s saying %q, got %s saying %q", out[0], "hello world", ev.GetId(), ev.GetBody())
+			}
+			return
+		case <-deadline:
+			t.Fatal("alice got no message from bot")
+		}
+	}
+}
+
+func TestUsersOutput(t *testing.T) {
+	addr := newServer(t)
+	connect(t, addr, "alice")
+	connect(t, addr, "carol")
+
+	code, out := chat(t, "users", "-server_addr", addr, "-user", "bot")
+	sort.Strings(out)
+	if code != exitOK || strings.Join(out, ",") != "alice,bot,carol" {
+		t.Fatalf("expected exit code 0 and a name per line, got %d and %q", code, out)
+	}
+
+	code, out = chat(t, "users", "-server_addr", addr, "-user", "bot", "-json")
+	if code != exitOK {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	var names []string
+	for _, line := range out {
+		var u pb.UserInfo
+		if err := protojson.Unmarshal([]byte(line), &u); err != nil {
+			t.Fatalf("expected a user as JSON, got %q: %s", line, err)
+		}
+		names = append(names, u.GetName())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "alice,bot,carol" {
+		t.Fatalf("expected a line per user, got %q", names)
+	}
+}
+
+func TestTailOutput(t *testing.T) {
+	addr := newServer(t)
+	alice := connect(t, addr, "alice")
+	tests := []struct {
+		name   string
+		asJSON bool
+		match  func(line string) bool
+	}{
+		{"plain", false, func(line string) bool {
+			return strings.Contains(line, "alice") && strings.HasSuffix(line, "hello plain")
+		}},
+		{"json", true, func(line string) bool {
+			var ev pb.Event
+			return protojson.Unmarshal([]byte(line), &ev) == nil && ev.GetSender() == "alice" && ev.GetBody() == "hello json"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := connect(t, addr, "bot-"+tt.name)
+			lines, restore := captureStdout(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan int)
+			go func() { done <- tail(ctx, c, "", tt.asJSON) }()
+
+			sendCtx, sendCancel := context.WithTimeout(context.Background(), timeout)
+			defer sendCancel()
+			if _, err := alice.Send(sendCtx, "", "hello "+tt.name); err != nil {
+				t.Fatalf("could not send: %s", err)
+			}
+			deadline := time.After(timeout)
+		wait:
+			for {
+				select {
+				case line := <-lines:
+					if tt.match(line) {
+						break wait
+					}
+				case <-deadline:
+					t.Fatal("the message was not printed")
+				}
+			}
+			cancel()
+			if code := <-done; code != exitOK {
+				t.Fatalf("expected exit code 0 once interrupted, got %d", code)
+			}
+			restore()
+		})
+	}
+}
+
+func TestTailStopsWhenTheClientCloses(t *testing.T) {
+	addr := newServer(t)
+	c := connect(t, addr, "bot")
+	c.Close()
+	done := make(chan int)
+	go func() { done <- tail(context.Background(), c, "", false) }()
+	select {
+	case code := <-done:
+		if code != exitUnavailable {
+			t.Fatalf("expected exit code %d, got %d", exitUnavailable, code)
+		}
+	case <-time.After(timeout):
+		t.Fatal("tail kept going after the client closed")
+	}
+}
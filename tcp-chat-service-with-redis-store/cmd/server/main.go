@@ -1,20 +1,296 @@
+// server runs the chat server and its maintenance commands.
+//
+//	server [command] [flags]
+//
+// Without a command it runs the server. Every flag can also be set with a SIMPLE_CHAT_<FLAG> environment variable
+// or in the config file, see package config.
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	"github.com/shameerb/tcp-chat-redis/pkg/config"
 	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
 )
 
-var (
-	redisAddr = flag.String("redis_addr", "localhost:6379", "redis address to connect to as host:port")
-	grpcPort  = flag.String("grpc_port", "3000", "gRPC port")
+// Exit codes.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
 )
 
+// command is a subcommand of the server. setup registers its flags and returns what runs it with the arguments left.
+type command struct {
+	name  string
+	args  string
+	help  string
+	setup func(fs *flag.FlagSet) func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "", "run the server (the default command)", setupRun},
+		{"reindex", "", "rebuild the search index of the stored messages. Servers may keep running, don't run two at once", setupReindex},
+		{"hash-password", "<user>", "read a password from stdin and print the users_file line for the user", setupHashPassword},
+		{"help", "", "show this help", setupHelp},
+	}
+}
+
 func main() {
-	c := server.NewServer(*redisAddr, *grpcPort)
-	if err := c.Run(); err != nil {
-		log.Fatalf("failed to start the server: %s", err)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := lookup(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "server: unknown command %q\n\n", name)
+		usage()
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("server "+cmd.name, flag.ContinueOnError)
+	configPath := fs.String("config", config.DefaultPath(), "config file. The server reads its top level and [server] section")
+	runCmd := cmd.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: server %s [flags] %s\n\n%s\n\nflags:\n", cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	// the command line wins over the environment, which wins over the config file.
+	if err := config.ApplyEnv(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "server: %s\n", err)
+		return exitUsage
+	}
+	file, err := config.Load(*configPath)
+	if err == nil {
+		err = file.Apply(fs, "server", "")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "server: %s\n", err)
+		return exitUsage
+	}
+	return runCmd(fs.Args())
+}
+
+func lookup(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: server [command] [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\n\"server <command> -h\" lists the flags of a command. Flags can be set with %s<FLAG> environment variables\n"+
+		"or in %s.\n", config.EnvPrefix, config.DefaultPath())
+}
+
+// roomRetention collects the repeated -room_retention flags.
+type roomRetention map[string]server.Retention
+
+func (r roomRetention) String() string {
+	return fmt.Sprint(map[string]server.Retention(r))
+}
+
+func (r roomRetention) Set(value string) error {
+	room, spec, ok := strings.Cut(value, ":")
+	if !ok || room == "" {
+		return fmt.Errorf("expected room:limits, got %q", value)
+	}
+	limits, err := server.ParseRetention(spec)
+	if err != nil {
+		return err
+	}
+	r[room] = limits
+	return nil
+}
+
+// runFlags are the flags of the run command.
+type runFlags struct {
+	redisAddr         *string
+	grpcPort          *string
+	tlsCert           *string
+	tlsKey            *string
+	tlsCA             *string
+	requireClientCert *bool
+	httpAddr          *string
+	ratePerUser       *float64
+	burstPerUser      *int
+	rateGlobal        *float64
+	burstGlobal       *int
+	moderators        *string
+	attachmentsDir    *string
+	retention         *string
+	usersFile         *string
+	roomRetentions    roomRetention
+}
+
+func setupRun(fs *flag.FlagSet) func([]string) int {
+	f := &runFlags{
+		redisAddr:         fs.String("redis_addr", "localhost:6379", "redis address to connect to as host:port"),
+		grpcPort:          fs.String("grpc_port", "3000", "gRPC port"),
+		tlsCert:           fs.String("tls_cert", "", "server certificate. Enables TLS together with -tls_key"),
+		tlsKey:            fs.String("tls_key", "", "server certificate key"),
+		tlsCA:             fs.String("tls_ca", "", "CA bundle to verify client certificates with"),
+		requireClientCert: fs.Bool("require_client_cert", false, "require a client certificate signed by -tls_ca (mutual TLS)"),
+		httpAddr:          fs.String("http_addr", "", "optional host:port to serve the HTTP/JSON gateway on"),
+		ratePerUser:       fs.Float64("rate_per_user", float64(server.DefaultRateLimits.PerUser), "requests per second allowed for each user. 0 disables the limit"),
+		burstPerUser:      fs.Int("burst_per_user", server.DefaultRateLimits.PerUserBurst, "burst of requests allowed for each user"),
+		rateGlobal:        fs.Float64("rate_global", float64(server.DefaultRateLimits.Global), "requests per second allowed for the whole server. 0 disables the limit"),
+		burstGlobal:       fs.Int("burst_global", server.DefaultRateLimits.GlobalBurst, "burst of requests allowed for the whole server"),
+		moderators:        fs.String("moderators", "", "comma separated users that may edit and delete messages in every room, the only moderators of general"),
+		attachmentsDir:    fs.String("attachments_dir", "", "optional directory to keep uploaded attachments in. Attachments are disabled without it"),
+		retention:         fs.String("retention", "", "retention limits of every room and conversation as max_age=720h,max_count=10000,max_bytes=104857600. Unlimited by default"),
+		usersFile:         fs.String("users_file", "", "optional file of user:bcrypt-hash lines. When set, users must connect with a matching password"),
+		roomRetentions:    roomRetention{},
+	}
+	fs.Var(f.roomRetentions, "room_retention", "retention limits of a room as room:max_age=24h,max_count=100, replacing the limits of -retention it sets. Repeatable")
+	return func(args []string) int {
+		if len(args) > 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		opts, err := f.options()
+		if err != nil {
+			log.Print(err)
+			return exitError
+		}
+		c := server.NewServer(*f.redisAddr, *f.grpcPort, opts...)
+		if err := c.Run(); err != nil {
+			log.Printf("failed to start the server: %s", err)
+			return exitError
+		}
+		return exitOK
+	}
+}
+
+func (f *runFlags) options() ([]server.Option, error) {
+	opts := []server.Option{
+		server.WithRateLimits(server.RateLimits{
+			PerUser:      rate.Limit(*f.ratePerUser),
+			PerUserBurst: *f.burstPerUser,
+			Global:       rate.Limit(*f.rateGlobal),
+			GlobalBurst:  *f.burstGlobal,
+		}),
+	}
+	if *f.usersFile != "" {
+		d, err := server.NewFileDirectory(*f.usersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the users file: %w", err)
+		}
+		opts = append(opts, server.WithDirectory(d))
+	}
+	if *f.tlsCert != "" || *f.tlsKey != "" {
+		cfg, err := common.ServerTLSConfig(*f.tlsCert, *f.tlsKey, *f.tlsCA, *f.requireClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls config: %w", err)
+		}
+		opts = append(opts, server.WithTLS(cfg))
+	}
+	var moderators []string
+	for _, name := range strings.Split(*f.moderators, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			moderators = append(moderators, name)
+		}
+	}
+	if len(moderators) > 0 {
+		opts = append(opts, server.WithModerators(moderators...))
+	}
+	if *f.attachmentsDir != "" {
+		store, err := server.NewFileBlobStore(*f.attachmentsDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the attachments directory: %w", err)
+		}
+		opts = append(opts, server.WithBlobStore(store))
+	}
+	if *f.retention != "" {
+		limits, err := server.ParseRetention(*f.retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -retention: %w", err)
+		}
+		opts = append(opts, server.WithRetention(limits))
+	}
+	for room, limits := range f.roomRetentions {
+		opts = append(opts, server.WithRoomRetention(room, limits))
+	}
+	if *f.httpAddr != "" {
+		opts = append(opts, server.WithHTTP(*f.httpAddr))
+	}
+	return opts, nil
+}
+
+func setupReindex(fs *flag.FlagSet) func([]string) int {
+	redisAddr := fs.String("redis_addr", "localhost:6379", "redis address to connect to as host:port")
+	return func(args []string) int {
+		if len(args) > 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		n, err := server.Reindex(*redisAddr)
+		if err != nil {
+			log.Printf("failed to reindex: %s", err)
+			return exitError
+		}
+		log.Printf("indexed %d messages", n)
+		return exitOK
+	}
+}
+
+func setupHashPassword(fs *flag.FlagSet) func([]string) int {
+	return func(args []string) int {
+		if len(args) != 1 || args[0] == "" || strings.Contains(args[0], ":") {
+			fs.Usage()
+			return exitUsage
+		}
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("failed to read the password: %s", err)
+			return exitError
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			log.Print("the password is empty")
+			return exitError
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("failed to hash the password: %s", err)
+			return exitError
+		}
+		fmt.Printf("%s:%s\n", args[0], hash)
+		return exitOK
+	}
+}
+
+func setupHelp(*flag.FlagSet) func([]string) int {
+	return func([]string) int {
+		usage()
+		return exitOK
 	}
 }
@@ -3,12 +3,26 @@ module github.com/shameerb/tcp-chat-redis
 go 1.20
 
 require (
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
-	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/gdamore/tcell/v2 v2.7.4
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/golang/protobuf v1.5.3
+	github.com/mattn/go-runewidth v0.0.15
+	golang.org/x/crypto v0.18.0
+	golang.org/x/time v0.5.0
+	google.golang.org/grpc v1.61.0
+	google.golang.org/protobuf v1.32.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
 	golang.org/x/net v0.20.0 // indirect
-	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/term v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240125205218-1f4bbc51befe // indirect
-	google.golang.org/grpc v1.61.0 // indirect
-	google.golang.org/protobuf v1.32.0 // indirect
 )
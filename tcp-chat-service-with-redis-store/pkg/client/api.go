@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// SendDirect sends a direct message that only the recipient, and the sender's own sessions, receive. It is
+// end-to-end encrypted, and refused with a *KeyChangedError if the recipient's key changed. Without an identity it
+// fails with ErrNoIdentity, unless the client was given WithPlaintextDirect.
+func (c *Client) SendDirect(ctx context.Context, to, text string) error {
+	msg, err := c.seal(ctx, to, text)
+	if err != nil {
+		return err
+	}
+	_, err = c.chatServerClient.SendDirect(c.withSession(ctx), msg)
+	return c.checkConnection(err)
+}
+
+// Rename changes the username of the session. Direct messages then arrive for the new name, the server moves the
+// stream of events over.
+func (c *Client) Rename(ctx context.Context, name string) error {
+	if _, err := c.chatServerClient.Rename(c.withSession(ctx), &pb.RenameRequest{User: name}); err != nil {
+		return c.checkConnection(err)
+	}
+	c.mu.Lock()
+	c.user = name
+	c.mu.Unlock()
+	// the key directory is by name.
+	return c.publishKey(ctx)
+}
+
+// Edit changes the text of one of the user's messages.
+func (c *Client) Edit(ctx context.Context, id, text string) error {
+	_, err := c.chatServerClient.EditMessage(c.withSession(ctx), &pb.EditMessageRequest{Id: id, Body: text})
+	return c.checkConnection(err)
+}
+
+// Delete deletes one of the user's messages.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	_, err := c.chatServerClient.DeleteMessage(c.withSession(ctx), &pb.DeleteMessageRequest{Id: id})
+	return c.checkConnection(err)
+}
+
+// Revisions fetches the earlier versions of a message, oldest first. Only its author or a moderator may read them.
+func (c *Client) Revisions(ctx context.Context, id string) ([]*pb.Event, error) {
+	res, err := c.chatServerClient.GetRevisions(c.withSession(ctx), &pb.RevisionsRequest{Id: id})
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetRevisions(), nil
+}
+
+// React adds an emoji reaction to a message.
+func (c *Client) React(ctx context.Context, id, emoji string) error {
+	_, err := c.chatServerClient.AddReaction(c.withSession(ctx), &pb.ReactionRequest{Id: id, Emoji: emoji})
+	return c.checkConnection(err)
+}
+
+// Unreact takes back a reaction.
+func (c *Client) Unreact(ctx context.Context, id, emoji string) error {
+	_, err := c.chatServerClient.RemoveReaction(c.withSession(ctx), &pb.ReactionRequest{Id: id, Emoji: emoji})
+	return c.checkConnection(err)
+}
+
+// MarkRead marks a room read up to a message.
+func (c *Client) MarkRead(ctx context.Context, room, id string) error {
+	_, err := c.chatServerClient.MarkRead(c.withSession(ctx), &pb.MarkReadRequest{Room: room, MessageId: id})
+	return c.checkConnection(err)
+}
+
+// SetTyping tells a room the user started or stopped typing.
+func (c *Client) SetTyping(ctx context.Context, room string, typing bool) error {
+	_, err := c.chatServerClient.SetTyping(c.withSession(ctx), &pb.TypingRequest{Room: room, Typing: typing})
+	return c.checkConnection(err)
+}
+
+// SetTypingDirect tells a user the user started or stopped typing a direct message to them.
+func (c *Client) SetTypingDirect(ctx context.Context, to string, typing bool) error {
+	_, err := c.chatServerClient.SetTyping(c.withSession(ctx), &pb.TypingRequest{To: to, Typing: typing})
+	return c.checkConnection(err)
+}
+
+// History returns a page of the stored messages of a room, oldest first.
+func (c *Client) History(ctx context.Context, req *pb.HistoryRequest) ([]*pb.Event, error) {
+	res, err := c.chatServerClient.GetHistory(c.withSession(ctx), req)
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetEvents(), nil
+}
+
+// DirectHistory returns a page of the stored direct messages of a conversation, or of all the user's conversations
+// when the request names no peer, oldest first.
+func (c *Client) DirectHistory(ctx context.Context, req *pb.DirectHistoryRequest) ([]*pb.Event, error) {
+	res, err := c.chatServerClient.GetDirectHistory(c.withSession(ctx), req)
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetEvents(), nil
+}
+
+// Search returns the messages matching a query, newest first.
+func (c *Client) Search(ctx context.Context, query string) ([]*pb.SearchResult, error) {
+	res, err := c.chatServerClient.SearchMessages(c.withSession(ctx), &pb.SearchRequest{Query: query})
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetResults(), nil
+}
+
+// ListMentions returns a page of the room messages that mention the user, oldest first, and how many mentions are
+// still unread.
+func (c *Client) ListMentions(ctx context.Context, req *pb.ListMentionsRequest) ([]*pb.Event, int64, error) {
+	res, err := c.chatServerClient.ListMentions(c.withSession(ctx), req)
+	if err != nil {
+		return nil, 0, c.checkConnection(err)
+	}
+	return res.GetEvents(), res.GetUnread(), nil
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// uploadChunkSize is the size of the chunks files are uploaded in.
+const uploadChunkSize = 64 << 10
+
+// Upload sends a file to the server and shares it in a room. It returns the id of the message.
+func (c *Client) Upload(ctx context.Context, room, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stream, err := c.chatServerClient.UploadAttachment(c.withSession(ctx))
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	name := filepath.Base(path)
+	chunk := &pb.AttachmentChunk{Info: &pb.Attachment{Filename: name, MimeType: mime.TypeByExtension(filepath.Ext(name))}}
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 || chunk.Info != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				// the server's reason is returned by CloseAndRecv.
+				break
+			}
+			chunk = &pb.AttachmentChunk{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			return "", err
+		}
+	}
+	a, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	res, err := c.chatServerClient.Chat(c.withSession(ctx), &pb.Message{Room: room, Attachments: []string{a.GetId()}})
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	return res.GetId(), nil
+}
+
+// Download fetches an attachment into dir under its filename and checks its checksum. It does not overwrite
+// existing files. It returns the path of the file.
+func (c *Client) Download(ctx context.Context, id, dir string) (string, error) {
+	stream, err := c.chatServerClient.DownloadAttachment(c.withSession(ctx), &pb.DownloadRequest{Id: id})
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	info := first.GetInfo()
+	name := filepath.Join(dir, filepath.Base(info.GetFilename()))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	w := io.MultiWriter(f, hash)
+	for chunk := first; ; {
+		if _, err := w.Write(chunk.GetData()); err != nil {
+			f.Close()
+			os.Remove(name)
+			return "", err
+		}
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(name)
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if sum := "sha256:" + hex.EncodeToString(hash.Sum(nil)); sum != info.GetChecksum() {
+		os.Remove(name)
+		return "", errors.New("download is corrupt: checksum mismatch")
+	}
+	return name, nil
+}
@@ -0,0 +1,143 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newAttachmentHarness(t *testing.T) *harness {
+	t.Helper()
+	blobs, err := server.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHarness(t, server.WithBlobStore(blobs))
+}
+
+// writeFile writes content to a file named name in a new directory and returns its path.
+func writeFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAttachmentRoundTrip(t *testing.T) {
+	h := newAttachmentHarness(t)
+	alice, bob, carol := h.connect("alice"), h.connect("bob"), h.connect("carol")
+	// a few chunks and a bit.
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	path := writeFile(t, "notes.txt", content)
+
+	// bob joins ops, carol doesn't.
+	if _, err := bob.Send(context.Background(), "ops", "hi"); err != nil {
+		t.Fatalf("could not join ops: %s", err)
+	}
+	msg, err := alice.Upload(context.Background(), "ops", path)
+	if err != nil {
+		t.Fatalf("could not upload: %s", err)
+	}
+	ev := await(t, bob, func(ev *pb.Event) bool { return ev.GetId() == msg })
+	if len(ev.GetAttachments()) != 1 {
+		t.Fatalf("expected one attachment, got %v", ev.GetAttachments())
+	}
+	a := ev.GetAttachments()[0]
+	if a.GetFilename() != "notes.txt" || a.GetSize() != int64(len(content)) || a.GetUploader() != "alice" {
+		t.Fatalf("unexpected attachment metadata: %v", a)
+	}
+
+	for _, c := range []*client.Client{alice, bob} {
+		saved, err := c.Download(context.Background(), a.GetId(), t.TempDir())
+		if err != nil {
+			t.Fatalf("%s could not download: %s", c.User(), err)
+		}
+		if got, _ := os.ReadFile(saved); !bytes.Equal(got, content) || filepath.Base(saved) != "notes.txt" {
+			t.Fatalf("%s: expected the uploaded file as notes.txt, got %d bytes in %s", c.User(), len(got), saved)
+		}
+	}
+	// carol can't see any message sharing it.
+	if _, err := carol.Download(context.Background(), a.GetId(), t.TempDir()); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for carol outside ops, got %v", err)
+	}
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	h := newAttachmentHarness(t)
+	conn, err := grpc.Dial("bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return h.listener.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	api := pb.NewChatServiceClient(conn)
+	res, err := api.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), common.AUTH_METADATA, common.AUTH_SCHEME+res.GetToken())
+
+	// upload sends the chunks and returns the server's answer.
+	upload := func(filename string, chunks ...[]byte) error {
+		stream, err := api.UploadAttachment(ctx)
+		if err != nil {
+			return err
+		}
+		chunk := &pb.AttachmentChunk{Info: &pb.Attachment{Filename: filename}}
+		for _, data := range chunks {
+			chunk.Data = data
+			if err := stream.Send(chunk); err != nil {
+				break
+			}
+			chunk = &pb.AttachmentChunk{}
+		}
+		_, err = stream.CloseAndRecv()
+		return err
+	}
+	chunk := make([]byte, 1<<20)
+	tooMany := make([][]byte, server.MaxAttachmentSize/len(chunk)+1)
+	for i := range tooMany {
+		tooMany[i] = chunk
+	}
+	tests := []struct {
+		name     string
+		filename string
+		chunks   [][]byte
+		want     codes.Code
+	}{
+		{"empty file", "empty", [][]byte{nil}, codes.OK},
+		{"largest file", "large", tooMany[1:], codes.OK},
+		{"file too large", "large", tooMany, codes.ResourceExhausted},
+		{"chunk too large", "large", [][]byte{make([]byte, 5<<20)}, codes.ResourceExhausted},
+		{"no filename", "", [][]byte{chunk}, codes.InvalidArgument},
+		{"parent directory", "..", [][]byte{chunk}, codes.InvalidArgument},
+		{"current directory", ".", [][]byte{chunk}, codes.InvalidArgument},
+		{"path", "../etc/passwd", [][]byte{chunk}, codes.InvalidArgument},
+		{"windows path", `..\boot.ini`, [][]byte{chunk}, codes.InvalidArgument},
+		{"control characters", "a\x1b[2J.txt", [][]byte{chunk}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := upload(tt.filename, tt.chunks...); status.Code(err) != tt.want {
+				t.Fatalf("expected %s, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -1,218 +1,362 @@
+// Package client is the Go SDK of the chat service. Dial opens a session for a user, Messages delivers the events of
+// the rooms and of the user's direct messages, and the other methods call the server:
+//
+//	c, err := client.Dial(ctx, client.WithServerAddr("chat.example.com:3000"), client.WithUser("bot"))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	c.Send(ctx, "ops", "deploy done")
+//	for ev := range c.Messages() {
+//		fmt.Println(ev.GetSender(), ev.GetBody())
+//	}
+//
+// A Client only talks to the server, the events come on a stream from it. It keeps its session alive and reconnects
+// on its own when the server goes away. It has no global side effects: it does not read stdin, write to stdout,
+// handle signals or touch the standard logger unless given one with WithLogger.
 package client
 
 import (
-	"bufio"
 	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/signal"
-	"strings"
+	"net"
 	"sync"
-	"syscall"
+	"time"
 
-	"github.com/go-redis/redis"
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
 	"github.com/shameerb/tcp-chat-redis/pkg/common"
 	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
 	"google.golang.org/grpc"
+	grpcbackoff "google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
-// connect to redis to read messages, start a grpc connection with server to register and send commands, read from the buffer continuously,
-// you will have 3 go routines. 1-> listen to commands from user stdio,  2-> listen to messages from redis, 3 -> select waiting for ctx done, messages or listen chan.
+const (
+	defaultServerAddr = "localhost:3000"
+	// messagesBuffer is how many events Messages holds before the client waits for them to be read.
+	messagesBuffer = 64
+	// disconnectTimeout bounds how long Close waits for the server to end the session.
+	disconnectTimeout = 5 * time.Second
+)
+
+// ErrNoUser is returned by Dial when there is neither a username nor a client certificate to connect as.
+var ErrNoUser = errors.New("a username is required")
 
+// Client is a session with the chat server. Its methods may be called from several goroutines.
 type Client struct {
-	redisAddr        string
-	redis            *redis.Client
-	pubsub           *redis.PubSub
 	serverAddr       string
+	dialer           func(ctx context.Context, addr string) (net.Conn, error)
 	chatServerConn   *grpc.ClientConn
 	chatServerClient pb.ChatServiceClient
-	ctx              context.Context
-	cancel           context.CancelFunc
-	grpcCtx          context.Context
-	// grpcCtxCancel       context.CancelFunc
-	redisMessageChannel chan string
-	rcvChannel          chan string
-	user                string
-	writer              io.Writer
-	wg                  sync.WaitGroup
-}
-
-func NewClient(redisAddr, serverAddr, user string) *Client {
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Client{
-		redisAddr:           redisAddr,
-		serverAddr:          serverAddr,
-		ctx:                 ctx,
-		cancel:              cancel,
-		rcvChannel:          make(chan string, 1),
-		redisMessageChannel: make(chan string, 1),
-		writer:              os.Stdout,
-		user:                user,
-	}
-}
-
-func (c *Client) Run() error {
-	var err error
-	// initialize redis
-	c.redis = redis.NewClient(&redis.Options{
-		Addr:     c.redisAddr,
-		Password: "",
-		DB:       0,
-	})
-	// Check the redis connection is working.
-	_, err = c.redis.Ping().Result()
-	if err != nil {
-		log.Printf("Error connecting to redis: %s", err.Error())
-		return err
+	password         string
+	tlsConfig        *tls.Config
+	identity         *ecdh.PrivateKey
+	plaintext        bool
+	keys             KeyStore
+	logger           *log.Logger
+	onConnection     func(online bool, detail string)
+	// ctx ends with Close, it stops the goroutines of the client.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	messages  chan *pb.Event
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	// mu guards the user, the session and whether the client is online, which change on rename and reconnect.
+	mu     sync.Mutex
+	user   string
+	token  string
+	online bool
+	lost   chan struct{}
+	// stopStream ends the stream of events in use.
+	stopStream context.CancelFunc
+}
+
+// Option configures optional behaviour of the Client.
+type Option func(*Client)
+
+// WithServerAddr sets the chat server to connect to, localhost:3000 by default.
+func WithServerAddr(addr string) Option {
+	return func(c *Client) {
+		c.serverAddr = addr
 	}
+}
 
-	c.pubsub = c.redis.Subscribe(common.CHANNEL)
-	log.Printf("listening to redis on %s", c.redisAddr)
+// WithDialer makes the connections to the server with dial instead of over TCP, like to an in-memory listener in
+// tests. The server address is handed to dial as is.
+func WithDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) Option {
+	return func(c *Client) {
+		c.dialer = dial
+	}
+}
 
-	c.grpcCtx, _ = context.WithCancel(context.Background())
-	// defer c.grpcCtxCancel()
-	// c.grpcCtx = c.ctx
-	c.chatServerConn, err = grpc.DialContext(c.grpcCtx, c.serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	log.Println("connected to grpc server ...")
-	if err != nil {
-		log.Printf("failed to establish connection with server: %s", err)
-		return err
+// WithUser sets the username to connect as.
+func WithUser(user string) Option {
+	return func(c *Client) {
+		c.user = user
 	}
-	c.chatServerClient = pb.NewChatServiceClient(c.chatServerConn)
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	// todo: initialize the user. Block until the user is set. Ideally put a timeout for how long you can wait the client.
-	if c.user == "" {
-		c.initUser(scanner)
+// WithPassword sets the password of the user, if the server requires one.
+func WithPassword(password string) Option {
+	return func(c *Client) {
+		c.password = password
 	}
+}
 
-	// listen to commands from command line
-	go c.listenInputMessage(scanner)
-	go c.listenRedisMessage()
+// WithTLS dials the server over TLS. If the config carries a client certificate the username may be left empty,
+// the server then uses the certificate's identity.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
 
-	// wait for messages on the command channel or message from the redis channel. Act accordingly.
-	go c.process()
-	c.awaitShutdown()
-	return nil
+// WithLogger logs what the client does in the background, like losing the connection. Nothing is logged by
+// default.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
 }
 
-func (c *Client) listenInputMessage(scanner *bufio.Scanner) {
-	c.wg.Add(1)
-	defer c.wg.Done()
-	for {
-		select {
-		case <-c.ctx.Done():
-			log.Println("context cancel, exiting listen input message")
-			return
-		default:
-			// this will block the goroutine, even if a ctx done has been sent.
-			// todo: The problem with this is that it gets stuck on receiveMessage and doesnt loop back to the ctx.Done until you send a new message
-			log.Println("Waiting for message ...")
-			scanner.Scan()
-			log.Println("Reading message ...")
-			input_msg := scanner.Text()
-			log.Println("mssage " + input_msg)
-			if strings.Contains(input_msg, "#quit") {
-				log.Println("Exiting scanner goroutine")
-				return
-			}
-			c.rcvChannel <- input_msg
-		}
+// WithConnectionHandler calls fn when the client goes offline, on every attempt to get back, and once it is online
+// again. detail says what it is doing. fn is called from the client's goroutines and must not block.
+func WithConnectionHandler(fn func(online bool, detail string)) Option {
+	return func(c *Client) {
+		c.onConnection = fn
 	}
 }
 
-func (c *Client) listenRedisMessage() {
-	// c.wg.Add(1)
-	// defer c.wg.Done()
-	// todo: The context cancel wont work here because the ReceiveMessage entirely blocks and doesnt proceed to the ctx.Done statement until a new message comes in.
+// Dial connects to the server, opens a session for the user and subscribes to its events. ctx bounds the connecting only, the
+// client then runs until Close.
+func Dial(ctx context.Context, opts ...Option) (*Client, error) {
+	c := &Client{
+		serverAddr:   defaultServerAddr,
+		keys:         NewMemoryKeyStore(),
+		logger:       log.New(io.Discard, "", 0),
+		onConnection: func(bool, string) {},
+		messages:     make(chan *pb.Event, messagesBuffer),
+		lost:         make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.user == "" && (c.tlsConfig == nil || len(c.tlsConfig.Certificates) == 0) {
+		return nil, ErrNoUser
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err := c.dialServer(ctx); err != nil {
+		c.cancel()
+		return nil, err
+	}
+	if err := c.login(ctx); err != nil {
+		c.cancel()
+		c.chatServerConn.Close()
+		return nil, err
+	}
+	if err := c.subscribe(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not subscribe to the events: %w", err)
+	}
+	if err := c.publishKey(ctx); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("could not publish the identity key: %w", err)
+	}
+	c.wg.Add(2)
+	// keep the presence lease alive while the client is running.
+	go c.heartbeat()
+	go c.reconnect()
+	return c, nil
+}
 
-	for {
-		// select {
-		// case <-c.ctx.Done():
-		// 	log.Println("context cancel, exiting redis listen message")
-		// 	return
-		// default:
-		// todo: The problem with this is that it gets stuck on receiveMessage and doesnt loop back to the ctx.Done until you send a new message
-		log.Println("reading redis message")
-		msg, err := c.pubsub.ReceiveMessage()
-		if err != nil {
-			log.Fatalf("error listening to message on redis: %s", err)
-		}
-		c.redisMessageChannel <- msg.Payload
-		// }
+// dialServer connects to the chat server, giving up when ctx is done.
+func (c *Client) dialServer(ctx context.Context) error {
+	creds := insecure.NewCredentials()
+	if c.tlsConfig != nil {
+		creds = credentials.NewTLS(c.tlsConfig)
+	}
+	// the connection comes back by itself when the server does, backing off like reconnect.
+	params := grpc.ConnectParams{Backoff: grpcbackoff.DefaultConfig}
+	params.Backoff.BaseDelay, params.Backoff.MaxDelay = minBackoff, maxBackoff
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithConnectParams(params), grpc.WithBlock()}
+	if c.dialer != nil {
+		opts = append(opts, grpc.WithContextDialer(c.dialer))
+	}
+	conn, err := grpc.DialContext(ctx, c.serverAddr, opts...)
+	if err != nil {
+		return err
 	}
+	c.chatServerConn = conn
+	c.chatServerClient = pb.NewChatServiceClient(conn)
+	return nil
 }
 
-func (c *Client) process() {
-	c.wg.Add(1)
-	defer c.wg.Done()
-	for {
-		select {
-		case <-c.ctx.Done():
-			log.Println("context cancel, exiting process message")
-			return
-		case msg := <-c.rcvChannel:
-			req := &pb.Message{
-				User: c.user,
-				Msg:  msg,
-			}
-			_, err := c.chatServerClient.Chat(c.grpcCtx, req)
-			if err != nil {
-				log.Printf("could not send message to chat server: %s", err)
-				panic(err)
-			}
-		case msg := <-c.redisMessageChannel:
-			c.writer.Write([]byte(msg + "\n"))
-		}
+// login opens a session for the user. Every following rpc carries the session token.
+func (c *Client) login(ctx context.Context) error {
+	req := &pb.ConnectRequest{
+		User:     c.User(),
+		Password: c.password,
 	}
+	res, err := c.chatServerClient.Connect(ctx, req)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = res.GetUser()
+	c.token = res.GetToken()
+	c.online = true
+	return nil
+}
+
+// Messages delivers the events of every room and the direct messages of the user. It is closed by Close. Events
+// published while the client is offline are missed, History fetches them once it is back. Encrypted direct messages
+// come sealed, with an empty body: Decrypt opens them.
+func (c *Client) Messages() <-chan *pb.Event {
+	return c.messages
+}
+
+// User is the user the session is for.
+func (c *Client) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// Online reports whether the client is connected, rather than trying to get back.
+func (c *Client) Online() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.online
 }
 
-func (c *Client) initUser(scanner *bufio.Scanner) {
+// Send posts a message to a room, the default room when empty. It returns the id of the message.
+func (c *Client) Send(ctx context.Context, room, text string) (string, error) {
+	res, err := c.chatServerClient.Chat(c.withSession(ctx), &pb.Message{Msg: text, Room: room})
+	if err != nil {
+		return "", c.checkConnection(err)
+	}
+	return res.GetId(), nil
+}
+
+// Users returns every online user, going through all the pages.
+func (c *Client) Users(ctx context.Context) ([]*pb.UserInfo, error) {
+	var users []*pb.UserInfo
+	req := &pb.ListUsersRequest{PageSize: 500}
 	for {
-		c.write("> Enter a username: ")
-		scanner.Scan()
-		user := scanner.Text()
-		req := &pb.ConnectRequest{
-			User: user,
+		res, err := c.chatServerClient.ListUsers(c.withSession(ctx), req)
+		if err != nil {
+			return nil, c.checkConnection(err)
 		}
-		if _, err := c.chatServerClient.Connect(c.grpcCtx, req); err != nil {
-			c.writer.Write([]byte(err.Error()))
-			continue
+		users = append(users, res.GetUsers()...)
+		if res.GetNextPageToken() == "" {
+			return users, nil
 		}
-		// successfully set the user
-		c.user = user
-		break
+		req.PageToken = res.GetNextPageToken()
 	}
 }
 
-func (c *Client) write(msg string) {
-	c.writer.Write([]byte(msg))
+// Close ends the session and closes the connections. Messages is closed once the client has stopped.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		// ends the stream of events too.
+		c.cancel()
+		c.wg.Wait()
+		close(c.messages)
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		_, err = c.chatServerClient.Disconnect(c.withSession(ctx), &google_protobuf.Empty{})
+		c.chatServerConn.Close()
+	})
+	return err
 }
 
-func (c *Client) awaitShutdown() {
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	// wait until you get an interrupt signal
-	<-stop
-	c.stop()
+// subscribe opens a stream of events in place of the one before, once the server is subscribed, and hands its events
+// to Messages. ctx bounds the waiting for the server.
+func (c *Client) subscribe(ctx context.Context) error {
+	c.mu.Lock()
+	if c.stopStream != nil {
+		c.stopStream()
+	}
+	c.mu.Unlock()
+	streamCtx, cancel := context.WithCancel(c.ctx)
+	stream, err := c.chatServerClient.Subscribe(c.withSession(streamCtx), &google_protobuf.Empty{})
+	if err != nil {
+		cancel()
+		return err
+	}
+	// the server sends the headers once it is subscribed.
+	subscribed := make(chan error, 1)
+	go func() {
+		_, err := stream.Header()
+		subscribed <- err
+	}()
+	select {
+	case err = <-subscribed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return err
+	}
+	c.mu.Lock()
+	c.stopStream = cancel
+	c.mu.Unlock()
+	c.wg.Add(1)
+	go c.receive(streamCtx, stream)
+	return nil
 }
 
-func (c *Client) disconnect() {
-	_, err := c.chatServerClient.Disconnect(c.grpcCtx, &pb.DisconnectRequest{User: c.user})
-	if err != nil {
-		log.Printf("could not disconnect the user: %s", err)
+// receive hands the events of a stream to Messages until the stream ends. A stream that breaks takes the client
+// offline, reconnect opens a new one.
+func (c *Client) receive(ctx context.Context, stream pb.ChatService_SubscribeClient) {
+	defer c.wg.Done()
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			// replaced by another stream, or the client is closing.
+			if ctx.Err() == nil {
+				c.connectionLost(err)
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case c.messages <- ev:
+		}
 	}
 }
 
-func (c *Client) stop() {
-	log.Println("Stopping client service..")
-	c.cancel()
-	os.Stdout.Write([]byte("#quit"))
-	c.wg.Wait()
-	c.disconnect()
-	// wait for pending messages to be processed before closing all connections.
-	c.chatServerConn.Close()
-	c.redis.Close()
+func (c *Client) heartbeat() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(common.HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			// reconnect renews the session while offline.
+			if !c.Online() {
+				continue
+			}
+			_, err := c.chatServerClient.Heartbeat(c.session(), &google_protobuf.Empty{})
+			if lostConnection(err) || status.Code(err) == codes.NotFound {
+				c.connectionLost(err)
+			} else if err != nil {
+				c.logger.Printf("could not refresh presence lease: %s", err)
+			}
+		}
+	}
 }
@@ -0,0 +1,228 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// These tests run the server and its clients end to end in the test process: redis is an in-memory stand-in and
+// gRPC goes through an in-memory listener.
+
+// timeout bounds how long a test waits for the server or for an event.
+const timeout = 5 * time.Second
+
+// harness is a running server, stopped at the end of the test.
+type harness struct {
+	t        *testing.T
+	redis    *miniredis.Miniredis
+	listener *bufconn.Listener
+}
+
+func newHarness(t *testing.T, opts ...server.Option) *harness {
+	t.Helper()
+	h := &harness{t: t, redis: miniredis.RunT(t), listener: bufconn.Listen(1 << 20)}
+	s := server.NewServer(h.redis.Addr(), "", append([]server.Option{server.WithListener(h.listener)}, opts...)...)
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start the server: %s", err)
+	}
+	t.Cleanup(s.Stop)
+	return h
+}
+
+// dial opens a session for user.
+func (h *harness) dial(user string, opts ...client.Option) (*client.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return h.dialContext(ctx, user, opts...)
+}
+
+func (h *harness) dialContext(ctx context.Context, user string, opts ...client.Option) (*client.Client, error) {
+	opts = append([]client.Option{
+		client.WithServerAddr("bufconn"),
+		client.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return h.listener.DialContext(ctx)
+		}),
+		client.WithUser(user),
+	}, opts...)
+	return client.Dial(ctx, opts...)
+}
+
+// connect opens a session for user, closed at the end of the test.
+func (h *harness) connect(user string, opts ...client.Option) *client.Client {
+	h.t.Helper()
+	c, err := h.dial(user, opts...)
+	if err != nil {
+		h.t.Fatalf("could not connect as %s: %s", user, err)
+	}
+	h.t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// await reads the events of c until one matches.
+func await(t *testing.T, c *client.Client, match func(*pb.Event) bool) *pb.Event {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("%s: the client closed while waiting for an event", c.User())
+			}
+			if match(ev) {
+				return ev
+			}
+		case <-deadline:
+			t.Fatalf("%s: no matching event within %s", c.User(), timeout)
+		}
+	}
+}
+
+// event matches the events of a kind from a sender.
+func event(kind pb.Event_Kind, sender string) func(*pb.Event) bool {
+	return func(ev *pb.Event) bool {
+		return ev.GetKind() == kind && ev.GetSender() == sender
+	}
+}
+
+// onlineUsers lists the names of the online users, sorted.
+func onlineUsers(t *testing.T, c *client.Client) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	users, err := c.Users(ctx)
+	if err != nil {
+		t.Fatalf("could not list users: %s", err)
+	}
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.GetName())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestConnect(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice")
+
+	if alice.User() != "alice" || !alice.Online() {
+		t.Fatalf("expected an online session for alice, got %q online=%v", alice.User(), alice.Online())
+	}
+	if got := onlineUsers(t, alice); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("expected only alice to be online, got %v", got)
+	}
+	// the events of the others are streamed from then on.
+	h.connect("bob")
+	await(t, alice, event(pb.Event_JOIN, "bob"))
+}
+
+func TestDuplicateUsername(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice")
+
+	if _, err := h.dial("alice"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists connecting as alice twice, got %v", err)
+	}
+	// the first session is untouched.
+	if _, err := alice.Send(context.Background(), "", "still here"); err != nil {
+		t.Fatalf("alice could not send after the duplicate was refused: %s", err)
+	}
+	if got := onlineUsers(t, alice); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("expected only alice to be online, got %v", got)
+	}
+}
+
+func TestChatFanOut(t *testing.T) {
+	h := newHarness(t)
+	clients := []*client.Client{h.connect("alice"), h.connect("bob"), h.connect("carol")}
+
+	id, err := clients[0].Send(context.Background(), "", "hello everyone")
+	if err != nil {
+		t.Fatalf("could not send: %s", err)
+	}
+	// everyone gets it, the sender too.
+	for _, c := range clients {
+		ev := await(t, c, func(ev *pb.Event) bool { return ev.GetId() == id })
+		if ev.GetKind() != pb.Event_TEXT || ev.GetSender() != "alice" || ev.GetRoom() != "general" || ev.GetBody() != "hello everyone" {
+			t.Fatalf("%s got an unexpected message: %v", c.User(), ev)
+		}
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice")
+	h.connect("carol")
+	h.connect("bob")
+
+	want := []string{"alice", "bob", "carol"}
+	if got := onlineUsers(t, alice); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v to be online, got %v", want, got)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice")
+	bob := h.connect("bob")
+
+	if err := bob.Close(); err != nil {
+		t.Fatalf("could not disconnect bob: %s", err)
+	}
+	await(t, alice, event(pb.Event_LEAVE, "bob"))
+	if got := onlineUsers(t, alice); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("expected only alice to be online after bob left, got %v", got)
+	}
+	// the name is free again.
+	h.connect("bob")
+	await(t, alice, event(pb.Event_JOIN, "bob"))
+}
+
+func TestDirectMessagesArePrivate(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol := h.connect("alice", client.WithPlaintextDirect()), h.connect("bob"), h.connect("carol")
+
+	if err := alice.SendDirect(context.Background(), "bob", "psst"); err != nil {
+		t.Fatalf("could not send a direct message: %s", err)
+	}
+	if ev := await(t, bob, direct("bob")); ev.GetSender() != "alice" || ev.GetBody() != "psst" {
+		t.Fatalf("bob got an unexpected direct message: %v", ev)
+	}
+	// carol only gets the room message sent after it.
+	if _, err := alice.Send(context.Background(), "", "hello"); err != nil {
+		t.Fatalf("could not send: %s", err)
+	}
+	ev := await(t, carol, func(ev *pb.Event) bool { return ev.GetRecipient() != "" || ev.GetBody() == "hello" })
+	if ev.GetRecipient() != "" {
+		t.Fatalf("carol got a direct message for %s", ev.GetRecipient())
+	}
+
+	// the stream follows a rename, once it is announced.
+	if err := bob.Rename(context.Background(), "robert"); err != nil {
+		t.Fatalf("could not rename bob: %s", err)
+	}
+	await(t, bob, func(ev *pb.Event) bool { return ev.GetKind() == pb.Event_SYSTEM })
+	if err := alice.SendDirect(context.Background(), "robert", "psst again"); err != nil {
+		t.Fatalf("could not send a direct message: %s", err)
+	}
+	if ev := await(t, bob, direct("robert")); ev.GetBody() != "psst again" {
+		t.Fatalf("robert got an unexpected direct message: %v", ev)
+	}
+}
+
+// direct matches the direct messages to a user.
+func direct(to string) func(*pb.Event) bool {
+	return func(ev *pb.Event) bool { return ev.GetRecipient() == to }
+}
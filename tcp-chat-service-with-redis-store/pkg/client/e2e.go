@@ -0,0 +1,389 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Direct messages are end-to-end encrypted with the client's identity: an X25519 key pair whose public half it
+// publishes in the server's key directory on Dial. A client without one only sends direct messages in the clear
+// when told to with WithPlaintextDirect. A message is sealed with ChaCha20-Poly1305 under a key derived
+// with HKDF-SHA256 from the X25519 shared secret of the sender's and the recipient's keys, so the two of them, and
+// only them, can open it. The server and redis see the sealed message, who sent it and to whom.
+//
+// The keys of the peers are pinned the first time they are used, in a KeyStore. When a peer's key no longer
+// matches the pinned one, SendDirect refuses to send and Decrypt warns with a *KeyChangedError until Trust accepts
+// the new key, after the users compared the Fingerprint of it.
+
+// sealInfo binds the derived keys to their use.
+const sealInfo = "simple-chat direct message v1"
+
+// ErrNoIdentity is returned when a client without an identity is to send a direct message, unless
+// WithPlaintextDirect allows it, or to open a sealed one.
+var ErrNoIdentity = errors.New("no identity key to encrypt or open direct messages with")
+
+// KeyChangedError reports that the key published by a user is not the one pinned for them. Someone, maybe the
+// server, may be posing as them.
+type KeyChangedError struct {
+	User     string
+	Pinned   []byte
+	Received []byte
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("the key of %s changed from %s to %s", e.User, Fingerprint(e.Pinned), Fingerprint(e.Received))
+}
+
+// KeyStore pins the public keys of the peers.
+type KeyStore interface {
+	// PinnedKey returns the key pinned for a user, nil if there is none.
+	PinnedKey(user string) ([]byte, error)
+	Pin(user string, key []byte) error
+}
+
+// memoryKeyStore keeps the pins for as long as the client runs.
+type memoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// NewMemoryKeyStore returns a KeyStore that forgets the pins when the program ends. Clients use one by default.
+func NewMemoryKeyStore() KeyStore {
+	return &memoryKeyStore{keys: make(map[string][]byte)}
+}
+
+func (m *memoryKeyStore) PinnedKey(user string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys[user], nil
+}
+
+func (m *memoryKeyStore) Pin(user string, key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[user] = key
+	return nil
+}
+
+// fileKeyStore keeps the pins in a file of "<quoted user> <base64 key>" lines. Names may hold spaces, they are
+// quoted like Go strings.
+type fileKeyStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileKeyStore returns a KeyStore that keeps the pins in a file, created on the first pin.
+func NewFileKeyStore(path string) KeyStore {
+	return &fileKeyStore{path: path}
+}
+
+func (f *fileKeyStore) PinnedKey(user string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return keys[user], nil
+}
+
+func (f *fileKeyStore) Pin(user string, key []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys, err := f.read()
+	if err != nil {
+		return err
+	}
+	keys[user] = key
+	users := make([]string, 0, len(keys))
+	for u := range keys {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	var b bytes.Buffer
+	for _, u := range users {
+		fmt.Fprintf(&b, "%s %s\n", strconv.Quote(u), base64.StdEncoding.EncodeToString(keys[u]))
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(f.path, b.Bytes(), 0o600)
+}
+
+func (f *fileKeyStore) read() (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	file, err := os.Open(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		user, key, ok := parsePin(strings.TrimSpace(scanner.Text()))
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected <quoted user> <base64 key>", f.path, n)
+		}
+		keys[user] = key
+	}
+	return keys, scanner.Err()
+}
+
+// parsePin splits a line of a key file into the user and the key. Lines written before names were quoted are read
+// as well.
+func parsePin(line string) (string, []byte, bool) {
+	user, encoded, ok := strings.Cut(line, " ")
+	if strings.HasPrefix(line, `"`) {
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return "", nil, false
+		}
+		user, _ = strconv.Unquote(quoted)
+		encoded, ok = strings.CutPrefix(line[len(quoted):], " ")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	return user, key, ok && err == nil
+}
+
+// GenerateIdentity creates a new identity key pair.
+func GenerateIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// LoadIdentity reads the identity key pair kept in a file, creating it with a new one if there is no file yet.
+func LoadIdentity(path string) (*ecdh.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := GenerateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+		return key, os.WriteFile(path, []byte(encoded), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: not an identity key: %w", path, err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not an identity key: %w", path, err)
+	}
+	return key, nil
+}
+
+// Fingerprint is the short form of a public key users compare to make sure it is the right one, e.g.
+// "3f2a 9c41 07be …", 20 groups in all.
+func Fingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "(none)"
+	}
+	sum := sha256.Sum256(key)
+	digits := hex.EncodeToString(sum[:20])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// WithIdentity encrypts direct messages with the key pair. Its public key is published on Dial, replacing the one
+// the user published before, so a user connecting from several places should use the same identity everywhere.
+func WithIdentity(key *ecdh.PrivateKey) Option {
+	return func(c *Client) {
+		c.identity = key
+	}
+}
+
+// WithPlaintextDirect lets a client without an identity send direct messages in the clear, the server can read them.
+// Without it such a client refuses to send them with ErrNoIdentity.
+func WithPlaintextDirect() Option {
+	return func(c *Client) {
+		c.plaintext = true
+	}
+}
+
+// WithKeyStore pins the keys of the peers in store rather than in memory.
+func WithKeyStore(store KeyStore) Option {
+	return func(c *Client) {
+		c.keys = store
+	}
+}
+
+// IdentityKey is the public key of the client's identity, nil without one.
+func (c *Client) IdentityKey() []byte {
+	if c.identity == nil {
+		return nil
+	}
+	return c.identity.PublicKey().Bytes()
+}
+
+// publishKey puts the identity's public key in the key directory.
+func (c *Client) publishKey(ctx context.Context) error {
+	if c.identity == nil {
+		return nil
+	}
+	_, err := c.chatServerClient.PublishKey(c.withSession(ctx), &pb.PublishKeyRequest{PublicKey: c.IdentityKey()})
+	return c.checkConnection(err)
+}
+
+// PeerKey returns the key a user published. The first key seen for a user is pinned, a different one after that is
+// returned along with a *KeyChangedError.
+func (c *Client) PeerKey(ctx context.Context, user string) ([]byte, error) {
+	res, err := c.chatServerClient.GetKey(c.withSession(ctx), &pb.GetKeyRequest{User: user})
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetPublicKey(), c.checkPin(user, res.GetPublicKey())
+}
+
+// Trust pins the key a user currently publishes, accepting a change of key.
+func (c *Client) Trust(ctx context.Context, user string) ([]byte, error) {
+	res, err := c.chatServerClient.GetKey(c.withSession(ctx), &pb.GetKeyRequest{User: user})
+	if err != nil {
+		return nil, c.checkConnection(err)
+	}
+	return res.GetPublicKey(), c.keys.Pin(user, res.GetPublicKey())
+}
+
+// checkPin pins the key of a user seen for the first time, or compares it with the pinned one.
+func (c *Client) checkPin(user string, key []byte) error {
+	pinned, err := c.keys.PinnedKey(user)
+	if err != nil {
+		return err
+	}
+	if pinned == nil {
+		return c.keys.Pin(user, key)
+	}
+	if !bytes.Equal(pinned, key) {
+		return &KeyChangedError{User: user, Pinned: pinned, Received: key}
+	}
+	return nil
+}
+
+// seal encrypts a direct message to a user. Without an identity the message goes in the clear if the client was
+// told it may.
+func (c *Client) seal(ctx context.Context, to, text string) (*pb.DirectMessage, error) {
+	if c.identity == nil {
+		if !c.plaintext {
+			return nil, ErrNoIdentity
+		}
+		return &pb.DirectMessage{To: to, Msg: text}, nil
+	}
+	peer, err := c.PeerKey(ctx, to)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("%s has no key to encrypt for, they need to connect with a client that publishes one", to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.messageKey(peer, c.IdentityKey(), peer)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := &pb.Sealed{
+		SenderKey:    c.IdentityKey(),
+		RecipientKey: peer,
+		Nonce:        nonce,
+		Ciphertext:   aead.Seal(nil, nonce, []byte(text), associatedData(c.User(), to)),
+	}
+	return &pb.DirectMessage{To: to, Sealed: sealed}, nil
+}
+
+// Decrypt returns the text of an event, opening it if it is a sealed direct message. When the sender's key is not
+// the one pinned for them the text comes with a *KeyChangedError: it may not be from who it claims to be.
+func (c *Client) Decrypt(ev *pb.Event) (string, error) {
+	sealed := ev.GetSealed()
+	if sealed == nil {
+		return ev.GetBody(), nil
+	}
+	if c.identity == nil {
+		return "", ErrNoIdentity
+	}
+	var peer []byte
+	var pinErr error
+	switch self := c.IdentityKey(); {
+	case bytes.Equal(sealed.GetRecipientKey(), self):
+		peer = sealed.GetSenderKey()
+		if ev.GetSender() != ev.GetRecipient() {
+			pinErr = c.checkPin(ev.GetSender(), peer)
+		}
+	case bytes.Equal(sealed.GetSenderKey(), self):
+		// a message sent from another session of the user.
+		peer = sealed.GetRecipientKey()
+	default:
+		return "", errors.New("sealed for another key")
+	}
+	aead, err := c.messageKey(peer, sealed.GetSenderKey(), sealed.GetRecipientKey())
+	if err != nil {
+		return "", err
+	}
+	text, err := aead.Open(nil, sealed.GetNonce(), sealed.GetCiphertext(), associatedData(ev.GetSender(), ev.GetRecipient()))
+	if err != nil {
+		return "", errors.New("the message was tampered with or is not for this key")
+	}
+	var changed *KeyChangedError
+	if errors.As(pinErr, &changed) {
+		return string(text), pinErr
+	}
+	return string(text), nil
+}
+
+// messageKey derives the cipher the sender and the recipient seal their messages with from the shared secret of
+// the identity and the peer's key.
+func (c *Client) messageKey(peer, senderKey, recipientKey []byte) (cipher.AEAD, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := c.identity.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte(sealInfo), senderKey...), recipientKey...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// associatedData binds a sealed message to its sender and recipient, so it can't be passed off as another one.
+func associatedData(sender, recipient string) []byte {
+	return []byte(sender + "\x00" + recipient)
+}
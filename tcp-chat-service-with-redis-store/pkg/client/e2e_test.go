@@ -0,0 +1,137 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+func identity(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := client.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealedDirectMessage(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice", client.WithIdentity(identity(t)))
+	bob := h.connect("bob", client.WithIdentity(identity(t)))
+
+	if err := alice.SendDirect(context.Background(), "bob", "psst"); err != nil {
+		t.Fatalf("could not send a sealed message: %s", err)
+	}
+	// the recipient and the sender's own sessions can open it, the server only sees it sealed.
+	for _, c := range []*client.Client{bob, alice} {
+		ev := await(t, c, direct("bob"))
+		if ev.GetSealed() == nil || ev.GetBody() != "" {
+			t.Fatalf("%s: expected a sealed message without a body, got %v", c.User(), ev)
+		}
+		if text, err := c.Decrypt(ev); err != nil || text != "psst" {
+			t.Fatalf("%s: expected to open %q, got %q %v", c.User(), "psst", text, err)
+		}
+	}
+}
+
+func TestSealedMessageIsBoundToItsUsers(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice", client.WithIdentity(identity(t)))
+	bob := h.connect("bob", client.WithIdentity(identity(t)))
+	carol := h.connect("carol", client.WithIdentity(identity(t)))
+
+	if err := alice.SendDirect(context.Background(), "bob", "psst"); err != nil {
+		t.Fatalf("could not send a sealed message: %s", err)
+	}
+	ev := await(t, bob, direct("bob"))
+	if _, err := carol.Decrypt(ev); err == nil {
+		t.Fatal("expected carol not to open a message sealed for bob")
+	}
+	// passed off as sent by carol.
+	forged := &pb.Event{Sender: "carol", Recipient: "bob", Sealed: ev.GetSealed()}
+	if _, err := bob.Decrypt(forged); err == nil {
+		t.Fatal("expected a message with another sender not to open")
+	}
+}
+
+func TestSendDirectWithoutIdentity(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice")
+	h.connect("bob")
+
+	if err := alice.SendDirect(context.Background(), "bob", "psst"); !errors.Is(err, client.ErrNoIdentity) {
+		t.Fatalf("expected ErrNoIdentity sending in the clear without opting in, got %v", err)
+	}
+}
+
+func TestKeyChange(t *testing.T) {
+	h := newHarness(t)
+	alice := h.connect("alice", client.WithIdentity(identity(t)))
+	bob, err := h.dial("bob", client.WithIdentity(identity(t)))
+	if err != nil {
+		t.Fatalf("could not connect as bob: %s", err)
+	}
+	// the first key seen is pinned.
+	if err := alice.SendDirect(context.Background(), "bob", "hello"); err != nil {
+		t.Fatalf("could not send a sealed message: %s", err)
+	}
+	bob.Close()
+	h.connect("bob", client.WithIdentity(identity(t)))
+
+	var changed *client.KeyChangedError
+	if err := alice.SendDirect(context.Background(), "bob", "still you?"); !errors.As(err, &changed) || changed.User != "bob" {
+		t.Fatalf("expected a KeyChangedError for bob, got %v", err)
+	}
+	key, err := alice.Trust(context.Background(), "bob")
+	if err != nil {
+		t.Fatalf("could not trust the new key: %s", err)
+	}
+	if !bytes.Equal(key, changed.Received) {
+		t.Fatal("expected the trusted key to be the one reported")
+	}
+	if err := alice.SendDirect(context.Background(), "bob", "hello again"); err != nil {
+		t.Fatalf("could not send after trusting the new key: %s", err)
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_keys")
+	pins := map[string][]byte{"alice": {1, 2, 3}, "b o b": {4, 5, 6}, `"quoted"`: {7}}
+	store := client.NewFileKeyStore(path)
+	for user, key := range pins {
+		if err := store.Pin(user, key); err != nil {
+			t.Fatalf("could not pin %q: %s", user, err)
+		}
+	}
+
+	// a new store reads them back.
+	store = client.NewFileKeyStore(path)
+	for user, key := range pins {
+		got, err := store.PinnedKey(user)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("expected the pin of %q to be %v, got %v %v", user, key, got, err)
+		}
+	}
+	if got, err := store.PinnedKey("carol"); got != nil || err != nil {
+		t.Fatalf("expected no pin for carol, got %v %v", got, err)
+	}
+}
+
+func TestFileKeyStoreReadsUnquotedNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_keys")
+	if err := os.WriteFile(path, []byte("alice AQID\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.NewFileKeyStore(path).PinnedKey("alice")
+	if err != nil || !bytes.Equal(got, []byte{1, 2, 3}) {
+		t.Fatalf("expected the pin written before names were quoted, got %v %v", got, err)
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// When the server goes away the client goes offline: whatever noticed it signals lost, and reconnect retries with a
+// jittered exponential backoff until the session is back, renewed if the server still knows it or opened again with
+// Connect, and the stream of events is open again. The connection handler hears about each step.
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// backoff computes the delays between reconnect attempts: doubling from min up to max, each picked at random
+// between half and the whole of it so clients cut off together don't all come back at once.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		d = b.min << b.attempt
+		b.attempt++
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// lostConnection reports whether an rpc failed because the server is unreachable or no longer knows the session.
+func lostConnection(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unauthenticated:
+		return true
+	}
+	return false
+}
+
+// session is the context background rpcs are made with. It carries the session token, which changes on reconnect.
+func (c *Client) session() context.Context {
+	return c.withSession(c.ctx)
+}
+
+// withSession adds the session token to ctx.
+func (c *Client) withSession(ctx context.Context) context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return metadata.AppendToOutgoingContext(ctx, common.AUTH_METADATA, common.AUTH_SCHEME+c.token)
+}
+
+// checkConnection starts reconnecting if err says the connection is lost. It returns err.
+func (c *Client) checkConnection(err error) error {
+	if lostConnection(err) {
+		c.connectionLost(err)
+	}
+	return err
+}
+
+// connectionLost takes the client offline and starts reconnecting, unless it already is.
+func (c *Client) connectionLost(err error) {
+	c.mu.Lock()
+	wasOnline := c.online
+	c.online = false
+	c.mu.Unlock()
+	if wasOnline {
+		c.logger.Printf("connection lost: %s", err)
+		c.onConnection(false, "reconnecting…")
+	}
+	select {
+	case c.lost <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) reconnect() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.lost:
+		}
+		b := backoff{min: minBackoff, max: maxBackoff}
+		for {
+			err := c.resume()
+			if err == nil {
+				break
+			}
+			d := b.next()
+			c.onConnection(false, fmt.Sprintf("reconnecting in %s: %s", d.Round(100*time.Millisecond), status.Convert(err).Message()))
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(d):
+			}
+		}
+		// losses noticed while reconnecting are covered.
+		select {
+		case <-c.lost:
+		default:
+		}
+		c.mu.Lock()
+		c.online = true
+		c.mu.Unlock()
+		c.logger.Print("reconnected")
+		c.onConnection(true, "")
+	}
+}
+
+// resume gets the session back and opens a new stream of events.
+func (c *Client) resume() error {
+	_, err := c.chatServerClient.Heartbeat(c.session(), &google_protobuf.Empty{})
+	if err == nil {
+		return c.subscribe(c.ctx)
+	}
+	if code := status.Code(err); code != codes.NotFound && code != codes.Unauthenticated {
+		return err
+	}
+	// the session is gone, open a new one. The old presence lease may have to run out first.
+	res, err := c.chatServerClient.Connect(c.ctx, &pb.ConnectRequest{User: c.User(), Password: c.password})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.token = res.GetToken()
+	c.mu.Unlock()
+	if err := c.publishKey(c.ctx); err != nil {
+		return err
+	}
+	return c.subscribe(c.ctx)
+}
@@ -0,0 +1,187 @@
+package client_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pki issues certificates from a test CA and writes them to files, as the flags take them.
+type pki struct {
+	t      *testing.T
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newPKI(t *testing.T) *pki {
+	t.Helper()
+	p := &pki{t: t, dir: t.TempDir()}
+	p.ca, p.caKey, p.caFile, _ = p.issue("test ca", nil, true)
+	return p
+}
+
+// issue creates a certificate for name, signed by the CA (self-signed for the CA itself), and returns the paths of
+// its certificate and key.
+func (p *pki) issue(name string, dnsNames []string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	p.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(p.serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	parent, signer := tmpl, key
+	if p.ca != nil {
+		parent, signer = p.ca, p.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(p.dir, name+".crt"), filepath.Join(p.dir, name+".key")
+	p.write(certFile, "CERTIFICATE", der)
+	p.write(keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, key, certFile, keyFile
+}
+
+func (p *pki) write(path, kind string, der []byte) {
+	p.t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// newTLSHarness runs a server over TLS that verifies the client certificates of the CA, and requires one if
+// required is set.
+func newTLSHarness(t *testing.T, p *pki, required bool) *harness {
+	t.Helper()
+	_, _, certFile, keyFile := p.issue("server", []string{"bufconn"}, false)
+	cfg, err := common.ServerTLSConfig(certFile, keyFile, p.caFile, required)
+	if err != nil {
+		t.Fatalf("could not configure the server: %s", err)
+	}
+	return newHarness(t, server.WithTLS(cfg))
+}
+
+// withCert dials with the client certificate of name, or with none if name is empty.
+func withCert(t *testing.T, p *pki, name string) client.Option {
+	t.Helper()
+	var certFile, keyFile string
+	if name != "" {
+		_, _, certFile, keyFile = p.issue(name, nil, false)
+	}
+	cfg, err := common.ClientTLSConfig(p.caFile, certFile, keyFile, "bufconn")
+	if err != nil {
+		t.Fatalf("could not configure the client: %s", err)
+	}
+	return client.WithTLS(cfg)
+}
+
+func TestClientCertificateNamesTheUser(t *testing.T) {
+	p := newPKI(t)
+	h := newTLSHarness(t, p, false)
+
+	// the name can be left to the certificate.
+	c, err := h.dial("", withCert(t, p, "alice"))
+	if err != nil {
+		t.Fatalf("could not connect with a certificate: %s", err)
+	}
+	defer c.Close()
+	if c.User() != "alice" {
+		t.Fatalf("expected the session of the certificate's alice, got %q", c.User())
+	}
+	// and may not be swapped for another one.
+	if err := c.Rename(context.Background(), "mallory"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied renaming a certified user, got %v", err)
+	}
+	if _, err := h.dial("bob", withCert(t, p, "carol")); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied connecting as someone else than the certificate, got %v", err)
+	}
+	// a certificate naming the user is fine.
+	dave, err := h.dial("dave", withCert(t, p, "dave"))
+	if err != nil {
+		t.Fatalf("could not connect as the certificate's own name: %s", err)
+	}
+	dave.Close()
+}
+
+// refused tries to connect, expecting the handshake to fail. The client keeps retrying until its deadline.
+func refused(h *harness, user string, opts ...client.Option) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c, err := h.dialContext(ctx, user, opts...)
+	if err == nil {
+		c.Close()
+	}
+	return err != nil
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	p := newPKI(t)
+	h := newTLSHarness(t, p, true)
+
+	if !refused(h, "alice", withCert(t, p, "")) {
+		t.Fatal("expected a connection without a certificate to be refused")
+	}
+	// a certificate from another CA doesn't count.
+	other := newPKI(t)
+	_, _, certFile, keyFile := other.issue("alice", nil, false)
+	cfg, err := common.ClientTLSConfig(p.caFile, certFile, keyFile, "bufconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !refused(h, "alice", client.WithTLS(cfg)) {
+		t.Fatal("expected a certificate of another CA to be refused")
+	}
+	c := h.connect("", withCert(t, p, "alice"))
+	if c.User() != "alice" {
+		t.Fatalf("expected the session of alice, got %q", c.User())
+	}
+}
+
+func TestRequireClientCertNeedsCA(t *testing.T) {
+	p := newPKI(t)
+	_, _, certFile, keyFile := p.issue("server", []string{"bufconn"}, false)
+	if _, err := common.ServerTLSConfig(certFile, keyFile, "", true); err == nil {
+		t.Fatal("expected requiring client certificates without a CA to be refused")
+	}
+	if _, err := common.ServerTLSConfig(certFile, keyFile, "", false); err != nil {
+		t.Fatalf("expected plain TLS without a CA to work: %s", err)
+	}
+}
@@ -1,5 +1,27 @@
 package common
 
+import "time"
+
 const (
 	CHANNEL = "chat"
+	// USER_CHANNEL_PREFIX prefixes the per-user channel direct messages are delivered on.
+	USER_CHANNEL_PREFIX = "chat.user."
+	// DEFAULT_ROOM is the room messages are posted to when none is given.
+	DEFAULT_ROOM = "general"
+
+	// HEARTBEAT_INTERVAL is how often a client refreshes its presence lease.
+	HEARTBEAT_INTERVAL = 5 * time.Second
+	// LEASE_TTL is how long a presence lease survives without a heartbeat.
+	LEASE_TTL = 3 * HEARTBEAT_INTERVAL
+	// TYPING_TTL is how long a typing indicator is shown unless the user keeps typing.
+	TYPING_TTL = 5 * time.Second
+
+	// AUTH_METADATA is the grpc metadata key carrying the session token as "Bearer <token>".
+	AUTH_METADATA = "authorization"
+	AUTH_SCHEME   = "Bearer "
 )
+
+// UserChannel is the channel carrying the direct messages of a user.
+func UserChannel(user string) string {
+	return USER_CHANNEL_PREFIX + user
+}
@@ -0,0 +1,181 @@
+// Package config reads the settings of the chat commands from the environment and a config file. Settings are named
+// like the command line flags. A flag given on the command line wins over the environment, which wins over the file.
+//
+// The file is made of "name = value" lines, "#" starts a comment. Lines before the first "[section]" header are the
+// top level, shared by every command. A section is only read by the commands it is meant for: "[server]" by the
+// server and "[profile <name>]" by the client run with -profile <name>:
+//
+//	redis_addr = localhost:6379
+//	user = alice
+//
+//	[server]
+//	grpc_port = 3000
+//
+//	[profile work]
+//	server_addr = chat.example.com:3000
+//	tls = true
+//
+// Settings a command has no flag for are ignored, so the top level can hold the settings of every command.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables that set flags, SIMPLE_CHAT_SERVER_ADDR sets -server_addr.
+const EnvPrefix = "SIMPLE_CHAT_"
+
+// Dir is the directory of the config file and of the other files the commands keep, usually ~/.config/simple-chat.
+func Dir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "simple-chat")
+}
+
+// DefaultPath is where the config file is read from unless -config says otherwise, usually
+// ~/.config/simple-chat/config.
+func DefaultPath() string {
+	if Dir() == "" {
+		return ""
+	}
+	return filepath.Join(Dir(), "config")
+}
+
+// EnvName is the environment variable that sets the flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// File holds the settings of a config file by section. The top level is the section "".
+type File struct {
+	Path     string
+	sections map[string]map[string]string
+}
+
+// Load reads a config file. A missing file at the default path is not an error, it is an empty file.
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && path == DefaultPath() {
+		return &File{Path: path, sections: map[string]map[string]string{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(path, f)
+}
+
+// Parse reads config file settings from r. path names the file in errors.
+func Parse(path string, r io.Reader) (*File, error) {
+	file := &File{Path: path, sections: map[string]map[string]string{"": {}}}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: expected [section], got %q", path, n, line)
+			}
+			// "[profile  work]" is the same section as "[profile work]".
+			section = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			if file.sections[section] == nil {
+				file.sections[section] = map[string]string{}
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name = value, got %q", path, n, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		file.sections[section][name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// HasSection reports whether the file has the section.
+func (f *File) HasSection(section string) bool {
+	_, ok := f.sections[section]
+	return ok
+}
+
+// Get returns a setting of a section.
+func (f *File) Get(section, name string) (string, bool) {
+	value, ok := f.sections[section][name]
+	return value, ok
+}
+
+// Profiles returns the names of the "[profile <name>]" sections.
+func (f *File) Profiles() []string {
+	var profiles []string
+	for section := range f.sections {
+		if name, ok := strings.CutPrefix(section, "profile "); ok {
+			profiles = append(profiles, name)
+		}
+	}
+	return profiles
+}
+
+// Apply sets the flags that are still unset from the sections, the first section with the setting wins.
+func (f *File) Apply(fs *flag.FlagSet, sections ...string) error {
+	return apply(fs, func(name string) (string, string, bool) {
+		for _, section := range sections {
+			if value, ok := f.sections[section][name]; ok {
+				where := f.Path
+				if section != "" {
+					where += " [" + section + "]"
+				}
+				return value, where, true
+			}
+		}
+		return "", "", false
+	})
+}
+
+// ApplyEnv sets the flags not given on the command line from the environment.
+func ApplyEnv(fs *flag.FlagSet) error {
+	return apply(fs, func(name string) (string, string, bool) {
+		value, ok := os.LookupEnv(EnvName(name))
+		return value, EnvName(name), ok
+	})
+}
+
+// apply sets the unset flags lookup has a value for.
+func apply(fs *flag.FlagSet, lookup func(name string) (value, where string, ok bool)) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, where, ok := lookup(f.Name)
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("invalid %s in %s: %s", f.Name, where, e)
+		}
+	})
+	return err
+}
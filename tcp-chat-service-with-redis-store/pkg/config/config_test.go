@@ -0,0 +1,159 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testFile = `
+# shared by every command
+user = top
+server_addr = "top:3000"
+colour = blue
+
+[profile  work]
+server_addr = work:3000
+shoe_size = 42
+
+[server]
+grpc_port = 4000
+`
+
+// flags are the flags of a command like chat.
+func flags() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs, map[string]*string{
+		"user":        fs.String("user", "", ""),
+		"server_addr": fs.String("server_addr", "localhost:3000", ""),
+		"password":    fs.String("password", "", ""),
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		sections []string
+		flag     string
+		want     string
+	}{
+		{"flag over everything", []string{"-server_addr", "flag:3000"}, map[string]string{"server_addr": "env:3000"}, []string{"profile work", ""}, "server_addr", "flag:3000"},
+		{"env over the profile", nil, map[string]string{"server_addr": "env:3000"}, []string{"profile work", ""}, "server_addr", "env:3000"},
+		{"empty env still set", nil, map[string]string{"server_addr": ""}, []string{"profile work", ""}, "server_addr", ""},
+		{"profile over the top level", nil, nil, []string{"profile work", ""}, "server_addr", "work:3000"},
+		{"top level without a profile", nil, nil, []string{""}, "server_addr", "top:3000"},
+		{"top level under a profile", nil, nil, []string{"profile work", ""}, "user", "top"},
+		{"default when unset", nil, nil, []string{"profile work", ""}, "password", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"user", "server_addr", "password"} {
+				if value, ok := tt.env[name]; ok {
+					t.Setenv(EnvName(name), value)
+				} else {
+					// t.Setenv puts the variable back at the end of the test.
+					t.Setenv(EnvName(name), "")
+					os.Unsetenv(EnvName(name))
+				}
+			}
+			fs, values := flags()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := ApplyEnv(fs); err != nil {
+				t.Fatalf("expected the environment to apply, got %s", err)
+			}
+			file, err := Parse("config", strings.NewReader(testFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Apply(fs, tt.sections...); err != nil {
+				t.Fatalf("expected the file to apply, got %s", err)
+			}
+			if got := *values[tt.flag]; got != tt.want {
+				t.Fatalf("expected -%s to be %q, got %q", tt.flag, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUnknownKeysAreIgnored(t *testing.T) {
+	file, err := Parse("config", strings.NewReader(testFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, _ := flags()
+	if err := file.Apply(fs, "profile work", "server", ""); err != nil {
+		t.Fatalf("expected settings without a flag to be ignored, got %s", err)
+	}
+	if value, ok := file.Get("", "colour"); !ok || value != "blue" {
+		t.Fatalf("expected the unknown setting to be kept, got %q", value)
+	}
+	if profiles := file.Profiles(); len(profiles) != 1 || profiles[0] != "work" {
+		t.Fatalf("expected the work profile, got %q", profiles)
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("tls", false, "")
+	file, err := Parse("config", strings.NewReader("[profile work]\ntls = maybe\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Apply(fs, "profile work")
+	if err == nil || !strings.Contains(err.Error(), "config [profile work]") {
+		t.Fatalf("expected an error naming the section, got %v", err)
+	}
+
+	t.Setenv(EnvName("tls"), "maybe")
+	if err := ApplyEnv(fs); err == nil || !strings.Contains(err.Error(), EnvName("tls")) {
+		t.Fatalf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    map[string]string
+		wantErr string
+	}{
+		{"settings", "a = 1\nb=two words\n", map[string]string{"a": "1", "b": "two words"}, ""},
+		{"quotes", `a = " padded "`, map[string]string{"a": " padded "}, ""},
+		{"comments and blank lines", "# a = 1\n\n  b = 2  \n", map[string]string{"b": "2"}, ""},
+		{"empty value", "a =", map[string]string{"a": ""}, ""},
+		{"equals in the value", "a = b = c", map[string]string{"a": "b = c"}, ""},
+		{"later wins", "a = 1\na = 2", map[string]string{"a": "2"}, ""},
+		{"no equals", "a = 1\nb", nil, "config:2"},
+		{"no name", "= 1", nil, "config:1"},
+		{"unclosed section", "[server", nil, "config:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := Parse("config", strings.NewReader(tt.text))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error at %s, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := file.sections[""]; len(got) != len(tt.want) {
+				t.Fatalf("expected %d settings, got %q", len(tt.want), got)
+			}
+			for name, want := range tt.want {
+				if got, ok := file.Get("", name); !ok || got != want {
+					t.Fatalf("expected %s = %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+// Package markup keeps user text safe to print on a terminal and parses the lightweight markup of messages.
+//
+// Sanitize escapes the control characters that would let one user's text drive another user's terminal: escape
+// sequences that clear the screen, move the cursor over other lines or retitle the window, and the bidi overrides
+// that make text read differently than it is. The server sanitizes the text it accepts and clients sanitize what they
+// show, so neither has to trust the other.
+//
+// The markup is opt-in on the client:
+//
+//	*bold*  _italics_  `code`  @name
+//
+// A marker opens before a non-space and closes after one, so 2 * 3 * 4 and snake_case stay as they are. Code spans
+// are taken literally. Names are coloured by NickColor, the same name always gets the same colour.
+package markup
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Sanitize returns s with tabs and line breaks turned into spaces and the other control characters, invalid UTF-8
+// and bidi overrides escaped as Go escapes, like \x1b. Text without them is returned as is.
+func Sanitize(s string) string {
+	if Clean(s) {
+		return s
+	}
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError:
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				b.WriteString(`\x` + strconv.FormatUint(uint64(s[i]), 16))
+				continue
+			}
+			b.WriteRune(r)
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case unsafe(r):
+			q := strconv.QuoteRuneToASCII(r)
+			b.WriteString(q[1 : len(q)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Clean reports whether s is valid UTF-8 without anything Sanitize would change.
+func Clean(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r == '\t' || r == '\n' || r == '\r' || unsafe(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// unsafe reports whether printing r may do something else than show a character: the C0 and C1 controls, DEL and
+// the bidi embeddings, overrides and isolates.
+func unsafe(r rune) bool {
+	return unicode.IsControl(r) || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// Style is how a span is shown.
+type Style uint8
+
+const (
+	Bold Style = 1 << iota
+	Italic
+	Code
+)
+
+// NickColors is how many colours names are shown in.
+const NickColors = 6
+
+// Span is a run of text in one style. Color is 0 for the default colour or a name colour from 1 to NickColors.
+type Span struct {
+	Text  string
+	Style Style
+	Color int
+}
+
+// Nick is a name shown in its colour.
+func Nick(name string) Span {
+	return Span{Text: name, Color: NickColor(name)}
+}
+
+// NickColor picks the colour of a name, from 1 to NickColors.
+func NickColor(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%NickColors) + 1
+}
+
+// Plain joins the text of the spans.
+func Plain(spans []Span) string {
+	var b strings.Builder
+	for _, s := range spans {
+		b.WriteString(s.Text)
+	}
+	return b.String()
+}
+
+// markers are the characters that style text between them.
+var markers = map[byte]Style{'*': Bold, '_': Italic}
+
+// Parse splits text into spans by its markup, dropping the markers. Markers that don't open or close a span are
+// kept as text.
+func Parse(text string) []Span {
+	var spans []Span
+	var style Style
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() > 0 {
+			spans = append(spans, Span{Text: cur.String(), Style: style})
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '`':
+			if end := strings.IndexByte(text[i+1:], '`'); end > 0 {
+				flush()
+				spans = append(spans, Span{Text: text[i+1 : i+1+end], Style: style | Code})
+				i += end + 2
+				continue
+			}
+		case c == '@' && opensAt(text, i):
+			if n := nameLen(text[i+1:]); n > 0 {
+				flush()
+				span := Nick(text[i+1 : i+1+n])
+				span.Text, span.Style = "@"+span.Text, style
+				spans = append(spans, span)
+				i += n + 1
+				continue
+			}
+		case markers[c] != 0:
+			s := markers[c]
+			if style&s != 0 && closesAt(text, i) {
+				flush()
+				style &^= s
+				i++
+				continue
+			}
+			if style&s == 0 && opensAt(text, i) && closer(text, i) > 0 {
+				flush()
+				style |= s
+				i++
+				continue
+			}
+		}
+		cur.WriteByte(c)
+		i++
+	}
+	flush()
+	return spans
+}
+
+// opensAt reports whether the marker at i may open a span: it starts a word and is followed by a non-space.
+func opensAt(text string, i int) bool {
+	if i+1 >= len(text) || text[i+1] == ' ' || text[i+1] == text[i] {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return !isWord(r)
+}
+
+// closesAt reports whether the marker at i may close a span: it follows a non-space and ends a word.
+func closesAt(text string, i int) bool {
+	if i == 0 || text[i-1] == ' ' || text[i-1] == text[i] {
+		return false
+	}
+	if i+1 == len(text) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(text[i+1:])
+	return !isWord(r)
+}
+
+// closer returns where the span opened by the marker at i closes, or -1 if it doesn't.
+func closer(text string, i int) int {
+	for j := i + 2; j < len(text); j++ {
+		if text[j] == text[i] && closesAt(text, j) {
+			return j
+		}
+	}
+	return -1
+}
+
+// nameLen returns the length of the name at the start of text. Trailing dots and dashes end a sentence, not the
+// name.
+func nameLen(text string) int {
+	n := 0
+	for n < len(text) {
+		r, size := utf8.DecodeRuneInString(text[n:])
+		if !isWord(r) && r != '.' && r != '-' {
+			break
+		}
+		n += size
+	}
+	return len(strings.TrimRight(text[:n], ".-"))
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
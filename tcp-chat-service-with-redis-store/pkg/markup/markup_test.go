@@ -0,0 +1,89 @@
+package markup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"unicode", "héllo wörld ✓", "héllo wörld ✓"},
+		{"whitespace", "a\tb\nc\rd", "a b c d"},
+		{"escape sequence", "\x1b[2Jgone", `\x1b[2Jgone`},
+		{"window title", "\x1b]0;pwned\x07", `\x1b]0;pwned\a`},
+		{"bell", "\x07", `\a`},
+		{"delete", "a\x7fb", `a\x7fb`},
+		{"c1 control", "a\u009bb", `a\u009bb`},
+		{"bidi override", "\u202etxt.exe", `\u202etxt.exe`},
+		{"bidi isolate", "a\u2066b\u2069", `a\u2066b\u2069`},
+		{"invalid utf-8", "a\xffb", `a\xffb`},
+		{"escapes are kept", `C:\x1b`, `C:\x1b`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sanitize(tt.in); got != tt.want {
+				t.Fatalf("expected Sanitize(%q) = %q, got %q", tt.in, tt.want, got)
+			}
+			if got := Clean(tt.in); got != (tt.in == tt.want) {
+				t.Fatalf("expected Clean(%q) = %v, got %v", tt.in, tt.in == tt.want, got)
+			}
+			// sanitized text is clean.
+			if !Clean(Sanitize(tt.in)) {
+				t.Fatalf("expected Sanitize(%q) to be clean", tt.in)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	bob := NickColor("bob")
+	tests := []struct {
+		name, in string
+		want     []Span
+	}{
+		{"plain", "hello", []Span{{Text: "hello"}}},
+		{"empty", "", nil},
+		{"bold", "*bold*", []Span{{Text: "bold", Style: Bold}}},
+		{"italics", "_it_", []Span{{Text: "it", Style: Italic}}},
+		{"code", "`x := 1`", []Span{{Text: "x := 1", Style: Code}}},
+		{"in a sentence", "a *b* c", []Span{{Text: "a "}, {Text: "b", Style: Bold}, {Text: " c"}}},
+		{"nested", "*_both_*", []Span{{Text: "both", Style: Bold | Italic}}},
+		{"two spans", "*a* and *b*", []Span{{Text: "a", Style: Bold}, {Text: " and "}, {Text: "b", Style: Bold}}},
+		{"code is literal", "`*x* @bob`", []Span{{Text: "*x* @bob", Style: Code}}},
+		{"arithmetic", "2 * 3 * 4", []Span{{Text: "2 * 3 * 4"}}},
+		{"snake case", "snake_case_name", []Span{{Text: "snake_case_name"}}},
+		{"unterminated bold", "*bold", []Span{{Text: "*bold"}}},
+		{"unterminated italics", "some _text", []Span{{Text: "some _text"}}},
+		{"unterminated code", "`code", []Span{{Text: "`code"}}},
+		{"empty code", "``", []Span{{Text: "``"}}},
+		{"doubled marker", "**", []Span{{Text: "**"}}},
+		{"closer after a space", "*a *", []Span{{Text: "*a *"}}},
+		{"mention", "hi @bob.", []Span{{Text: "hi "}, {Text: "@bob", Color: bob}, {Text: "."}}},
+		{"mention in bold", "*to @bob*", []Span{{Text: "to ", Style: Bold}, {Text: "@bob", Style: Bold, Color: bob}}},
+		{"email", "a@b.c", []Span{{Text: "a@b.c"}}},
+		{"lone at", "@ noon", []Span{{Text: "@ noon"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected Parse(%q) = %+v, got %+v", tt.in, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNickColor(t *testing.T) {
+	for _, name := range []string{"", "alice", "bob", "a b", "ünïcode"} {
+		c := NickColor(name)
+		if c < 1 || c > NickColors {
+			t.Fatalf("expected the colour of %q within 1..%d, got %d", name, NickColors, c)
+		}
+		if NickColor(name) != c {
+			t.Fatalf("expected %q to always get the same colour", name)
+		}
+	}
+}
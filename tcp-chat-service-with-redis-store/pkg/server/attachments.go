@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	re "github.com/go-redis/redis"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Attachments are uploaded on their own and then shared by referencing their id in a message. The content goes to
+// the blob store, the metadata to the hash attachment.<id>. Any number of messages can share an attachment, the set
+// attachment.<id>.refs holds their ids so that the attachment is only purged with the last of them. Uploads wait in
+// the sorted set attachments.unshared until a message shares them; the janitor deletes those nobody shared within
+// unsharedAttachmentTTL.
+
+// unsharedAttachments scores the uploads no message shared yet by when the janitor may delete them.
+const unsharedAttachments = "attachments.unshared"
+
+// unsharedAttachmentTTL is how long an upload is kept without being shared.
+const unsharedAttachmentTTL = 24 * time.Hour
+
+const (
+	// MaxAttachmentSize is the largest file that can be uploaded.
+	MaxAttachmentSize = 25 << 20
+	// attachmentChunkSize is the size of the chunks attachments are downloaded in.
+	attachmentChunkSize = 64 << 10
+	maxFilenameLen      = 255
+)
+
+var attachmentFields = []string{"filename", "size", "mime_type", "checksum", "uploader"}
+
+// WithBlobStore enables attachments, keeping their content in the store.
+func WithBlobStore(store BlobStore) Option {
+	return func(s *Server) {
+		s.blobs = store
+	}
+}
+
+func attachmentKey(id string) string {
+	return "attachment." + id
+}
+
+func attachmentRefsKey(id string) string {
+	return "attachment." + id + ".refs"
+}
+
+// validAttachmentID reports whether id looks like an id handed out by UploadAttachment.
+func validAttachmentID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+func newAttachmentID() (string, error) {
+	id, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	return id[:32], nil
+}
+
+func (s *Server) attachmentsEnabled() error {
+	if s.blobs == nil {
+		return status.Error(codes.Unimplemented, "attachments are not enabled on this server")
+	}
+	return nil
+}
+
+// attachment returns the metadata of an uploaded attachment.
+func (s *Server) attachment(id string) (*pb.Attachment, error) {
+	if !validAttachmentID(id) {
+		return nil, status.Errorf(codes.NotFound, "attachment %s does not exist", id)
+	}
+	fields, err := s.redis.getFields(attachmentKey(id), attachmentFields...)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		v, ok := f.(string)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "attachment %s does not exist", id)
+		}
+		values[i] = v
+	}
+	size, _ := strconv.ParseInt(values[1], 10, 64)
+	return &pb.Attachment{
+		Id:       id,
+		Filename: values[0],
+		Size:     size,
+		MimeType: values[2],
+		Checksum: values[3],
+		Uploader: values[4],
+	}, nil
+}
+
+// attachments resolves the attachment ids of a message.
+func (s *Server) attachments(ids []string) ([]*pb.Attachment, error) {
+	var attachments []*pb.Attachment
+	for _, id := range ids {
+		a, err := s.attachment(id)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+func (s *Server) UploadAttachment(stream pb.ChatService_UploadAttachmentServer) error {
+	if err := s.attachmentsEnabled(); err != nil {
+		return err
+	}
+	user, _ := UserFromContext(stream.Context())
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	filename := first.GetInfo().GetFilename()
+	if !validFilename(filename) {
+		return status.Error(codes.InvalidArgument, "the first chunk must carry a valid filename, without a path")
+	}
+	id, err := newAttachmentID()
+	if err != nil {
+		return err
+	}
+	w, err := s.blobs.Create(id)
+	if err != nil {
+		return err
+	}
+	a, err := receiveAttachment(stream, first, w)
+	if err != nil {
+		w.Close()
+		s.blobs.Delete(id)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		s.blobs.Delete(id)
+		return err
+	}
+	a.Id, a.Filename, a.Uploader = id, filename, user
+	if err := s.saveAttachment(a, time.Now()); err != nil {
+		s.blobs.Delete(id)
+		return err
+	}
+	return stream.SendAndClose(a)
+}
+
+// saveAttachment stores the metadata of an upload, unshared until a message references it.
+func (s *Server) saveAttachment(a *pb.Attachment, now time.Time) error {
+	return s.redis.pipelined(func(pipe re.Pipeliner) error {
+		pipe.HMSet(attachmentKey(a.GetId()), map[string]interface{}{
+			"filename":  a.GetFilename(),
+			"size":      a.GetSize(),
+			"mime_type": a.GetMimeType(),
+			"checksum":  a.GetChecksum(),
+			"uploader":  a.GetUploader(),
+		})
+		pipe.ZAdd(unsharedAttachments, re.Z{Score: float64(now.Add(unsharedAttachmentTTL).Unix()), Member: a.GetId()})
+		return nil
+	})
+}
+
+// validFilename reports whether name is safe to save a download under: a plain name, not a path or a directory.
+func validFilename(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > maxFilenameLen {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`) && markup.Clean(name)
+}
+
+// receiveAttachment writes the chunks of an upload to w and returns what it learnt about the content.
+func receiveAttachment(stream pb.ChatService_UploadAttachmentServer, chunk *pb.AttachmentChunk, w io.Writer) (*pb.Attachment, error) {
+	a := &pb.Attachment{MimeType: cleanMimeType(chunk.GetInfo().GetMimeType())}
+	hash := sha256.New()
+	for {
+		data := chunk.GetData()
+		if a.Size+int64(len(data)) > MaxAttachmentSize {
+			return nil, status.Errorf(codes.ResourceExhausted, "attachments are limited to %d bytes", MaxAttachmentSize)
+		}
+		if a.MimeType == "" && len(data) > 0 {
+			a.MimeType = http.DetectContentType(data)
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		hash.Write(data)
+		a.Size += int64(len(data))
+
+		var err error
+		chunk, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if a.MimeType == "" {
+		a.MimeType = "application/octet-stream"
+	}
+	a.Checksum = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	return a, nil
+}
+
+// cleanMimeType returns the media type the client claimed in its canonical form, or "" for anything that is not a
+// media type, for the server to sniff the content instead.
+func cleanMimeType(claimed string) string {
+	mediaType, params, err := mime.ParseMediaType(claimed)
+	if err != nil || !strings.Contains(mediaType, "/") {
+		return ""
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// canDownload reports whether the user may download the attachment: the user uploaded it, or can see one of the
+// messages sharing it.
+func (s *Server) canDownload(user string, a *pb.Attachment) (bool, error) {
+	if a.GetUploader() == user {
+		return true, nil
+	}
+	refs, err := s.redis.members(attachmentRefsKey(a.GetId()))
+	if err != nil {
+		return false, err
+	}
+	for _, id := range refs {
+		ev, _, err := s.load(id)
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if ok, err := s.canSee(user, ev); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (s *Server) DownloadAttachment(req *pb.DownloadRequest, stream pb.ChatService_DownloadAttachmentServer) error {
+	if err := s.attachmentsEnabled(); err != nil {
+		return err
+	}
+	user, _ := UserFromContext(stream.Context())
+	a, err := s.attachment(req.GetId())
+	if err != nil {
+		return err
+	}
+	allowed, err := s.canDownload(user, a)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return status.Errorf(codes.NotFound, "attachment %s does not exist", a.GetId())
+	}
+	r, err := s.blobs.Open(a.GetId())
+	if errors.Is(err, os.ErrNotExist) {
+		return status.Errorf(codes.NotFound, "attachment %s is gone", a.GetId())
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	chunk := &pb.AttachmentChunk{Info: a}
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || chunk.Info != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &pb.AttachmentChunk{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read attachment %s: %w", a.GetId(), err)
+		}
+	}
+}
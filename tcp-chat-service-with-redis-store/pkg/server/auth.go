@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Directory checks user credentials at connect time. Plug in another implementation to authenticate against a
+// different user store (ldap, sql etc).
+type Directory interface {
+	// Authenticate returns an error if the password is not valid for the user.
+	Authenticate(user, password string) error
+}
+
+// FileDirectory is a Directory backed by a htpasswd style file with one "user:bcrypt-hash" entry per line.
+type FileDirectory struct {
+	hashes map[string][]byte
+}
+
+func NewFileDirectory(path string) (*FileDirectory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := &FileDirectory{hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		d.hashes[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *FileDirectory) Authenticate(user, password string) error {
+	hash, ok := d.hashes[user]
+	if !ok {
+		return fmt.Errorf("unknown user %s", user)
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// peerIdentity returns the common name of the verified client certificate of the connection, if any.
+func peerIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	name := info.State.VerifiedChains[0][0].Subject.CommonName
+	return name, name != ""
+}
+
+type userCtxKey struct{}
+
+type sessionCtxKey struct{}
+
+// UserFromContext returns the user authenticated by the session token of the request.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userCtxKey{}).(string)
+	return user, ok
+}
+
+// sessionFromContext returns the id of the session of the request.
+func sessionFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionCtxKey{}).(string)
+	return id
+}
+
+// publicMethods can be called without a session token.
+var publicMethods = map[string]bool{
+	pb.ChatService_Connect_FullMethodName: true,
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionID is what a session is known by in redis: a hash of its token, so that whoever reads redis can't act as
+// the session's user with it.
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate resolves the session token in the request metadata and returns a context carrying the user.
+func (s *Server) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(common.AUTH_METADATA)
+	if len(values) == 0 || !strings.HasPrefix(values[0], common.AUTH_SCHEME) {
+		return nil, status.Error(codes.Unauthenticated, "missing session token. connect first")
+	}
+	id := sessionID(strings.TrimPrefix(values[0], common.AUTH_SCHEME))
+	user, err := s.redis.get(sessionKey(id))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired session token")
+	}
+	callInfoFromContext(ctx).user = user
+	ctx = context.WithValue(ctx, sessionCtxKey{}, id)
+	return context.WithValue(ctx, userCtxKey{}, user), nil
+}
+
+func (s *Server) authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// wrappedStream overrides the context of a server stream.
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedStream) Context() context.Context {
+	return w.ctx
+}
+
+func (s *Server) authStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if publicMethods[info.FullMethod] {
+		return handler(srv, ss)
+	}
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &wrappedStream{ServerStream: ss, ctx: ctx})
+}
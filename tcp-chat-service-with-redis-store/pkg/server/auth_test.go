@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// writeUsers writes a users file of "user:hash" lines for the passwords and returns its path.
+func writeUsers(t *testing.T, passwords map[string]string, extra ...string) string {
+	t.Helper()
+	lines := append([]string{"# users of the test"}, extra...)
+	for user, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, "", user+":"+string(hash))
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileDirectory(t *testing.T) {
+	d, err := NewFileDirectory(writeUsers(t, map[string]string{"alice": "secret", "bob": "hunter2"}))
+	if err != nil {
+		t.Fatalf("could not load the users file: %s", err)
+	}
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"bob", "hunter2", true},
+		{"alice", "hunter2", false},
+		{"alice", "", false},
+		{"alice", "secret ", false},
+		{"carol", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+":"+tt.password, func(t *testing.T) {
+			if err := d.Authenticate(tt.user, tt.password); (err == nil) != tt.ok {
+				t.Fatalf("expected ok to be %t, got %v", tt.ok, err)
+			}
+		})
+	}
+
+	if _, err := NewFileDirectory(writeUsers(t, nil, "alice")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expected an error at the line without a hash, got %v", err)
+	}
+	if _, err := NewFileDirectory(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestConnectChecksTheDirectory(t *testing.T) {
+	d, err := NewFileDirectory(writeUsers(t, map[string]string{"alice": "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServers(t, 1, WithDirectory(d))[0]
+	for _, req := range []*pb.ConnectRequest{
+		{User: "alice", Password: "wrong"},
+		{User: "alice"},
+		{User: "mallory", Password: "secret"},
+	} {
+		if _, err := s.Connect(context.Background(), req); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected Unauthenticated for %s with %q, got %v", req.GetUser(), req.GetPassword(), err)
+		}
+	}
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatalf("expected alice to connect with the right password, got %s", err)
+	}
+	if _, err := s.Rename(sessionContext("alice", res.GetToken()), &pb.RenameRequest{User: "bob"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied renaming a user of the directory, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestServersOn(t, mr, 1)[0]
+	connect := func(user string) string {
+		t.Helper()
+		res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: user})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", user, err)
+		}
+		return res.GetToken()
+	}
+	expired := connect("bob")
+	mr.FastForward(common.LEASE_TTL + time.Second)
+	token := connect("alice")
+
+	withAuth := func(values ...string) context.Context {
+		md := metadata.MD{}
+		for _, v := range values {
+			md.Append(common.AUTH_METADATA, v)
+		}
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		method string
+		want   codes.Code
+	}{
+		{"no metadata", context.Background(), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"no token", withAuth(), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"empty token", withAuth(common.AUTH_SCHEME), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"other scheme", withAuth("Basic " + token), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"bare token", withAuth(token), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"unknown token", withAuth(common.AUTH_SCHEME + "nope"), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"expired token", withAuth(common.AUTH_SCHEME + expired), pb.ChatService_Chat_FullMethodName, codes.Unauthenticated},
+		{"valid token", withAuth(common.AUTH_SCHEME + token), pb.ChatService_Chat_FullMethodName, codes.OK},
+		{"public method", context.Background(), pb.ChatService_Connect_FullMethodName, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user string
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				user, _ = UserFromContext(ctx)
+				return nil, nil
+			}
+			_, err := s.authUnaryInterceptor(tt.ctx, nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+			if status.Code(err) != tt.want {
+				t.Fatalf("expected %s, got %v", tt.want, err)
+			}
+			streamHandler := func(srv interface{}, ss grpc.ServerStream) error {
+				if u, _ := UserFromContext(ss.Context()); u != user {
+					t.Fatalf("expected the stream of %q, got %q", user, u)
+				}
+				return nil
+			}
+			err = s.authStreamInterceptor(nil, &wrappedStream{ctx: tt.ctx}, &grpc.StreamServerInfo{FullMethod: tt.method}, streamHandler)
+			if status.Code(err) != tt.want {
+				t.Fatalf("expected %s for the stream, got %v", tt.want, err)
+			}
+			if tt.want == codes.OK && tt.method != pb.ChatService_Connect_FullMethodName && user != "alice" {
+				t.Fatalf("expected the handler to run as alice, got %q", user)
+			}
+		})
+	}
+}
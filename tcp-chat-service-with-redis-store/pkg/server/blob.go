@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore keeps the content of attachments. Plug in another implementation to store them elsewhere (s3, gcs etc).
+type BlobStore interface {
+	// Create returns a writer for a new blob. The blob only becomes readable once the writer is closed.
+	Create(id string) (io.WriteCloser, error)
+	// Open returns a reader for a blob. It returns an error satisfying errors.Is(err, os.ErrNotExist) if there is
+	// no such blob.
+	Open(id string) (io.ReadCloser, error)
+	// Delete removes a blob, complete or not. Deleting a missing blob is not an error.
+	Delete(id string) error
+}
+
+// FileBlobStore is a BlobStore keeping each blob as a file in a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (f *FileBlobStore) path(id string) string {
+	return filepath.Join(f.dir, filepath.Base(id))
+}
+
+func (f *FileBlobStore) Create(id string) (io.WriteCloser, error) {
+	file, err := os.OpenFile(f.path(id)+".part", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &blobFile{File: file, path: f.path(id)}, nil
+}
+
+func (f *FileBlobStore) Open(id string) (io.ReadCloser, error) {
+	return os.Open(f.path(id))
+}
+
+func (f *FileBlobStore) Delete(id string) error {
+	for _, path := range []string{f.path(id), f.path(id) + ".part"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobFile is written under a temporary name and moved in place when closed, so readers never see half a blob.
+type blobFile struct {
+	*os.File
+	path string
+}
+
+func (b *blobFile) Close() error {
+	if err := b.File.Sync(); err != nil {
+		b.File.Close()
+		return err
+	}
+	if err := b.File.Close(); err != nil {
+		return err
+	}
+	return os.Rename(b.File.Name(), b.path)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"strconv"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// knownUsers is the set of every user that ever connected. Direct messages can only be sent to them.
+const knownUsers = "users"
+
+// directKey names the sorted set of the direct messages a user sent or received, in any conversation, scored by id.
+func directKey(user string) string {
+	return "direct." + user
+}
+
+func (s *Server) SendDirect(ctx context.Context, msg *pb.DirectMessage) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	to := msg.GetTo()
+	known, err := s.redis.isMember(knownUsers, to)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, status.Errorf(codes.NotFound, "user %s does not exist", to)
+	}
+	if msg.GetSealed() != nil {
+		if msg.GetMsg() != "" {
+			return nil, status.Error(codes.InvalidArgument, "an encrypted message has no clear text")
+		}
+		if err := s.checkSealed(user, msg.GetSealed()); err != nil {
+			return nil, err
+		}
+	}
+	ev, err := s.newEvent(pb.Event_TEXT, "", user, markup.Sanitize(msg.GetMsg()))
+	if err != nil {
+		return nil, err
+	}
+	ev.Recipient = to
+	ev.Sealed = msg.GetSealed()
+	if err := s.store(ev); err != nil {
+		return nil, err
+	}
+	if err := s.fileDirect(ev); err != nil {
+		return nil, err
+	}
+	if err := s.deliver(ev, ev); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *Server) GetDirectHistory(ctx context.Context, req *pb.DirectHistoryRequest) (*pb.DirectHistoryResponse, error) {
+	user, _ := UserFromContext(ctx)
+	key := directKey(user)
+	if req.GetPeer() != "" {
+		key = conversationKey(user, req.GetPeer())
+	}
+	events, err := s.history(user, key, req.GetBeforeId(), req.GetAfterId(), int64(req.GetLimit()))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DirectHistoryResponse{Events: events}, nil
+}
+
+// fileDirect adds a direct message to the messages of its sender and its recipient.
+func (s *Server) fileDirect(ev *pb.Event) error {
+	id, err := strconv.ParseInt(ev.GetId(), 10, 64)
+	if err != nil {
+		return err
+	}
+	if err := s.redis.scoreMember(directKey(ev.GetSender()), float64(id), ev.GetId()); err != nil {
+		return err
+	}
+	return s.redis.scoreMember(directKey(ev.GetRecipient()), float64(id), ev.GetId())
+}
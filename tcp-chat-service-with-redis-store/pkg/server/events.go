@@ -0,0 +1,47 @@
+package server
+
+import (
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventSeq is the counter handing out event ids. Ids are shared by all server instances and increase over time.
+const eventSeq = "seq.event"
+
+// newEvent builds an event stamped with a fresh id and the server time.
+func (s *Server) newEvent(kind pb.Event_Kind, room, sender, body string) (*pb.Event, error) {
+	id, err := s.redis.incr(eventSeq)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Event{
+		Id:        strconv.FormatInt(id, 10),
+		Room:      room,
+		Sender:    sender,
+		Timestamp: timestamppb.Now(),
+		Kind:      kind,
+		Body:      body,
+	}, nil
+}
+
+// publishEvent serializes the event and publishes it on the channel.
+func (s *Server) publishEvent(channel string, ev *pb.Event) error {
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.redis.publishTo(channel, string(b))
+}
+
+// broadcast creates an event and publishes it to every client.
+func (s *Server) broadcast(kind pb.Event_Kind, room, sender, body string) error {
+	ev, err := s.newEvent(kind, room, sender, body)
+	if err != nil {
+		return err
+	}
+	return s.publishEvent(common.CHANNEL, ev)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The gateway exposes every unary rpc of the ChatService as POST /v1/<Method> with a JSON body, and Subscribe as a
+// Server-Sent Events stream on GET /v1/events. Requests are dispatched through the generated service handlers and
+// the same interceptors as gRPC, so there is no second implementation of any rpc to keep in sync.
+//
+// UploadAttachment and DownloadAttachment are left out on purpose: they move files in chunks over streams, which
+// JSON would only bloat by a third. Use gRPC for attachments.
+
+const (
+	// maxRequestBody bounds the JSON body of a request, as gRPC bounds its messages by default.
+	maxRequestBody = 4 << 20
+	// shutdownTimeout bounds how long stopping waits for the requests in flight.
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	jsonMarshaler   = protojson.MarshalOptions{EmitUnpopulated: true}
+	jsonUnmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+)
+
+// httpStatus maps gRPC status codes to the closest HTTP status.
+var httpStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+func (s *Server) startHTTPServer() error {
+	var err error
+	s.httpListener, err = net.Listen("tcp", s.httpAddr)
+	if err != nil {
+		return fmt.Errorf("http listener failed to initialize: %s", err)
+	}
+	mux := http.NewServeMux()
+	for _, m := range pb.ChatService_ServiceDesc.Methods {
+		mux.HandleFunc("/v1/"+m.MethodName, s.unaryHandler(m))
+	}
+	for _, m := range pb.ChatService_ServiceDesc.Streams {
+		if m.StreamName == "Subscribe" {
+			mux.HandleFunc("/v1/events", s.eventsHandler(m))
+		}
+	}
+	s.httpServer = &http.Server{Handler: mux, TLSConfig: s.tlsConfig}
+	go func() {
+		var err error
+		if s.tlsConfig != nil {
+			err = s.httpServer.ServeTLS(s.httpListener, "", "")
+		} else {
+			err = s.httpServer.Serve(s.httpListener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Http server cannot serve: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) closeHTTPServer() {
+	if s.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error while closing http server: %s", err)
+	}
+}
+
+// incomingContext carries the session token, request id, remote address and client certificate of the http request
+// the way gRPC would. The request id is echoed back in the response. queryToken also takes the token from ?token=,
+// for EventSource which can't set headers. Only the event stream allows it, query strings end up in access logs.
+func incomingContext(w http.ResponseWriter, r *http.Request, queryToken bool) context.Context {
+	md := metadata.MD{}
+	var token string
+	if queryToken {
+		token = r.URL.Query().Get("token")
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token = strings.TrimPrefix(auth, common.AUTH_SCHEME)
+	}
+	if token != "" {
+		md.Set(common.AUTH_METADATA, common.AUTH_SCHEME+token)
+	}
+	id := requestID(r.Header.Get(REQUEST_ID_METADATA))
+	md.Set(REQUEST_ID_METADATA, id)
+	w.Header().Set(REQUEST_ID_METADATA, id)
+
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	return peer.NewContext(metadata.NewIncomingContext(r.Context(), md), p)
+}
+
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+func (s *Server) unaryHandler(m grpc.MethodDesc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErrorStatus(w, http.StatusRequestEntityTooLarge, status.Errorf(codes.InvalidArgument, "the request body is larger than %d bytes", maxRequestBody))
+			return
+		}
+		if err != nil {
+			writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		dec := func(req interface{}) error {
+			if len(body) == 0 {
+				return nil
+			}
+			if err := jsonUnmarshaler.Unmarshal(body, req.(proto.Message)); err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid request body: %s", err)
+			}
+			return nil
+		}
+		res, err := m.Handler(s, incomingContext(w, r, false), dec, s.unaryInterceptor)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		b, err := jsonMarshaler.Marshal(res.(proto.Message))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// eventsHandler serves Subscribe as Server-Sent Events until the client goes away.
+func (s *Server) eventsHandler(m grpc.StreamDesc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, status.Error(codes.Unimplemented, "streaming is not supported"))
+			return
+		}
+		ss := &eventStream{w: w, flusher: flusher, ctx: incomingContext(w, r, true)}
+		info := &grpc.StreamServerInfo{FullMethod: pb.ChatService_Subscribe_FullMethodName, IsServerStream: true}
+		if err := s.streamInterceptor(s, ss, info, m.Handler); err != nil && !ss.started {
+			writeError(w, err)
+		}
+	}
+}
+
+// eventStream is the server side of Subscribe over http: the header starts the response and every message is
+// written as an event.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	ctx     context.Context
+	started bool
+}
+
+func (e *eventStream) Context() context.Context        { return e.ctx }
+func (e *eventStream) SetHeader(metadata.MD) error     { return nil }
+func (e *eventStream) SetTrailer(metadata.MD)          {}
+func (e *eventStream) RecvMsg(m interface{}) error     { return nil }
+func (e *eventStream) SendHeader(md metadata.MD) error { return e.start() }
+
+func (e *eventStream) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	e.w.Header().Set("Content-Type", "text/event-stream")
+	e.w.Header().Set("Cache-Control", "no-cache")
+	e.w.WriteHeader(http.StatusOK)
+	e.flusher.Flush()
+	return nil
+}
+
+func (e *eventStream) SendMsg(m interface{}) error {
+	ev, ok := m.(*pb.Event)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message %T on the event stream", m)
+	}
+	if err := e.start(); err != nil {
+		return err
+	}
+	b, err := protojson.Marshal(ev)
+	if err != nil {
+		log.Printf("could not encode event: %s", err)
+		return nil
+	}
+	if _, err := fmt.Fprintf(e.w, "id: %s\nevent: %s\ndata: %s\n\n", ev.GetId(), strings.ToLower(ev.GetKind().String()), b); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// allowMethod answers 405 unless the request uses method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeErrorStatus(w, http.StatusMethodNotAllowed, status.Errorf(codes.Unimplemented, "use %s", method))
+	return false
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code, ok := httpStatus[status.Code(err)]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	writeErrorStatus(w, code, err)
+}
+
+// writeErrorStatus writes err with an http status of its own.
+func writeErrorStatus(w http.ResponseWriter, code int, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    st.Code().String(),
+		"message": st.Message(),
+	})
+}
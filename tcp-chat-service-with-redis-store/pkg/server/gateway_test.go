@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGateway starts a server with the http gateway and returns its base url and the token of a session for alice.
+func newGateway(t *testing.T) (string, string) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s := NewServer(mr.Addr(), "", WithListener(bufconn.Listen(1<<20)), WithHTTP("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start the server: %s", err)
+	}
+	t.Cleanup(s.Stop)
+	base := "http://" + s.httpListener.Addr().String()
+	res, body := request(t, http.MethodPost, base+"/v1/Connect", "", `{"user": "alice"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("could not connect: %s %s", res.Status, body)
+	}
+	var connected struct{ Token string }
+	if err := json.Unmarshal([]byte(body), &connected); err != nil || connected.Token == "" {
+		t.Fatalf("expected a token from Connect, got %s", body)
+	}
+	return base, connected.Token
+}
+
+// request sends an http request with an optional Authorization header and returns the response and its body.
+func request(t *testing.T, method, url, auth, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send the request: %s", err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(b)
+}
+
+func TestGatewayDispatch(t *testing.T) {
+	base, token := newGateway(t)
+	bearer := "Bearer " + token
+	tests := []struct {
+		name, method, path, auth, body string
+		status                         int
+		// contains is a piece of the expected response body.
+		contains string
+	}{
+		{"unary call", http.MethodPost, "/v1/Chat", bearer, `{"msg": "hello"}`, http.StatusOK, `"id":`},
+		{"empty body", http.MethodPost, "/v1/ListUsers", bearer, ``, http.StatusOK, `"alice"`},
+		{"unknown fields are ignored", http.MethodPost, "/v1/ListUsers", bearer, `{"nope": 1}`, http.StatusOK, `"alice"`},
+		{"invalid json", http.MethodPost, "/v1/Chat", bearer, `{"msg":`, http.StatusBadRequest, `"InvalidArgument"`},
+		{"error status", http.MethodPost, "/v1/GetKey", bearer, `{"user": "bob"}`, http.StatusNotFound, `"NotFound"`},
+		{"public call", http.MethodPost, "/v1/Connect", "", `{"user": "alice"}`, http.StatusConflict, `"AlreadyExists"`},
+		{"missing token", http.MethodPost, "/v1/Chat", "", `{"msg": "hello"}`, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"unknown token", http.MethodPost, "/v1/Chat", "Bearer nope", `{"msg": "hello"}`, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"other scheme", http.MethodPost, "/v1/Chat", "Basic " + token, `{"msg": "hello"}`, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"token in the query", http.MethodPost, "/v1/Chat?token=" + token, "", `{"msg": "hello"}`, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"wrong method", http.MethodGet, "/v1/Chat", bearer, ``, http.StatusMethodNotAllowed, `"Unimplemented"`},
+		{"events without a token", http.MethodGet, "/v1/events", "", ``, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"events with a bad token", http.MethodGet, "/v1/events?token=nope", "", ``, http.StatusUnauthorized, `"Unauthenticated"`},
+		{"events by post", http.MethodPost, "/v1/events", bearer, ``, http.StatusMethodNotAllowed, `"Unimplemented"`},
+		{"body too large", http.MethodPost, "/v1/Chat", bearer, `{"msg": "` + strings.Repeat("a", maxRequestBody) + `"}`, http.StatusRequestEntityTooLarge, `"InvalidArgument"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := request(t, tt.method, base+tt.path, tt.auth, tt.body)
+			if res.StatusCode != tt.status || !strings.Contains(body, tt.contains) {
+				t.Fatalf("expected %d with %s, got %s %s", tt.status, tt.contains, res.Status, body)
+			}
+			if res.StatusCode == http.StatusMethodNotAllowed && res.Header.Get("Allow") == "" {
+				t.Fatal("expected an Allow header")
+			}
+			// requests refused before they are dispatched have no request id.
+			dispatched := res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusRequestEntityTooLarge
+			if dispatched && res.Header.Get(REQUEST_ID_METADATA) == "" {
+				t.Fatal("expected a request id in the response")
+			}
+		})
+	}
+}
+
+func TestEventsTakeTheQueryToken(t *testing.T) {
+	base, token := newGateway(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v1/events?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not open the event stream: %s", err)
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK || stream.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s %s", stream.Status, stream.Header.Get("Content-Type"))
+	}
+
+	if res, body := request(t, http.MethodPost, base+"/v1/Chat", "Bearer "+token, `{"msg": "hello"}`); res.StatusCode != http.StatusOK {
+		t.Fatalf("could not post: %s %s", res.Status, body)
+	}
+	events := bufio.NewReader(stream.Body)
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("the stream ended before the message: %s", err)
+		}
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, `"hello"`) {
+			return
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{status.Error(codes.InvalidArgument, ""), http.StatusBadRequest},
+		{status.Error(codes.Unauthenticated, ""), http.StatusUnauthorized},
+		{status.Error(codes.PermissionDenied, ""), http.StatusForbidden},
+		{status.Error(codes.NotFound, ""), http.StatusNotFound},
+		{status.Error(codes.AlreadyExists, ""), http.StatusConflict},
+		{status.Error(codes.FailedPrecondition, ""), http.StatusBadRequest},
+		{status.Error(codes.ResourceExhausted, ""), http.StatusTooManyRequests},
+		{status.Error(codes.Canceled, ""), 499},
+		{status.Error(codes.DeadlineExceeded, ""), http.StatusGatewayTimeout},
+		{status.Error(codes.Unimplemented, ""), http.StatusNotImplemented},
+		{status.Error(codes.Unavailable, ""), http.StatusServiceUnavailable},
+		{status.Error(codes.Internal, ""), http.StatusInternalServerError},
+		{errors.New("not a status"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(status.Code(tt.err).String(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, tt.err)
+			var body struct{ Code string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("expected a JSON error, got %s", w.Body)
+			}
+			if w.Code != tt.want || body.Code != status.Code(tt.err).String() {
+				t.Fatalf("expected %d with code %s, got %d %s", tt.want, status.Code(tt.err), w.Code, body.Code)
+			}
+		})
+	}
+}
+
+func TestStopEndsEventStreams(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := NewServer(mr.Addr(), "", WithListener(bufconn.Listen(1<<20)), WithHTTP("127.0.0.1:0"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start the server: %s", err)
+	}
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+s.httpListener.Addr().String()+"/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+res.GetToken())
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not open the event stream: %s", err)
+	}
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatalf("expected the event stream to open, got %s", stream.Status)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		t.Fatal("Stop is blocked by the open event stream")
+	}
+	// the stream ends rather than hanging.
+	if _, err := bufio.NewReader(stream.Body).ReadString('\n'); err == nil {
+		t.Fatal("expected the event stream to be closed")
+	}
+}
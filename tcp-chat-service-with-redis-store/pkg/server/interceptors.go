@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Every call goes through this chain, outermost first:
+//
+//	request id -> logging -> panic recovery -> auth -> rate limits -> custom interceptors -> handler
+
+// REQUEST_ID_METADATA is the metadata key carrying the request id, both ways.
+const REQUEST_ID_METADATA = "x-request-id"
+
+// RateLimits configures the token buckets applied to every call. A zero rate disables the bucket.
+type RateLimits struct {
+	// PerUser applies to each session user, or to the peer address before the user is known (Connect).
+	PerUser      rate.Limit
+	PerUserBurst int
+	Global       rate.Limit
+	GlobalBurst  int
+}
+
+// DefaultRateLimits are generous enough for interactive clients and stop a client flooding in a loop.
+var DefaultRateLimits = RateLimits{
+	PerUser:      5,
+	PerUserBurst: 20,
+	Global:       1000,
+	GlobalBurst:  2000,
+}
+
+// WithRateLimits replaces the default rate limits.
+func WithRateLimits(limits RateLimits) Option {
+	return func(s *Server) {
+		s.rateLimits = limits
+	}
+}
+
+// WithInterceptors appends interceptors to the end of the chain, after auth and rate limiting.
+func WithInterceptors(unary []grpc.UnaryServerInterceptor, stream []grpc.StreamServerInterceptor) Option {
+	return func(s *Server) {
+		s.extraUnary = append(s.extraUnary, unary...)
+		s.extraStream = append(s.extraStream, stream...)
+	}
+}
+
+// callInfo collects what the outer interceptors log about a call. Inner interceptors fill it in.
+type callInfo struct {
+	requestID string
+	user      string
+}
+
+type callInfoCtxKey struct{}
+
+func callInfoFromContext(ctx context.Context) *callInfo {
+	info, ok := ctx.Value(callInfoCtxKey{}).(*callInfo)
+	if !ok {
+		return &callInfo{}
+	}
+	return info
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// maxRequestIDLen bounds the request ids taken from callers.
+const maxRequestIDLen = 64
+
+// requestID returns the request id the caller claimed, or a new one if it is not made of up to maxRequestIDLen
+// letters, digits and dashes, so it is safe to log and echo back.
+func requestID(claimed string) string {
+	if claimed == "" || len(claimed) > maxRequestIDLen {
+		return newRequestID()
+	}
+	for i := 0; i < len(claimed); i++ {
+		c := claimed[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return newRequestID()
+		}
+	}
+	return claimed
+}
+
+// withRequestID propagates the request id of the caller, or assigns one, and returns it to the caller.
+func withRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var claimed string
+	if ids := md.Get(REQUEST_ID_METADATA); len(ids) > 0 {
+		claimed = ids[0]
+	}
+	id := requestID(claimed)
+	// fails outside of a grpc call (http gateway), which sets the header itself.
+	grpc.SetHeader(ctx, metadata.Pairs(REQUEST_ID_METADATA, id))
+	return context.WithValue(ctx, callInfoCtxKey{}, &callInfo{requestID: id})
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	info := callInfoFromContext(ctx)
+	log.Printf("[%s] %s user=%q code=%s latency=%s", info.requestID, method, info.user, status.Code(err), time.Since(start))
+}
+
+func recoverPanic(method string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("panic in %s: %v\n%s", method, r, debug.Stack())
+		*err = status.Error(codes.Internal, "internal server error")
+	}
+}
+
+// limiter hands out token buckets per key and forgets the ones that have not been used for a while.
+type limiter struct {
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+const bucketIdleTimeout = 10 * time.Minute
+
+func newLimiter(limit rate.Limit, burst int) *limiter {
+	return &limiter{limit: limit, burst: burst, buckets: make(map[string]*bucket), lastPrune: time.Now()}
+}
+
+func (l *limiter) allow(key string) bool {
+	if l.limit == 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > bucketIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastUsed) > bucketIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastUsed = now
+	return b.AllowN(now, 1)
+}
+
+// checkRateLimits applies the global bucket and the bucket of the caller.
+func (s *Server) checkRateLimits(ctx context.Context) error {
+	if s.globalLimiter != nil && !s.globalLimiter.Allow() {
+		return status.Error(codes.ResourceExhausted, "server is busy. try again later")
+	}
+	key, ok := UserFromContext(ctx)
+	if !ok {
+		if p, ok := peer.FromContext(ctx); ok {
+			key = p.Addr.String()
+			if host, _, err := net.SplitHostPort(key); err == nil {
+				key = host
+			}
+		}
+	}
+	if !s.userLimiter.allow(key) {
+		return status.Error(codes.ResourceExhausted, "too many requests. slow down")
+	}
+	return nil
+}
+
+func (s *Server) initInterceptors() {
+	if s.rateLimits.Global != 0 {
+		s.globalLimiter = rate.NewLimiter(s.rateLimits.Global, s.rateLimits.GlobalBurst)
+	}
+	s.userLimiter = newLimiter(s.rateLimits.PerUser, s.rateLimits.PerUserBurst)
+
+	unary := []grpc.UnaryServerInterceptor{s.authUnaryInterceptor, s.rateLimitUnaryInterceptor}
+	s.unaryInterceptor = chainUnary(append(unary, s.extraUnary...))
+	stream := []grpc.StreamServerInterceptor{s.authStreamInterceptor, s.rateLimitStreamInterceptor}
+	s.streamInterceptor = chainStream(append(stream, s.extraStream...))
+}
+
+// chainUnary nests the interceptors inside the request id, logging and recovery handling every call gets.
+func chainUnary(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+		start := time.Now()
+		ctx = withRequestID(ctx)
+		defer func() { logCall(ctx, info.FullMethod, start, err) }()
+		defer recoverPanic(info.FullMethod, &err)
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// chainStream is the streaming counterpart of chainUnary.
+func chainStream(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		ss = &wrappedStream{ServerStream: ss, ctx: withRequestID(ss.Context())}
+		defer func() { logCall(ss.Context(), info.FullMethod, start, err) }()
+		defer recoverPanic(info.FullMethod, &err)
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, inner)
+			}
+		}
+		return next(srv, ss)
+	}
+}
+
+func (s *Server) rateLimitUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.checkRateLimits(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) rateLimitStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.checkRateLimits(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name, claimed string
+		kept          bool
+	}{
+		{"uuid", "3f2b8c1e-9a4d-4e6f-8b7a-1c2d3e4f5a6b", true},
+		{"longest", strings.Repeat("a", maxRequestIDLen), true},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLen+1), false},
+		{"line break", "abc\n[forged] log line", false},
+		{"escape sequence", "\x1b[2J", false},
+		{"space", "a b", false},
+		{"non ascii", "ab£", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestID(tt.claimed)
+			if (got == tt.claimed) != tt.kept {
+				t.Fatalf("expected requestID(%q) kept=%v, got %q", tt.claimed, tt.kept, got)
+			}
+			if got != tt.claimed && requestID(got) != got {
+				t.Fatalf("expected the new id %q to be valid", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The key directory holds the public key every user published for end-to-end encrypted direct messages. The server
+// never sees a private key and can't open a sealed message, it checks that a sealed message names the sender's
+// published key and delivers it as is.
+
+// publicKeySize is the size of an X25519 public key.
+const publicKeySize = 32
+
+// publicKeyKey holds the key a user published, with when.
+func publicKeyKey(user string) string {
+	return "key." + user
+}
+
+func (s *Server) PublishKey(ctx context.Context, req *pb.PublishKeyRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	if len(req.GetPublicKey()) != publicKeySize {
+		return nil, status.Errorf(codes.InvalidArgument, "a public key is %d bytes", publicKeySize)
+	}
+	fields := map[string]interface{}{"key": string(req.GetPublicKey()), "published": time.Now().Unix()}
+	if err := s.redis.setFields(publicKeyKey(user), fields); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *Server) GetKey(ctx context.Context, req *pb.GetKeyRequest) (*pb.PublicKey, error) {
+	key, err := s.publicKey(req.GetUser())
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// publicKey returns the key a user published, NotFound if there is none.
+func (s *Server) publicKey(user string) (*pb.PublicKey, error) {
+	fields, err := s.redis.allFields(publicKeyKey(user))
+	if err != nil {
+		return nil, err
+	}
+	if fields["key"] == "" {
+		return nil, status.Errorf(codes.NotFound, "%s has not published a key", user)
+	}
+	published, _ := strconv.ParseInt(fields["published"], 10, 64)
+	return &pb.PublicKey{
+		User:      user,
+		PublicKey: []byte(fields["key"]),
+		Published: timestamppb.New(time.Unix(published, 0)),
+	}, nil
+}
+
+// checkSealed validates a sealed direct message from user.
+func (s *Server) checkSealed(user string, sealed *pb.Sealed) error {
+	if len(sealed.GetSenderKey()) != publicKeySize || len(sealed.GetRecipientKey()) != publicKeySize {
+		return status.Errorf(codes.InvalidArgument, "sealed messages name two keys of %d bytes", publicKeySize)
+	}
+	if len(sealed.GetNonce()) == 0 || len(sealed.GetCiphertext()) == 0 {
+		return status.Error(codes.InvalidArgument, "sealed message is empty")
+	}
+	key, err := s.publicKey(user)
+	if status.Code(err) == codes.NotFound {
+		return status.Error(codes.FailedPrecondition, "publish your key before sending encrypted messages")
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(key.GetPublicKey(), sealed.GetSenderKey()) {
+		return status.Error(codes.FailedPrecondition, "the message is sealed with a key other than the one you published")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// A room message naming a known user as @name mentions them. The server tags the event with the users mentioned
+// and files the message in each of their mention inboxes, which they read with ListMentions whether they were
+// online or not. A read marker per user tells the mentions already seen from the new ones.
+
+// mentionPattern matches @name not preceded by a word character, so email addresses are no mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)`)
+
+// mentionsKey is the mention inbox of a user, message ids scored by id.
+func mentionsKey(user string) string {
+	return "mentions." + user
+}
+
+// mentionsReadKey holds the id of the newest mention the user has read.
+func mentionsReadKey(user string) string {
+	return "mentions." + user + ".read"
+}
+
+// mentions returns the known users a text from sender mentions, sorted. Senders don't mention themselves.
+func (s *Server) mentions(sender, text string) ([]string, error) {
+	seen := make(map[string]bool)
+	var users []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// "@bob." at the end of a sentence mentions bob.
+		name := strings.TrimRight(m[1], ".-")
+		if name == "" || name == sender || seen[name] {
+			continue
+		}
+		seen[name] = true
+		known, err := s.redis.isMember(knownUsers, name)
+		if err != nil {
+			return nil, err
+		}
+		if known {
+			users = append(users, name)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// fileMentions adds a message to the inboxes of the users it mentions.
+func (s *Server) fileMentions(ev *pb.Event) error {
+	id, err := strconv.ParseInt(ev.GetId(), 10, 64)
+	if err != nil {
+		return err
+	}
+	for _, user := range ev.GetMentions() {
+		if err := s.redis.scoreMember(mentionsKey(user), float64(id), ev.GetId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) ListMentions(ctx context.Context, req *pb.ListMentionsRequest) (*pb.MentionsResponse, error) {
+	user, _ := UserFromContext(ctx)
+	read, _ := s.redis.get(mentionsReadKey(user))
+	after := ""
+	if req.GetUnreadOnly() {
+		after = read
+		if after == "" {
+			after = "0"
+		}
+	}
+	events, err := s.history(user, mentionsKey(user), req.GetBeforeId(), after, int64(req.GetLimit()))
+	if err != nil {
+		return nil, err
+	}
+	if req.GetMarkRead() && len(events) > 0 {
+		// the marker only moves forward.
+		if newest := events[len(events)-1].GetId(); parseID(newest) > parseID(read) {
+			if err := s.redis.setValue(mentionsReadKey(user), newest); err != nil {
+				return nil, err
+			}
+			read = newest
+		}
+	}
+	min := "-inf"
+	if read != "" {
+		min = "(" + read
+	}
+	unread, err := s.redis.countByScore(mentionsKey(user), min)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MentionsResponse{Events: events, Unread: unread}, nil
+}
+
+// parseID parses a message id, 0 if it is not one.
+func parseID(id string) int64 {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Messages (room posts and direct messages) are stored once under msg.<id> as a serialized Event. Rooms and
+// conversations keep a sorted set of the ids of their messages (scored by id) to page through their history.
+// Editing or deleting a message rewrites msg.<id> and keeps the previous versions in msg.<id>.revisions. <history>.bytes
+// keeps the size of a history for the janitor.
+
+// defaultHistoryLimit is used when a history request does not specify a limit.
+const defaultHistoryLimit = 50
+
+// histories is a hash of every history key to its room (empty for conversations).
+const histories = "histories"
+
+// casRetries bounds how often an edit is retried when the message changes under it.
+const casRetries = 3
+
+func messageKey(id string) string {
+	return "msg." + id
+}
+
+func revisionsKey(id string) string {
+	return "msg." + id + ".revisions"
+}
+
+// historyBytesKey names the counter of the size of the messages of a history, see messageSize.
+func historyBytesKey(key string) string {
+	return key + ".bytes"
+}
+
+func roomHistoryKey(room string) string {
+	return "room." + room + ".history"
+}
+
+func roomModeratorsKey(room string) string {
+	return "room." + room + ".moderators"
+}
+
+// conversationKey names the sorted set indexing the direct messages between two users, independent of who sent
+// first.
+func conversationKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("dm.%s.%s.history", a, b)
+}
+
+// historyKey names the history a message belongs to.
+func historyKey(ev *pb.Event) string {
+	if ev.GetRecipient() != "" {
+		return conversationKey(ev.GetSender(), ev.GetRecipient())
+	}
+	return roomHistoryKey(ev.GetRoom())
+}
+
+// store saves the message and appends it to its history.
+func (s *Server) store(ev *pb.Event) error {
+	b, err := proto.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(ev.GetId(), 10, 64)
+	if err != nil {
+		return err
+	}
+	for _, a := range ev.GetAttachments() {
+		if _, err := s.redis.addMember(attachmentRefsKey(a.GetId()), ev.GetId()); err != nil {
+			return err
+		}
+		if _, err := s.redis.removeScored(unsharedAttachments, a.GetId()); err != nil {
+			return err
+		}
+	}
+	if err := s.redis.setValue(messageKey(ev.GetId()), string(b)); err != nil {
+		return err
+	}
+	// the janitor enforces retention on every history it finds here.
+	if err := s.redis.setFields(histories, map[string]interface{}{historyKey(ev): ev.GetRoom()}); err != nil {
+		return err
+	}
+	if err := s.redis.scoreMember(historyKey(ev), float64(id), ev.GetId()); err != nil {
+		return err
+	}
+	_, err = s.redis.run(resizeHistoryScript, []string{historyBytesKey(historyKey(ev))}, messageSize(ev, string(b)))
+	return err
+}
+
+// load returns a stored message together with its serialized form.
+func (s *Server) load(id string) (*pb.Event, string, error) {
+	raw, err := s.redis.get(messageKey(id))
+	if err != nil {
+		return nil, "", status.Errorf(codes.NotFound, "message %s does not exist", id)
+	}
+	ev := &pb.Event{}
+	if err := proto.Unmarshal([]byte(raw), ev); err != nil {
+		return nil, "", err
+	}
+	return ev, raw, nil
+}
+
+// history returns up to limit messages of a history older than beforeID (all when empty), oldest first, as the user
+// sees them. With afterID it returns the oldest messages newer than afterID instead.
+func (s *Server) history(user, key, beforeID, afterID string, limit int64) ([]*pb.Event, error) {
+	ids, err := s.historyIDs(key, beforeID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.events(user, ids)
+}
+
+// roomsHistory is history over the messages of every room.
+func (s *Server) roomsHistory(user, beforeID, afterID string, limit int64) ([]*pb.Event, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	keys, err := s.redis.allFields(histories)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for key, room := range keys {
+		// conversations have no room.
+		if room == "" {
+			continue
+		}
+		page, err := s.historyIDs(key, beforeID, afterID, limit)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return olderID(ids[i], ids[j]) })
+	if int64(len(ids)) > limit {
+		if afterID != "" {
+			ids = ids[:limit]
+		} else {
+			ids = ids[int64(len(ids))-limit:]
+		}
+	}
+	return s.events(user, ids)
+}
+
+// historyIDs returns the ids of the messages history returns.
+func (s *Server) historyIDs(key, beforeID, afterID string, limit int64) ([]string, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if afterID != "" {
+		return s.redis.rangeByScore(key, "("+afterID, limit)
+	}
+	max := "+inf"
+	if beforeID != "" {
+		max = "(" + beforeID
+	}
+	ids, err := s.redis.revRangeByScore(key, "-inf", max, limit)
+	// ids come newest first.
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, err
+}
+
+// olderID reports whether the message id a was handed out before b. Ids are increasing decimal numbers.
+func olderID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// events loads the stored messages with the ids for the user, skipping those that are gone.
+func (s *Server) events(user string, ids []string) ([]*pb.Event, error) {
+	events := make([]*pb.Event, 0, len(ids))
+	for i := range ids {
+		ev, _, err := s.load(ids[i])
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	if err := s.annotate(user, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// deliver publishes ev to whoever can see msg: every client for a room message, both users of the conversation for
+// a direct message. ev and msg are the same event for new messages.
+func (s *Server) deliver(ev, msg *pb.Event) error {
+	if msg.GetRecipient() == "" {
+		return s.publishEvent(common.CHANNEL, ev)
+	}
+	if err := s.publishEvent(common.UserChannel(msg.GetRecipient()), ev); err != nil {
+		return err
+	}
+	// the sender's own sessions see what was sent as well.
+	if msg.GetRecipient() != msg.GetSender() {
+		return s.publishEvent(common.UserChannel(msg.GetSender()), ev)
+	}
+	return nil
+}
+
+// canSee reports whether the user can see the message: it is in a room the user is a member of, or a direct message
+// the user sent or received.
+func (s *Server) canSee(user string, ev *pb.Event) (bool, error) {
+	if ev.GetRecipient() != "" {
+		return ev.GetSender() == user || ev.GetRecipient() == user, nil
+	}
+	return s.redis.isMember(roomMembersKey(ev.GetRoom()), user)
+}
+
+// isModerator reports whether the user moderates the room, for the whole server or for that room alone.
+func (s *Server) isModerator(user, room string) (bool, error) {
+	if s.moderators[user] {
+		return true, nil
+	}
+	if room == "" {
+		return false, nil
+	}
+	return s.redis.isMember(roomModeratorsKey(room), user)
+}
+
+// authorize loads a message the user is allowed to change: its own, or one in a room the user moderates.
+func (s *Server) authorize(user, id string) (*pb.Event, string, error) {
+	ev, raw, err := s.load(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if ev.GetKind() != pb.Event_TEXT || ev.GetDeleted() {
+		return nil, "", status.Errorf(codes.FailedPrecondition, "message %s can't be changed", id)
+	}
+	if ev.GetSender() == user {
+		return ev, raw, nil
+	}
+	moderator, err := s.isModerator(user, ev.GetRoom())
+	if err != nil {
+		return nil, "", err
+	}
+	if !moderator {
+		return nil, "", status.Error(codes.PermissionDenied, "only the author or a moderator can change a message")
+	}
+	return ev, raw, nil
+}
+
+// revise applies change to a message the user may change and stores the result, keeping the previous version as a
+// revision. change sees the version the store compares against, so what it checks holds when the revision is
+// stored; an error from it leaves the message as it is. It returns the revised message.
+func (s *Server) revise(user, id string, change func(*pb.Event) error) (*pb.Event, error) {
+	for i := 0; i < casRetries; i++ {
+		ev, raw, err := s.authorize(user, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := change(ev); err != nil {
+			return nil, err
+		}
+		b, err := proto.Marshal(ev)
+		if err != nil {
+			return nil, err
+		}
+		keys := []string{messageKey(id), revisionsKey(id), historyBytesKey(historyKey(ev))}
+		n, err := s.redis.run(reviseScript, keys, raw, string(b), len(b)-len(raw))
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return ev, nil
+		}
+	}
+	return nil, status.Errorf(codes.Aborted, "message %s is being changed concurrently. try again", id)
+}
+
+func (s *Server) EditMessage(ctx context.Context, req *pb.EditMessageRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	body := markup.Sanitize(req.GetBody())
+	mentions, err := s.mentions(user, body)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.revise(user, req.GetId(), func(ev *pb.Event) error {
+		// the new text would go out in the clear.
+		if ev.GetSealed() != nil {
+			return status.Errorf(codes.FailedPrecondition, "message %s is encrypted and can't be edited", req.GetId())
+		}
+		ev.Body = body
+		ev.Edited = true
+		if ev.GetRoom() != "" {
+			ev.Mentions = mentions
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// users mentioned by the edit find it in their inbox, those no longer mentioned keep it.
+	if err := s.fileMentions(msg); err != nil {
+		return nil, err
+	}
+	if searchable(msg) {
+		if err := s.index(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.announce(pb.Event_EDIT, msg, user, body); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *Server) DeleteMessage(ctx context.Context, req *pb.DeleteMessageRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	msg, err := s.revise(user, req.GetId(), func(ev *pb.Event) error {
+		ev.Body = ""
+		ev.Sealed = nil
+		ev.Deleted = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.announce(pb.Event_DELETE, msg, user, ""); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *Server) GetRevisions(ctx context.Context, req *pb.RevisionsRequest) (*pb.RevisionsResponse, error) {
+	user, _ := UserFromContext(ctx)
+	ev, _, err := s.load(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	// direct messages are nobody else's business.
+	if ev.GetSender() != user {
+		moderator, err := s.isModerator(user, ev.GetRoom())
+		if err != nil {
+			return nil, err
+		}
+		if !moderator || ev.GetRecipient() != "" {
+			return nil, status.Error(codes.PermissionDenied, "only the author or a moderator can read the revisions of a message")
+		}
+	}
+	revisions, err := s.redis.listRange(revisionsKey(req.GetId()))
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.RevisionsResponse{}
+	for _, raw := range revisions {
+		rev := &pb.Event{}
+		if err := proto.Unmarshal([]byte(raw), rev); err != nil {
+			return nil, err
+		}
+		res.Revisions = append(res.Revisions, rev)
+	}
+	return res, nil
+}
+
+// announce tells the clients that see msg about a change to it.
+func (s *Server) announce(kind pb.Event_Kind, msg *pb.Event, sender, body string) error {
+	ev, err := s.newEvent(kind, msg.GetRoom(), sender, body)
+	if err != nil {
+		return err
+	}
+	ev.Ref = msg.GetId()
+	ev.Recipient = msg.GetRecipient()
+	return s.deliver(ev, msg)
+}
+
+func (s *Server) GetHistory(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	user, _ := UserFromContext(ctx)
+	room := req.GetRoom()
+	if room == "" {
+		room = common.DEFAULT_ROOM
+	}
+	var events []*pb.Event
+	var err error
+	if req.GetAllRooms() {
+		events, err = s.roomsHistory(user, req.GetBeforeId(), req.GetAfterId(), int64(req.GetLimit()))
+	} else {
+		events, err = s.history(user, roomHistoryKey(room), req.GetBeforeId(), req.GetAfterId(), int64(req.GetLimit()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HistoryResponse{Events: events}, nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// online is a lexicographic index of the connected users, used to page through them without KEYS or SCAN.
+	online = "online"
+	// sessions is a sorted set of session ids scored by the unix time they run out, for the janitor to sweep.
+	sessions = "sessions"
+
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// activeKey names the key claiming a username. It holds the id of the session owning the name and expires with
+// the presence lease.
+func activeKey(user string) string {
+	return "active." + user
+}
+
+// sessionKey names the key mapping a session id to its user. Session ids are hashes of the tokens, see sessionID.
+func sessionKey(id string) string {
+	return "session." + id
+}
+
+// presenceKey names the hash holding the presence metadata (connected since, last seen) of a user.
+func presenceKey(user string) string {
+	return "presence." + user
+}
+
+// roomMembersKey names the set of users that joined a room.
+func roomMembersKey(room string) string {
+	return "room." + room + ".members"
+}
+
+// touch records activity of the user.
+func (s *Server) touch(user string, now time.Time) error {
+	return s.redis.setFields(presenceKey(user), map[string]interface{}{"last_seen": now.Unix()})
+}
+
+// joinRoom makes the user a member of the room. Membership outlives the session.
+func (s *Server) joinRoom(user, room string) error {
+	// everyone is in the default room from the start, nobody created it.
+	creatorModerates := 1
+	if room == common.DEFAULT_ROOM {
+		creatorModerates = 0
+	}
+	_, err := s.redis.run(joinRoomScript, []string{roomMembersKey(room), roomModeratorsKey(room)}, user, creatorModerates)
+	return err
+}
+
+// claim atomically claims the username for a new session. It returns false if the name is taken.
+func (s *Server) claim(user, id string, now time.Time) (bool, error) {
+	keys := []string{activeKey(user), sessionKey(id), leases, knownUsers, online, presenceKey(user), roomMembersKey(common.DEFAULT_ROOM), sessions}
+	n, err := s.redis.run(connectScript, keys, id, user, common.LEASE_TTL.Milliseconds(), now.Add(common.LEASE_TTL).Unix(), now.Unix())
+	return n == 1, err
+}
+
+// release atomically frees the username owned by the session. It returns false if the session did not own it.
+func (s *Server) release(user, id string) (bool, error) {
+	keys := []string{activeKey(user), sessionKey(id), leases, online, presenceKey(user), sessions}
+	n, err := s.redis.run(disconnectScript, keys, id, user)
+	return n == 1, err
+}
+
+// renew atomically renews the lease of the session. It returns false if the session no longer owns the username.
+func (s *Server) renew(user, id string, now time.Time) (bool, error) {
+	keys := []string{activeKey(user), sessionKey(id), leases, sessions, presenceKey(user)}
+	n, err := s.redis.run(heartbeatScript, keys, id, user, common.LEASE_TTL.Milliseconds(), now.Add(common.LEASE_TTL).Unix(), now.Unix())
+	return n == 1, err
+}
+
+// expire atomically drops a user whose lease lapsed. It returns false if the lease was renewed or another server
+// instance expired the user already.
+func (s *Server) expire(user string) (bool, error) {
+	n, err := s.redis.run(reapScript, []string{activeKey(user), leases, online, presenceKey(user)}, user)
+	return n == 1, err
+}
+
+func (s *Server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.UserListResponse, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	min, max := "-", "+"
+	if prefix := req.GetPrefix(); prefix != "" {
+		// \xff sorts after every byte a username can continue with.
+		min, max = "["+prefix, "["+prefix+"\xff"
+	}
+	if token := req.GetPageToken(); token != "" {
+		min = "(" + token
+	}
+
+	// collect one user more than the page size to know whether another page follows.
+	var names []string
+	for len(names) <= pageSize {
+		batch, err := s.redis.rangeByLex(online, min, max, int64(pageSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if req.GetRoom() == "" {
+			names = append(names, batch...)
+		} else {
+			members, err := s.redis.areMembers(roomMembersKey(req.GetRoom()), batch)
+			if err != nil {
+				return nil, err
+			}
+			for i, name := range batch {
+				if members[i] {
+					names = append(names, name)
+				}
+			}
+		}
+		if len(batch) <= pageSize {
+			break
+		}
+		min = "(" + batch[len(batch)-1]
+	}
+
+	res := &pb.UserListResponse{}
+	if len(names) > pageSize {
+		names = names[:pageSize]
+		res.NextPageToken = names[pageSize-1]
+	}
+	for _, name := range names {
+		info, err := s.userInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		res.Users = append(res.Users, info)
+	}
+	return res, nil
+}
+
+func (s *Server) userInfo(user string) (*pb.UserInfo, error) {
+	fields, err := s.redis.getFields(presenceKey(user), "connected_since", "last_seen")
+	if err != nil {
+		return nil, err
+	}
+	info := &pb.UserInfo{Name: user}
+	if since, ok := unixField(fields[0]); ok {
+		info.ConnectedSince = timestamppb.New(since)
+	}
+	if seen, ok := unixField(fields[1]); ok {
+		info.LastSeen = timestamppb.New(seen)
+	}
+	return info, nil
+}
+
+// unixField parses a unix timestamp read from a redis hash. Missing fields come back as nil.
+func unixField(v interface{}) (time.Time, bool) {
+	str, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The reactions to a message are a set msg.<id>.reactions of "<emoji> <user>" members, so reacting is idempotent
+// and needs no script. Read markers are a hash room.<room>.read of user -> id of the last message read. Ids grow
+// over time, so a user has seen every message of the room up to its marker.
+
+// maxEmojiLen bounds the size of a reaction. Anything short without spaces is accepted, not only real emoji.
+const maxEmojiLen = 32
+
+func reactionsKey(id string) string {
+	return "msg." + id + ".reactions"
+}
+
+func readMarkersKey(room string) string {
+	return "room." + room + ".read"
+}
+
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxEmojiLen && strings.IndexFunc(emoji, unicode.IsSpace) < 0 && markup.Clean(emoji)
+}
+
+// visible loads a message the user can see: any room message, or a direct message the user sent or received.
+func (s *Server) visible(user, id string) (*pb.Event, error) {
+	ev, _, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if ev.GetRecipient() != "" && ev.GetSender() != user && ev.GetRecipient() != user {
+		return nil, status.Errorf(codes.NotFound, "message %s does not exist", id)
+	}
+	return ev, nil
+}
+
+func (s *Server) AddReaction(ctx context.Context, req *pb.ReactionRequest) (*google_protobuf.Empty, error) {
+	return s.react(ctx, req, pb.Event_REACTION)
+}
+
+func (s *Server) RemoveReaction(ctx context.Context, req *pb.ReactionRequest) (*google_protobuf.Empty, error) {
+	return s.react(ctx, req, pb.Event_UNREACTION)
+}
+
+// react adds or removes a reaction and announces it if that changed anything.
+func (s *Server) react(ctx context.Context, req *pb.ReactionRequest, kind pb.Event_Kind) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	if !validEmoji(req.GetEmoji()) {
+		return nil, status.Errorf(codes.InvalidArgument, "a reaction is up to %d characters without spaces or control characters", maxEmojiLen)
+	}
+	msg, err := s.visible(user, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetDeleted() {
+		return nil, status.Errorf(codes.FailedPrecondition, "message %s was deleted", req.GetId())
+	}
+	member := req.GetEmoji() + " " + user
+	var changed bool
+	if kind == pb.Event_REACTION {
+		changed, err = s.redis.addMember(reactionsKey(msg.GetId()), member)
+	} else {
+		changed, err = s.redis.removeMember(reactionsKey(msg.GetId()), member)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		if err := s.announce(kind, msg, user, req.GetEmoji()); err != nil {
+			return nil, err
+		}
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+func (s *Server) MarkRead(ctx context.Context, req *pb.MarkReadRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	room := req.GetRoom()
+	if room == "" {
+		room = common.DEFAULT_ROOM
+	}
+	msg, _, err := s.load(req.GetMessageId())
+	if err != nil {
+		return nil, err
+	}
+	if msg.GetRecipient() != "" || msg.GetRoom() != room {
+		return nil, status.Errorf(codes.InvalidArgument, "message %s is not in room %s", req.GetMessageId(), room)
+	}
+	member, err := s.redis.isMember(roomMembersKey(room), user)
+	if err != nil {
+		return nil, err
+	}
+	if !member {
+		return nil, status.Errorf(codes.PermissionDenied, "only the members of room %s can mark it read", room)
+	}
+	moved, err := s.redis.run(markReadScript, []string{readMarkersKey(room)}, user, msg.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if moved == 1 {
+		if err := s.announce(pb.Event_READ, msg, user, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+// annotate adds the aggregated reactions and, for room messages of the rooms the user is a member of, the readers to
+// messages returned by a history query.
+func (s *Server) annotate(user string, events []*pb.Event) error {
+	markers := make(map[string]map[string]string)
+	for _, ev := range events {
+		reactions, err := s.reactions(ev.GetId())
+		if err != nil {
+			return err
+		}
+		ev.Reactions = reactions
+		if ev.GetRecipient() != "" {
+			continue
+		}
+		room := ev.GetRoom()
+		if _, ok := markers[room]; !ok {
+			// outsiders don't learn who reads the room, nil markers show no readers.
+			member, err := s.redis.isMember(roomMembersKey(room), user)
+			if err != nil {
+				return err
+			}
+			markers[room] = nil
+			if member {
+				if markers[room], err = s.redis.allFields(readMarkersKey(room)); err != nil {
+					return err
+				}
+			}
+		}
+		ev.SeenBy = seenBy(markers[room], ev.GetId())
+	}
+	return nil
+}
+
+// reactions aggregates the reactions to a message by emoji.
+func (s *Server) reactions(id string) ([]*pb.Reaction, error) {
+	members, err := s.redis.members(reactionsKey(id))
+	if err != nil {
+		return nil, err
+	}
+	byEmoji := make(map[string]*pb.Reaction)
+	for _, member := range members {
+		emoji, user, ok := strings.Cut(member, " ")
+		if !ok {
+			continue
+		}
+		r, ok := byEmoji[emoji]
+		if !ok {
+			r = &pb.Reaction{Emoji: emoji}
+			byEmoji[emoji] = r
+		}
+		r.Count++
+		r.Users = append(r.Users, user)
+	}
+	reactions := make([]*pb.Reaction, 0, len(byEmoji))
+	for _, r := range byEmoji {
+		sort.Strings(r.Users)
+		reactions = append(reactions, r)
+	}
+	sort.Slice(reactions, func(i, j int) bool { return reactions[i].Emoji < reactions[j].Emoji })
+	return reactions, nil
+}
+
+// seenBy returns the users whose read marker is at or past the message.
+func seenBy(markers map[string]string, id string) []string {
+	msgID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	var users []string
+	for user, marker := range markers {
+		if read, err := strconv.ParseInt(marker, 10, 64); err == nil && read >= msgID {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// historyOf returns the messages of a room as the user sees them, by id.
+func historyOf(t *testing.T, s *Server, ctx context.Context, room string) map[string]*pb.Event {
+	t.Helper()
+	res, err := s.GetHistory(ctx, &pb.HistoryRequest{Room: room})
+	if err != nil {
+		t.Fatalf("could not get the history: %s", err)
+	}
+	byID := make(map[string]*pb.Event)
+	for _, ev := range res.GetEvents() {
+		byID[ev.GetId()] = ev
+	}
+	return byID
+}
+
+// summary is the reactions of a message as "emoji count users" strings.
+func summary(ev *pb.Event) []string {
+	var got []string
+	for _, r := range ev.GetReactions() {
+		got = append(got, fmt.Sprintf("%s %d %s", r.GetEmoji(), r.GetCount(), strings.Join(r.GetUsers(), ",")))
+	}
+	return got
+}
+
+func TestReactionToggle(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	ctxs := connectAll(t, s, "alice", "bob", "carol")
+	id := post(t, s, ctxs["alice"], "hello")
+	bus := listen(t, s, common.CHANNEL)
+	react := func(user, emoji string) {
+		t.Helper()
+		if _, err := s.AddReaction(ctxs[user], &pb.ReactionRequest{Id: id, Emoji: emoji}); err != nil {
+			t.Fatalf("could not react as %s: %s", user, err)
+		}
+	}
+	unreact := func(user, emoji string) {
+		t.Helper()
+		if _, err := s.RemoveReaction(ctxs[user], &pb.ReactionRequest{Id: id, Emoji: emoji}); err != nil {
+			t.Fatalf("could not take back the reaction of %s: %s", user, err)
+		}
+	}
+
+	react("bob", "👍")
+	react("bob", "👍")
+	react("carol", "👍")
+	react("bob", "🎉")
+	if got, want := bus.kinds(), []pb.Event_Kind{pb.Event_REACTION, pb.Event_REACTION, pb.Event_REACTION}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected a reaction to be announced once, got %v", got)
+	}
+	if got, want := summary(historyOf(t, s, ctxs["alice"], "")[id]), []string{"🎉 1 bob", "👍 2 bob,carol"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the reactions %q, got %q", want, got)
+	}
+
+	unreact("bob", "👍")
+	unreact("bob", "👍")
+	unreact("alice", "👍")
+	if got, want := bus.kinds(), []pb.Event_Kind{pb.Event_UNREACTION}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected only the reaction taken back to be announced, got %v", got)
+	}
+	if got, want := summary(historyOf(t, s, ctxs["alice"], "")[id]), []string{"🎉 1 bob", "👍 1 carol"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the reactions %q, got %q", want, got)
+	}
+
+	if _, err := s.DeleteMessage(ctxs["alice"], &pb.DeleteMessageRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddReaction(ctxs["bob"], &pb.ReactionRequest{Id: id, Emoji: "👍"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition reacting to a deleted message, got %v", err)
+	}
+}
+
+func TestReactionToDirectMessage(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	ctxs := connectAll(t, s, "alice", "bob", "carol")
+	if _, err := s.SendDirect(ctxs["alice"], &pb.DirectMessage{To: "bob", Msg: "psst"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.GetDirectHistory(ctxs["bob"], &pb.DirectHistoryRequest{})
+	if err != nil || len(res.GetEvents()) != 1 {
+		t.Fatalf("expected the direct message, got %v %v", res.GetEvents(), err)
+	}
+	id := res.GetEvents()[0].GetId()
+	if _, err := s.AddReaction(ctxs["bob"], &pb.ReactionRequest{Id: id, Emoji: "👀"}); err != nil {
+		t.Fatalf("expected the recipient to react, got %s", err)
+	}
+	if _, err := s.AddReaction(ctxs["carol"], &pb.ReactionRequest{Id: id, Emoji: "👀"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for someone else's direct message, got %v", err)
+	}
+	if _, err := s.AddReaction(ctxs["bob"], &pb.ReactionRequest{Id: "404", Emoji: "👀"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a missing message, got %v", err)
+	}
+}
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		want  bool
+	}{
+		{"👍", true},
+		{":+1:", true},
+		{"+1", true},
+		{"👨‍👩‍👧", true},
+		{strings.Repeat("x", maxEmojiLen), true},
+		{strings.Repeat("x", maxEmojiLen+1), false},
+		{"", false},
+		{"thumbs up", false},
+		{"👍\n", false},
+		{" ", false},
+		{"\x1b[31m", false},
+		{"\x00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.emoji, func(t *testing.T) {
+			if got := validEmoji(tt.emoji); got != tt.want {
+				t.Fatalf("expected %t for %q, got %t", tt.want, tt.emoji, got)
+			}
+		})
+	}
+
+	s := newTestServers(t, 1)[0]
+	ctxs := connectAll(t, s, "alice")
+	id := post(t, s, ctxs["alice"], "hello")
+	if _, err := s.AddReaction(ctxs["alice"], &pb.ReactionRequest{Id: id, Emoji: "thumbs up"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a reaction with a space, got %v", err)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	ctxs := connectAll(t, s, "alice", "bob", "carol", "dave")
+	var ids []string
+	for _, text := range []string{"one", "two", "three"} {
+		ids = append(ids, post(t, s, ctxs["alice"], text))
+	}
+	bus := listen(t, s, common.CHANNEL)
+	markRead := func(user, room, id string) error {
+		_, err := s.MarkRead(ctxs[user], &pb.MarkReadRequest{Room: room, MessageId: id})
+		return err
+	}
+
+	for _, mark := range []struct{ user, id string }{{"bob", ids[1]}, {"carol", ids[2]}, {"bob", ids[0]}} {
+		if err := markRead(mark.user, "", mark.id); err != nil {
+			t.Fatalf("could not mark read as %s: %s", mark.user, err)
+		}
+	}
+	// markers only move forward, bob going back to the first message changes nothing.
+	if got, want := bus.kinds(), []pb.Event_Kind{pb.Event_READ, pb.Event_READ}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected two READ receipts, got %v", got)
+	}
+	history := historyOf(t, s, ctxs["alice"], "")
+	for i, want := range [][]string{{"bob", "carol"}, {"bob", "carol"}, {"carol"}} {
+		if got := history[ids[i]].GetSeenBy(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected message %d seen by %v, got %v", i+1, want, got)
+		}
+	}
+
+	if err := markRead("bob", "ops", ids[0]); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a message of another room, got %v", err)
+	}
+	if err := markRead("bob", "", "404"); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a missing message, got %v", err)
+	}
+
+	// only the members of a room mark it read and see who read it.
+	res, err := s.Chat(ctxs["alice"], &pb.Message{Room: "ops", Msg: "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := markRead("alice", "ops", res.GetId()); err != nil {
+		t.Fatalf("expected the member to mark ops read, got %s", err)
+	}
+	if err := markRead("dave", "ops", res.GetId()); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for an outsider, got %v", err)
+	}
+	if got := historyOf(t, s, ctxs["alice"], "ops")[res.GetId()].GetSeenBy(); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("expected the member to see the readers, got %v", got)
+	}
+	if got := historyOf(t, s, ctxs["dave"], "ops")[res.GetId()].GetSeenBy(); len(got) != 0 {
+		t.Fatalf("expected an outsider to see no readers, got %v", got)
+	}
+}
@@ -1,13 +1,17 @@
 package server
 
 import (
-	"errors"
 	"log"
+	"strconv"
+	"time"
 
 	re "github.com/go-redis/redis"
 	"github.com/shameerb/tcp-chat-redis/pkg/common"
 )
 
+// leases is a sorted set of connected users scored by the unix time their presence lease runs out.
+const leases = "leases"
+
 type redis struct {
 	client *re.Client
 	pubsub *re.PubSub
@@ -29,36 +33,158 @@ func initRedis(redisAddr string) (*redis, error) {
 	return &redis{client: client, pubsub: pubsub}, nil
 }
 
-func (r *redis) exists(key string) bool {
-	v := r.client.Exists(key)
-	return v.Val() == int64(1)
+func (r *redis) get(key string) (string, error) {
+	return r.client.Get(key).Result()
 }
 
-func (r *redis) set(key, value string) bool {
-	bc := r.client.SetNX(key, value, 0)
-	return bc.Val()
+// refresh extends the expiry of an existing key. It returns false if the key is gone.
+func (r *redis) expiredLeases(now time.Time) ([]string, error) {
+	return r.expired(leases, now)
 }
 
-func (r *redis) delete(key string) error {
-	v := r.client.Del(key)
-	if v.Val() != int64(1) {
-		return errors.New("user didn't exist")
-	}
-	return nil
+// expired returns the members of a sorted set scored by unix expiry time that expired by now.
+func (r *redis) expired(key string, now time.Time) ([]string, error) {
+	return r.client.ZRangeByScore(key, re.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+}
+
+// removeExpired drops the members of a sorted set scored by unix expiry time that expired by now and returns how
+// many there were.
+func (r *redis) removeExpired(key string, now time.Time) (int64, error) {
+	return r.client.ZRemRangeByScore(key, "-inf", strconv.FormatInt(now.Unix(), 10)).Result()
 }
 
-func (r *redis) publish(msg string) error {
-	return r.client.Publish(common.CHANNEL, msg).Err()
+func (r *redis) publishTo(channel, msg string) error {
+	return r.client.Publish(channel, msg).Err()
 }
 
-func (r *redis) search(key string) ([]string, error) {
-	// keys is resource intensive. Use scan instead.
-	// run a for loop with pagination using scan. 		keys, nextCursor, err := client.Scan(context.Background(), cursor, match, int64(count)).Result()
-	keys, err := r.client.Keys(key).Result()
+func (r *redis) incr(key string) (int64, error) {
+	return r.client.Incr(key).Result()
+}
+
+// run executes a lua script that returns an integer.
+func (r *redis) run(script *re.Script, keys []string, args ...interface{}) (int64, error) {
+	return script.Run(r.client, keys, args...).Int64()
+}
+
+func (r *redis) subscribe(channels ...string) *re.PubSub {
+	return r.client.Subscribe(channels...)
+}
+
+// addMember adds the member to a set. It returns false if it was a member already.
+func (r *redis) addMember(set, member string) (bool, error) {
+	n, err := r.client.SAdd(set, member).Result()
+	return n == 1, err
+}
+
+// removeMember removes the member from a set. It returns false if it was not a member.
+func (r *redis) removeMember(set, member string) (bool, error) {
+	n, err := r.client.SRem(set, member).Result()
+	return n == 1, err
+}
+
+func (r *redis) members(set string) ([]string, error) {
+	return r.client.SMembers(set).Result()
+}
+
+func (r *redis) isMember(set, member string) (bool, error) {
+	return r.client.SIsMember(set, member).Result()
+}
+
+// areMembers reports which of the members are in a set, in one round trip.
+func (r *redis) areMembers(set string, members []string) ([]bool, error) {
+	cmds := make([]*re.BoolCmd, len(members))
+	err := r.pipelined(func(pipe re.Pipeliner) error {
+		for i, member := range members {
+			cmds[i] = pipe.SIsMember(set, member)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	in := make([]bool, len(members))
+	for i, cmd := range cmds {
+		in[i] = cmd.Val()
+	}
+	return in, nil
+}
+
+func (r *redis) setValue(key, value string) error {
+	return r.client.Set(key, value, 0).Err()
+}
+
+func (r *redis) del(keys ...string) error {
+	return r.client.Del(keys...).Err()
+}
 
-	return keys, nil
+// setIfAbsent sets the key unless it exists. It returns false if it did.
+func (r *redis) setIfAbsent(key string, value interface{}) (bool, error) {
+	return r.client.SetNX(key, value, 0).Result()
+}
+
+// scoreMember adds the member to a sorted set with the given score.
+func (r *redis) scoreMember(key string, score float64, member string) error {
+	return r.client.ZAdd(key, re.Z{Score: score, Member: member}).Err()
+}
+
+// revRangeByScore returns up to count members of a sorted set with a score from min to max, highest score first.
+func (r *redis) revRangeByScore(key, min, max string, count int64) ([]string, error) {
+	return r.client.ZRevRangeByScore(key, re.ZRangeBy{Min: min, Max: max, Count: count}).Result()
+}
+
+// rangeByScore returns up to count members of a sorted set with a score from min, lowest score first.
+func (r *redis) rangeByScore(key, min string, count int64) ([]string, error) {
+	return r.client.ZRangeByScore(key, re.ZRangeBy{Min: min, Max: "+inf", Count: count}).Result()
+}
+
+// rangeByRank returns the members of a sorted set from rank start to stop (inclusive), lowest score first.
+func (r *redis) rangeByRank(key string, start, stop int64) ([]string, error) {
+	return r.client.ZRange(key, start, stop).Result()
+}
+
+// removeScored removes the member from a sorted set. It returns false if it was not a member.
+func (r *redis) removeScored(key, member string) (bool, error) {
+	n, err := r.client.ZRem(key, member).Result()
+	return n == 1, err
+}
+
+// countByScore counts the members of a sorted set with a score from min.
+func (r *redis) countByScore(key, min string) (int64, error) {
+	return r.client.ZCount(key, min, "+inf").Result()
+}
+
+func (r *redis) count(key string) (int64, error) {
+	return r.client.ZCard(key).Result()
+}
+
+// pipelined sends the commands queued by fn in one round trip.
+func (r *redis) pipelined(fn func(re.Pipeliner) error) error {
+	_, err := r.client.Pipelined(fn)
+	return err
+}
+
+// listRange returns every element of a list.
+func (r *redis) listRange(key string) ([]string, error) {
+	return r.client.LRange(key, 0, -1).Result()
+}
+
+func (r *redis) setFields(key string, fields map[string]interface{}) error {
+	return r.client.HMSet(key, fields).Err()
+}
+
+func (r *redis) allFields(key string) (map[string]string, error) {
+	return r.client.HGetAll(key).Result()
+}
+
+func (r *redis) getFields(key string, fields ...string) ([]interface{}, error) {
+	return r.client.HMGet(key, fields...).Result()
+}
 
+// rangeByLex returns up to count members of a lexicographic index between min and max, using redis ZRANGEBYLEX
+// syntax for the bounds ("[a" inclusive, "(a" exclusive, "-" and "+" for the ends).
+func (r *redis) rangeByLex(key, min, max string, count int64) ([]string, error) {
+	return r.client.ZRangeByLex(key, re.ZRangeBy{Min: min, Max: max, Count: count}).Result()
 }
@@ -0,0 +1,449 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	re "github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The janitor periodically purges the oldest messages of every room and conversation that exceed their retention
+// limits, together with their revisions, reactions, search index entries and attachments. It also sweeps state the
+// normal flow can leave behind: users listed online without a session or lease, typing indicators that ran out and
+// sessions that expired, and deletes uploads nobody shared. Every server instance runs a janitor, the purges are idempotent.
+
+// janitorInterval is how often the janitor runs.
+const janitorInterval = time.Minute
+
+// Retention limits how much history is kept. A zero limit means no limit.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int64
+	// MaxBytes bounds the size of the stored messages and their attachments.
+	MaxBytes int64
+}
+
+// ParseRetention parses limits written as "max_age=720h,max_count=10000,max_bytes=104857600". Limits left out
+// are zero.
+func ParseRetention(spec string) (Retention, error) {
+	var r Retention
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return r, fmt.Errorf("expected name=value, got %q", part)
+		}
+		var err error
+		switch name {
+		case "max_age":
+			r.MaxAge, err = time.ParseDuration(value)
+		case "max_count":
+			r.MaxCount, err = strconv.ParseInt(value, 10, 64)
+		case "max_bytes":
+			r.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return r, fmt.Errorf("unknown retention limit %q", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	return r, nil
+}
+
+func (r Retention) isZero() bool {
+	return r == Retention{}
+}
+
+// merge returns r with the limits set in o replacing its own.
+func (r Retention) merge(o Retention) Retention {
+	if o.MaxAge != 0 {
+		r.MaxAge = o.MaxAge
+	}
+	if o.MaxCount != 0 {
+		r.MaxCount = o.MaxCount
+	}
+	if o.MaxBytes != 0 {
+		r.MaxBytes = o.MaxBytes
+	}
+	return r
+}
+
+// WithRetention sets the retention limits of every room and conversation.
+func WithRetention(r Retention) Option {
+	return func(s *Server) {
+		s.retention = r
+	}
+}
+
+// WithRoomRetention sets retention limits for one room. The limits it sets replace the global ones.
+func WithRoomRetention(room string, r Retention) Option {
+	return func(s *Server) {
+		s.roomRetention[room] = r
+	}
+}
+
+func (s *Server) retentionFor(room string) Retention {
+	r := s.retention
+	if o, ok := s.roomRetention[room]; ok && room != "" {
+		r = r.merge(o)
+	}
+	return r
+}
+
+func (s *Server) janitor() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			log.Println("context cancel, exiting janitor")
+			return
+		case now := <-ticker.C:
+			report, err := s.clean(now, false)
+			if err != nil {
+				log.Printf("janitor failed: %s", err)
+				continue
+			}
+			logReport(report)
+		}
+	}
+}
+
+func logReport(report *pb.PurgeReport) {
+	var messages, bytes int64
+	for _, h := range report.GetHistories() {
+		messages += h.GetMessages()
+		bytes += h.GetBytes()
+	}
+	if messages == 0 && report.GetPresence() == 0 && report.GetTyping() == 0 && report.GetSessions() == 0 && report.GetAttachments() == 0 {
+		return
+	}
+	log.Printf("janitor purged %d messages (%d bytes) from %d histories, %d stale presence entries, %d typing indicators, %d sessions, %d unshared attachments",
+		messages, bytes, len(report.GetHistories()), report.GetPresence(), report.GetTyping(), report.GetSessions(), report.GetAttachments())
+}
+
+func (s *Server) Purge(ctx context.Context, req *pb.PurgeRequest) (*pb.PurgeReport, error) {
+	user, _ := UserFromContext(ctx)
+	if !s.moderators[user] {
+		return nil, status.Error(codes.PermissionDenied, "only server moderators can purge")
+	}
+	return s.clean(time.Now(), req.GetDryRun())
+}
+
+// clean enforces the retention limits and sweeps stale state. With dryRun it only reports what it would do.
+func (s *Server) clean(now time.Time, dryRun bool) (*pb.PurgeReport, error) {
+	report := &pb.PurgeReport{DryRun: dryRun}
+	rooms, err := s.redis.allFields(histories)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(rooms))
+	for key := range rooms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r := s.retentionFor(rooms[key])
+		if r.isZero() {
+			continue
+		}
+		h, purged, err := s.planPurge(key, r, now)
+		if err != nil {
+			return nil, err
+		}
+		if len(purged) == 0 {
+			continue
+		}
+		h.Room = rooms[key]
+		report.Histories = append(report.Histories, h)
+		if !dryRun {
+			if err := s.purge(key, purged); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if report.Presence, err = s.sweepPresence(dryRun); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		expired, err := s.redis.expired(typing, now)
+		if err != nil {
+			return nil, err
+		}
+		report.Typing = int64(len(expired))
+	} else if report.Typing, err = s.redis.removeExpired(typing, now); err != nil {
+		return nil, err
+	}
+	if report.Sessions, err = s.sweepSessions(now, dryRun); err != nil {
+		return nil, err
+	}
+	if report.Attachments, err = s.sweepAttachments(now, dryRun); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// purgeBatch is how many messages the janitor looks at in one go, from the oldest end of a history.
+const purgeBatch = 100
+
+// purgedMessage is a message the janitor purges, or a dangling id without a message.
+type purgedMessage struct {
+	ev   *pb.Event
+	size int64
+}
+
+// planPurge returns the messages of a history that exceed the retention limits, oldest first. They are always the
+// oldest messages of the history, so it walks up from the oldest one and stops at the first message it keeps.
+func (s *Server) planPurge(key string, r Retention, now time.Time) (*pb.PurgedHistory, []purgedMessage, error) {
+	count, err := s.redis.count(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bytes int64
+	if r.MaxBytes > 0 {
+		if bytes, err = s.historySize(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	h := &pb.PurgedHistory{History: key}
+	var purged []purgedMessage
+	cutoff := now.Add(-r.MaxAge)
+	for start := int64(0); ; start += purgeBatch {
+		ids, err := s.redis.rangeByRank(key, start, start+purgeBatch-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ids) == 0 {
+			return h, purged, nil
+		}
+		for _, id := range ids {
+			ev, raw, err := s.load(id)
+			if status.Code(err) == codes.NotFound {
+				// a dangling id, drop it from the history.
+				purged = append(purged, purgedMessage{ev: &pb.Event{Id: id}})
+				count--
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			tooMany := r.MaxCount > 0 && count > r.MaxCount
+			tooBig := r.MaxBytes > 0 && bytes > r.MaxBytes
+			tooOld := r.MaxAge > 0 && ev.GetTimestamp().AsTime().Before(cutoff)
+			if !tooMany && !tooBig && !tooOld {
+				return h, purged, nil
+			}
+			size := messageSize(ev, raw)
+			purged = append(purged, purgedMessage{ev: ev, size: size})
+			count--
+			bytes -= size
+			h.Messages++
+			h.Bytes += size
+			h.ThroughId = ev.GetId()
+		}
+	}
+}
+
+// historySize returns the size of a history. Histories are counted once, by the first janitor to need their size,
+// and the counter is kept up to date from then on.
+func (s *Server) historySize(key string) (int64, error) {
+	counter := historyBytesKey(key)
+	for {
+		n, err := s.redis.get(counter)
+		if err == nil {
+			return strconv.ParseInt(n, 10, 64)
+		}
+		if err != re.Nil {
+			return 0, err
+		}
+		ids, err := s.redis.revRangeByScore(key, "-inf", "+inf", 0)
+		if err != nil {
+			return 0, err
+		}
+		var size int64
+		for _, id := range ids {
+			ev, raw, err := s.load(id)
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			size += messageSize(ev, raw)
+		}
+		// another janitor may have counted it meanwhile, its count is as good.
+		if ok, err := s.redis.setIfAbsent(counter, size); ok || err != nil {
+			return size, err
+		}
+	}
+}
+
+// messageSize is the size of a stored message and its attachments.
+func messageSize(ev *pb.Event, raw string) int64 {
+	size := int64(len(raw))
+	for _, a := range ev.GetAttachments() {
+		size += a.GetSize()
+	}
+	return size
+}
+
+// purge removes messages from a history together with everything stored about them. Attachments go with the last
+// message referencing them.
+func (s *Server) purge(key string, messages []purgedMessage) error {
+	terms := make([][]string, len(messages))
+	for i, m := range messages {
+		var err error
+		if terms[i], err = s.indexedTerms(m.ev); err != nil {
+			return err
+		}
+	}
+	err := s.redis.pipelined(func(pipe re.Pipeliner) error {
+		for i, m := range messages {
+			id := m.ev.GetId()
+			keys := []string{key, historyBytesKey(key), messageKey(id), revisionsKey(id), reactionsKey(id)}
+			purgeMessageScript.Eval(pipe, keys, id, m.size)
+			for _, term := range terms[i] {
+				pipe.ZRem(searchTermKey(term), id)
+			}
+			for _, user := range m.ev.GetMentions() {
+				pipe.ZRem(mentionsKey(user), id)
+			}
+			if m.ev.GetRecipient() != "" {
+				pipe.ZRem(directKey(m.ev.GetSender()), id)
+				pipe.ZRem(directKey(m.ev.GetRecipient()), id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		for _, a := range m.ev.GetAttachments() {
+			deleted, err := s.redis.run(releaseAttachmentScript, []string{attachmentKey(a.GetId()), attachmentRefsKey(a.GetId())}, m.ev.GetId())
+			if err != nil {
+				return err
+			}
+			if deleted == 0 || s.blobs == nil {
+				continue
+			}
+			if err := s.blobs.Delete(a.GetId()); err != nil {
+				log.Printf("could not delete attachment %s: %s", a.GetId(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexedTerms returns the words the search index may hold a message under: those of its body and of the revisions
+// edits replaced.
+func (s *Server) indexedTerms(ev *pb.Event) ([]string, error) {
+	revisions, err := s.redis.listRange(revisionsKey(ev.GetId()))
+	if err != nil {
+		return nil, err
+	}
+	bodies := []string{ev.GetBody()}
+	for _, raw := range revisions {
+		old := &pb.Event{}
+		if err := proto.Unmarshal([]byte(raw), old); err != nil {
+			log.Printf("could not decode a revision of message %s: %s", ev.GetId(), err)
+			continue
+		}
+		bodies = append(bodies, old.GetBody())
+	}
+	seen := make(map[string]bool)
+	var terms []string
+	for _, body := range bodies {
+		for _, t := range tokenize(body) {
+			if !seen[t.term] {
+				seen[t.term] = true
+				terms = append(terms, t.term)
+			}
+		}
+	}
+	return terms, nil
+}
+
+// sweepAttachments deletes the uploads that were not shared in a message within unsharedAttachmentTTL.
+func (s *Server) sweepAttachments(now time.Time, dryRun bool) (int64, error) {
+	ids, err := s.redis.expired(unsharedAttachments, now)
+	if err != nil {
+		return 0, err
+	}
+	flag := "0"
+	if dryRun {
+		flag = "1"
+	}
+	var swept int64
+	for _, id := range ids {
+		n, err := s.redis.run(sweepAttachmentScript, []string{attachmentKey(id), attachmentRefsKey(id), unsharedAttachments}, id, flag)
+		if err != nil {
+			return swept, err
+		}
+		swept += n
+		if n == 0 || dryRun || s.blobs == nil {
+			continue
+		}
+		if err := s.blobs.Delete(id); err != nil {
+			log.Printf("could not delete attachment %s: %s", id, err)
+		}
+	}
+	return swept, nil
+}
+
+// sweepPresence drops users listed online that have neither a session nor a lease for the reaper to expire.
+func (s *Server) sweepPresence(dryRun bool) (int64, error) {
+	users, err := s.redis.rangeByLex(online, "-", "+", 0)
+	if err != nil {
+		return 0, err
+	}
+	flag := "0"
+	if dryRun {
+		flag = "1"
+	}
+	var swept int64
+	for _, user := range users {
+		n, err := s.redis.run(sweepPresenceScript, []string{activeKey(user), leases, online, presenceKey(user)}, user, flag)
+		if err != nil {
+			return swept, err
+		}
+		swept += n
+	}
+	return swept, nil
+}
+
+// sweepSessions deletes the sessions that expired a lease ago. The grace period keeps the janitor away from
+// sessions a heartbeat is renewing right now.
+func (s *Server) sweepSessions(now time.Time, dryRun bool) (int64, error) {
+	ids, err := s.redis.expired(sessions, now.Add(-common.LEASE_TTL))
+	if err != nil {
+		return 0, err
+	}
+	if dryRun || len(ids) == 0 {
+		return int64(len(ids)), nil
+	}
+	err = s.redis.pipelined(func(pipe re.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Del(sessionKey(id))
+			pipe.ZRem(sessions, id)
+		}
+		return nil
+	})
+	return int64(len(ids)), err
+}
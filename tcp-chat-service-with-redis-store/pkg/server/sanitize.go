@@ -0,0 +1,19 @@
+package server
+
+import (
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Text users send reaches other users' terminals, so it never carries control characters: message bodies are
+// sanitized, escaping them, and names of users and rooms, reactions and filenames that have any are refused, since a
+// name changed behind the user's back would name something else.
+
+// checkName refuses a name with control characters. what says what it names.
+func checkName(what, name string) error {
+	if !markup.Clean(name) {
+		return status.Errorf(codes.InvalidArgument, "%s can't contain control characters", what)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import re "github.com/go-redis/redis"
+
+// Presence changes touch several keys. They run as lua scripts so that redis applies each of them atomically and
+// concurrent server instances can never interleave (two sessions for one name, a user announced as left twice ...).
+
+// connectScript claims a username and opens its session. Every user is a member of the default room, which has no
+// creator and so no room moderator: only the server moderators moderate it.
+//
+// KEYS: active.<user>, session.<id>, leases, users, online, presence.<user>, room.<default>.members, sessions
+// ARGV: session id, user, lease ttl (ms), lease expiry (unix), now (unix)
+// returns 1 if the name was claimed, 0 if it is taken.
+var connectScript = re.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3], 'NX') then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[2])
+redis.call('SADD', KEYS[4], ARGV[2])
+redis.call('ZADD', KEYS[5], 0, ARGV[2])
+redis.call('HMSET', KEYS[6], 'connected_since', ARGV[5], 'last_seen', ARGV[5])
+redis.call('SADD', KEYS[7], ARGV[2])
+redis.call('ZADD', KEYS[8], ARGV[4], ARGV[1])
+return 1
+`)
+
+// disconnectScript releases a username and closes its session, as long as the session still owns the name.
+//
+// KEYS: active.<user>, session.<id>, leases, online, presence.<user>, sessions
+// ARGV: session id, user
+// returns 1 if the user was disconnected, 0 if the session did not own the name (anymore).
+var disconnectScript = re.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[5])
+redis.call('ZREM', KEYS[3], ARGV[2])
+redis.call('ZREM', KEYS[4], ARGV[2])
+redis.call('ZREM', KEYS[6], ARGV[1])
+return 1
+`)
+
+// renameScript moves a session from one username to another.
+//
+// KEYS: active.<old>, active.<new>, session.<id>, leases, online, presence.<old>, presence.<new>, users,
+// room.<default>.members, sessions
+// ARGV: session id, old, new, lease ttl (ms), lease expiry (unix)
+// returns 1 if renamed, 0 if the new name is taken, -1 if the session does not own the old name.
+var renameScript = re.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return -1
+end
+if not redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[4], 'NX') then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[4])
+redis.call('ZREM', KEYS[4], ARGV[2])
+redis.call('ZADD', KEYS[4], ARGV[5], ARGV[3])
+redis.call('ZREM', KEYS[5], ARGV[2])
+redis.call('ZADD', KEYS[5], 0, ARGV[3])
+if redis.call('EXISTS', KEYS[6]) == 1 then
+	redis.call('RENAME', KEYS[6], KEYS[7])
+end
+redis.call('SADD', KEYS[8], ARGV[3])
+redis.call('SADD', KEYS[9], ARGV[3])
+redis.call('ZADD', KEYS[10], ARGV[5], ARGV[1])
+return 1
+`)
+
+// heartbeatScript renews the lease of a session, as long as the session still owns the name.
+//
+// KEYS: active.<user>, session.<id>, leases, sessions, presence.<user>
+// ARGV: session id, user, lease ttl (ms), lease expiry (unix), now (unix)
+// returns 1 if renewed, -1 if the session does not own the name (it expired, was reaped or renamed).
+var heartbeatScript = re.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] or redis.call('EXISTS', KEYS[2]) == 0 then
+	return -1
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[2])
+redis.call('ZADD', KEYS[4], ARGV[4], ARGV[1])
+redis.call('HSET', KEYS[5], 'last_seen', ARGV[5])
+return 1
+`)
+
+// reapScript expires a user whose lease lapsed, unless a heartbeat renewed it in the meantime.
+//
+// KEYS: active.<user>, leases, online, presence.<user>
+// ARGV: user
+// returns 1 if the user was expired by this call.
+var reapScript = re.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('DEL', KEYS[4])
+return 1
+`)
+
+// reviseScript replaces a stored message if nobody changed it since it was read, keeping the old version.
+//
+// KEYS: msg.<id>, msg.<id>.revisions, <history>.bytes
+// ARGV: message as read, revised message, change in size
+// returns 1 if replaced, 0 if the message changed in the meantime.
+var reviseScript = re.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('RPUSH', KEYS[2], ARGV[1])
+redis.call('SET', KEYS[1], ARGV[2])
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('INCRBY', KEYS[3], ARGV[3])
+end
+return 1
+`)
+
+// resizeHistoryScript adds to the size of a history. Sizes are only kept once the janitor counted the history, see
+// historySize.
+//
+// KEYS: <history>.bytes
+// ARGV: change in size
+var resizeHistoryScript = re.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('INCRBY', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// purgeMessageScript removes a message from its history and deletes it, once: purging it again changes nothing.
+//
+// KEYS: <history>, <history>.bytes, msg.<id>, msg.<id>.revisions, msg.<id>.reactions
+// ARGV: id, size
+// returns 1 if the message was purged, 0 if it was gone already.
+var purgeMessageScript = re.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('DECRBY', KEYS[2], ARGV[2])
+end
+redis.call('DEL', KEYS[3], KEYS[4], KEYS[5])
+return 1
+`)
+
+// releaseAttachmentScript drops a message from the messages referencing an attachment and deletes the attachment
+// once no message references it.
+//
+// KEYS: attachment.<id>, attachment.<id>.refs
+// ARGV: message id
+// returns 1 if the attachment was deleted, its content can go too.
+var releaseAttachmentScript = re.NewScript(`
+redis.call('SREM', KEYS[2], ARGV[1])
+if redis.call('SCARD', KEYS[2]) > 0 then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// sweepAttachmentScript deletes an upload nobody shared in time. An attachment shared meanwhile only leaves the set
+// of unshared uploads.
+//
+// KEYS: attachment.<id>, attachment.<id>.refs, attachments.unshared
+// ARGV: attachment id, dry run (1 to only report)
+// returns 1 if the attachment was (or would be) deleted, its content can go too.
+var sweepAttachmentScript = re.NewScript(`
+if redis.call('SCARD', KEYS[2]) > 0 then
+	if ARGV[2] ~= '1' then
+		redis.call('ZREM', KEYS[3], ARGV[1])
+	end
+	return 0
+end
+if ARGV[2] == '1' then
+	return 1
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+return 1
+`)
+
+// joinRoomScript adds a member to a room. Whoever creates the room by joining it first becomes its moderator, if the
+// room has creators.
+//
+// KEYS: room.<room>.members, room.<room>.moderators
+// ARGV: user, 1 if the creator becomes a moderator, 0 if not
+var joinRoomScript = re.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 1 and ARGV[2] == '1' and redis.call('SCARD', KEYS[1]) == 1 then
+	redis.call('SADD', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+// markReadScript moves a user's read marker in a room forward. Markers never move back.
+//
+// KEYS: room.<room>.read
+// ARGV: user, message id
+// returns 1 if the marker moved, 0 if it already was at or past the message.
+var markReadScript = re.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if current >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// typingScript marks a user typing until an expiry, unless it did so recently: a client renewing it more often is
+// not announced again before half the indicator ran out.
+//
+// KEYS: typing
+// ARGV: member, expiry (unix), renew after (unix): a stored expiry later than this is recent
+// returns 1 if marked, 0 if it was marked recently.
+var typingScript = re.NewScript(`
+local expires = tonumber(redis.call('ZSCORE', KEYS[1], ARGV[1]) or '0')
+if expires > tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// sweepPresenceScript drops the presence of a user that is listed online without a session or a lease, which the
+// reaper would never look at.
+//
+// KEYS: active.<user>, leases, online, presence.<user>
+// ARGV: user, dry run (1 to only report)
+// returns 1 if the user was (or would be) dropped.
+var sweepPresenceScript = re.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 0
+end
+if ARGV[2] == '1' then
+	return 1
+end
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('DEL', KEYS[4])
+return 1
+`)
+
+// swapTermScript moves the rebuilt index entries of a word into the live index. The live entries up to the newest
+// rebuilt message are replaced, those of newer messages are kept.
+//
+// KEYS: search.term.<word>, search.rebuild.term.<word>, search.terms
+// ARGV: word, newest rebuilt message id
+// returns 1 if the word is still indexed, 0 if it was dropped.
+var swapTermScript = re.NewScript(`
+local newest = tonumber(ARGV[2])
+for _, id in ipairs(redis.call('ZRANGE', KEYS[1], 0, -1)) do
+	if tonumber(id) <= newest then
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+redis.call('ZUNIONSTORE', KEYS[1], 2, KEYS[1], KEYS[2], 'AGGREGATE', 'MAX')
+redis.call('DEL', KEYS[2])
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+	return 0
+end
+redis.call('ZADD', KEYS[3], 0, ARGV[1])
+return 1
+`)
@@ -0,0 +1,509 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	re "github.com/go-redis/redis"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The search index is inverted: every word of a room message adds the message id to search.term.<word>, a sorted
+// set scored by when the message was sent (unix ms), so that time bounds narrow a search before anything is
+// loaded, and the word to the lexicographic index search.terms, which prefix queries expand against.
+// The index only narrows down the candidates. Every candidate is checked against its current text, so edits just
+// add their words and deleted messages drop out, and reindexing cleans up the words that no longer match.
+//
+// Reindexing builds a new index next to the live one, under search.rebuild.*, and then swaps it in word by word.
+// Servers keep searching the live index and adding new messages to it meanwhile.
+
+const (
+	searchTerms        = "search.terms"
+	rebuildTerms       = "search.rebuild.terms"
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// maxSearchCandidates bounds how many messages a single search looks at.
+	maxSearchCandidates = 5000
+	// maxPrefixTerms bounds how many words a prefix expands to.
+	maxPrefixTerms = 200
+	snippetLen     = 160
+	snippetContext = 40
+)
+
+func searchTermKey(term string) string {
+	return "search.term." + term
+}
+
+// rebuildTermKey is searchTermKey in the index being rebuilt.
+func rebuildTermKey(term string) string {
+	return "search.rebuild.term." + term
+}
+
+// token is a word of a message and where it is in the text.
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower cased words of letters and digits.
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// clause is a part of a query: a word or a phrase. With prefix set its last word matches any word starting with it.
+type clause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseQuery splits a query into clauses: "quoted words" are a phrase, others single words, a trailing * a prefix.
+func parseQuery(query string) []clause {
+	var clauses []clause
+	add := func(text string) {
+		prefix := strings.HasSuffix(strings.TrimSpace(text), "*")
+		var terms []string
+		for _, t := range tokenize(text) {
+			terms = append(terms, t.term)
+		}
+		if len(terms) > 0 {
+			clauses = append(clauses, clause{terms: terms, prefix: prefix})
+		}
+	}
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			add(part)
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			add(word)
+		}
+	}
+	return clauses
+}
+
+// match returns the spans of the text matched by the clause.
+func (c clause) match(tokens []token) [][2]int {
+	var spans [][2]int
+	for i := 0; i+len(c.terms) <= len(tokens); i++ {
+		matched := true
+		for k, term := range c.terms {
+			got := tokens[i+k].term
+			if got != term && !(c.prefix && k == len(c.terms)-1 && strings.HasPrefix(got, term)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			spans = append(spans, [2]int{tokens[i].start, tokens[i+len(c.terms)-1].end})
+		}
+	}
+	return spans
+}
+
+// index adds the words of a room message to the search index.
+func (s *Server) index(ev *pb.Event) error {
+	return s.indexInto(ev, searchTermKey, searchTerms)
+}
+
+// indexInto adds the words of a room message to the index made of the keys termKey names and the terms set.
+func (s *Server) indexInto(ev *pb.Event, termKey func(string) string, terms string) error {
+	seen := make(map[string]bool)
+	score := sentScore(ev)
+	return s.redis.pipelined(func(pipe re.Pipeliner) error {
+		for _, t := range tokenize(ev.GetBody()) {
+			if seen[t.term] {
+				continue
+			}
+			seen[t.term] = true
+			pipe.ZAdd(termKey(t.term), re.Z{Score: score, Member: ev.GetId()})
+			pipe.ZAdd(terms, re.Z{Score: 0, Member: t.term})
+		}
+		return nil
+	})
+}
+
+// sentScore is when a message was sent, as scored in the index.
+func sentScore(ev *pb.Event) float64 {
+	return float64(ev.GetTimestamp().AsTime().UnixMilli())
+}
+
+// sentRange returns the index score bounds of the time filters of a search. filtered applies them exactly.
+func sentRange(req *pb.SearchRequest) (min, max string) {
+	min, max = "-inf", "+inf"
+	if req.GetAfter() != nil {
+		min = strconv.FormatInt(req.GetAfter().AsTime().UnixMilli(), 10)
+	}
+	if req.GetBefore() != nil {
+		max = strconv.FormatInt(req.GetBefore().AsTime().UnixMilli(), 10)
+	}
+	return min, max
+}
+
+// searchable reports whether a message belongs in the search index.
+func searchable(ev *pb.Event) bool {
+	return ev.GetKind() == pb.Event_TEXT && ev.GetRecipient() == "" && !ev.GetDeleted()
+}
+
+// expand returns the index keys holding the candidates of a clause: the rarest of its words, or every word the
+// prefix expands to if that is all there is.
+func (s *Server) expand(c clause) ([]string, int64, error) {
+	exact := c.terms
+	if c.prefix {
+		exact = c.terms[:len(c.terms)-1]
+	}
+	if len(exact) == 0 {
+		prefix := c.terms[0]
+		terms, err := s.redis.rangeByLex(searchTerms, "["+prefix, "["+prefix+"\xff", maxPrefixTerms)
+		if err != nil {
+			return nil, 0, err
+		}
+		var keys []string
+		var total int64
+		for _, term := range terms {
+			n, err := s.redis.count(searchTermKey(term))
+			if err != nil {
+				return nil, 0, err
+			}
+			keys = append(keys, searchTermKey(term))
+			total += n
+		}
+		return keys, total, nil
+	}
+	var rarest string
+	var least int64 = -1
+	for _, term := range exact {
+		n, err := s.redis.count(searchTermKey(term))
+		if err != nil {
+			return nil, 0, err
+		}
+		if least < 0 || n < least {
+			rarest, least = searchTermKey(term), n
+		}
+	}
+	return []string{rarest}, least, nil
+}
+
+// candidates returns the ids of the messages sent between min and max (index scores) that may match the query,
+// newest first.
+func (s *Server) candidates(clauses []clause, min, max string) ([]int64, error) {
+	var keys []string
+	var least int64 = -1
+	for _, c := range clauses {
+		k, n, err := s.expand(c)
+		if err != nil {
+			return nil, err
+		}
+		if least < 0 || n < least {
+			keys, least = k, n
+		}
+	}
+	seen := make(map[int64]bool)
+	var ids []int64
+	for _, key := range keys {
+		members, err := s.redis.revRangeByScore(key, min, max, maxSearchCandidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			id, err := strconv.ParseInt(m, 10, 64)
+			if err != nil || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if len(ids) > maxSearchCandidates {
+		ids = ids[:maxSearchCandidates]
+	}
+	return ids, nil
+}
+
+func (s *Server) SearchMessages(ctx context.Context, req *pb.SearchRequest) (*pb.SearchResponse, error) {
+	user, _ := UserFromContext(ctx)
+	clauses := parseQuery(req.GetQuery())
+	if len(clauses) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "query has no words to search for")
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	// membership of the rooms seen so far.
+	member := make(map[string]bool)
+	isMember := func(room string) (bool, error) {
+		if m, ok := member[room]; ok {
+			return m, nil
+		}
+		m, err := s.redis.isMember(roomMembersKey(room), user)
+		if err != nil {
+			return false, err
+		}
+		member[room] = m
+		return m, nil
+	}
+	if req.GetRoom() != "" {
+		m, err := isMember(req.GetRoom())
+		if err != nil {
+			return nil, err
+		}
+		if !m {
+			return nil, status.Errorf(codes.PermissionDenied, "you are not a member of %s", req.GetRoom())
+		}
+	}
+
+	min, max := sentRange(req)
+	ids, err := s.candidates(clauses, min, max)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.SearchResponse{}
+	for _, id := range ids {
+		if len(res.Results) == limit {
+			break
+		}
+		ev, _, err := s.load(strconv.FormatInt(id, 10))
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !searchable(ev) || !filtered(req, ev) {
+			continue
+		}
+		m, err := isMember(ev.GetRoom())
+		if err != nil {
+			return nil, err
+		}
+		if !m {
+			continue
+		}
+		spans, ok := matchAll(clauses, tokenize(ev.GetBody()))
+		if !ok {
+			continue
+		}
+		res.Results = append(res.Results, &pb.SearchResult{Message: ev, Snippet: snippet(ev.GetBody(), spans)})
+	}
+	if err := s.annotate(user, messagesOf(res.Results)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// filtered reports whether a message passes the room, sender and time filters of a search.
+func filtered(req *pb.SearchRequest, ev *pb.Event) bool {
+	if req.GetRoom() != "" && ev.GetRoom() != req.GetRoom() {
+		return false
+	}
+	if req.GetFromUser() != "" && ev.GetSender() != req.GetFromUser() {
+		return false
+	}
+	sent := ev.GetTimestamp().AsTime()
+	if req.GetBefore() != nil && !sent.Before(req.GetBefore().AsTime()) {
+		return false
+	}
+	if req.GetAfter() != nil && !sent.After(req.GetAfter().AsTime()) {
+		return false
+	}
+	return true
+}
+
+// matchAll returns the sorted, merged spans matched by the clauses if every one of them matches.
+func matchAll(clauses []clause, tokens []token) ([][2]int, bool) {
+	var spans [][2]int
+	for _, c := range clauses {
+		matched := c.match(tokens)
+		if len(matched) == 0 {
+			return nil, false
+		}
+		spans = append(spans, matched...)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	merged := spans[:1]
+	for _, sp := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if sp[0] <= last[1] {
+			if sp[1] > last[1] {
+				last[1] = sp[1]
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged, true
+}
+
+// snippet cuts an excerpt of up to about snippetLen bytes around the first match out of the text and wraps the
+// matches in it in **. Cuts fall on spaces, so words stay whole.
+func snippet(text string, spans [][2]int) string {
+	start, end := 0, len(text)
+	if len(text) > snippetLen {
+		start = spans[0][0] - snippetContext
+		if start < 0 {
+			start = 0
+		}
+		for start > 0 && text[start-1] != ' ' {
+			start--
+		}
+		end = start + snippetLen
+		if end > len(text) {
+			end = len(text)
+		}
+		for end < len(text) && text[end] != ' ' {
+			end++
+		}
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, sp := range spans {
+		if sp[0] < pos || sp[1] > end {
+			continue
+		}
+		b.WriteString(text[pos:sp[0]])
+		b.WriteString("**" + text[sp[0]:sp[1]] + "**")
+		pos = sp[1]
+	}
+	b.WriteString(text[pos:end])
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func messagesOf(results []*pb.SearchResult) []*pb.Event {
+	events := make([]*pb.Event, len(results))
+	for i, r := range results {
+		events[i] = r.GetMessage()
+	}
+	return events
+}
+
+// Reindex rebuilds the search index from the stored messages, dropping words that no longer match and adding
+// messages stored before search existed. It returns how many messages were indexed.
+func Reindex(redisAddr string) (int, error) {
+	s := NewServer(redisAddr, "")
+	var err error
+	if s.redis, err = initRedis(redisAddr); err != nil {
+		return 0, err
+	}
+	defer s.redis.client.Close()
+	return s.reindex()
+}
+
+func (s *Server) reindex() (int, error) {
+	last, err := s.redis.get(eventSeq)
+	if err == re.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	indexed, err := s.rebuildIndex(n)
+	if err != nil {
+		return indexed, err
+	}
+	return indexed, s.swapIndex(n)
+}
+
+// rebuildIndex indexes the messages up to the id newest into the rebuilt index. It returns how many it indexed.
+func (s *Server) rebuildIndex(newest int64) (int, error) {
+	// left over from a reindex that did not finish.
+	if err := s.dropIndex(rebuildTermKey, rebuildTerms); err != nil {
+		return 0, err
+	}
+	indexed := 0
+	// every event id was handed out by eventSeq, the stored messages are among them.
+	for id := int64(1); id <= newest; id++ {
+		ev, _, err := s.load(strconv.FormatInt(id, 10))
+		if status.Code(err) == codes.NotFound {
+			continue
+		}
+		if err != nil {
+			return indexed, err
+		}
+		if !searchable(ev) {
+			continue
+		}
+		if err := s.indexInto(ev, rebuildTermKey, rebuildTerms); err != nil {
+			return indexed, err
+		}
+		indexed++
+		if indexed%10000 == 0 {
+			log.Printf("reindexed %d messages", indexed)
+		}
+	}
+	return indexed, nil
+}
+
+// swapIndex replaces the entries of the live index up to the id newest with the rebuilt ones, one word at a time.
+// The entries of newer messages, indexed while the index was rebuilt, stay.
+func (s *Server) swapIndex(newest int64) error {
+	built, err := s.redis.rangeByLex(rebuildTerms, "-", "+", 0)
+	if err != nil {
+		return err
+	}
+	live, err := s.redis.rangeByLex(searchTerms, "-", "+", 0)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, term := range append(built, live...) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		keys := []string{searchTermKey(term), rebuildTermKey(term), searchTerms}
+		if _, err := s.redis.run(swapTermScript, keys, term, newest); err != nil {
+			return err
+		}
+	}
+	return s.redis.del(rebuildTerms)
+}
+
+// dropIndex deletes the index made of the keys termKey names and the terms set.
+func (s *Server) dropIndex(termKey func(string) string, terms string) error {
+	words, err := s.redis.rangeByLex(terms, "-", "+", 0)
+	if err != nil {
+		return err
+	}
+	return s.redis.pipelined(func(pipe re.Pipeliner) error {
+		for _, word := range words {
+			pipe.Del(termKey(word))
+		}
+		pipe.Del(terms)
+		return nil
+	})
+}
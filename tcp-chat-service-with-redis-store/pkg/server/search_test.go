@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     []clause
+	}{
+		{"word", "hello", []clause{{terms: []string{"hello"}}}},
+		{"words are lowercased", "Hello World", []clause{{terms: []string{"hello"}}, {terms: []string{"world"}}}},
+		{"phrase", `"hello world"`, []clause{{terms: []string{"hello", "world"}}}},
+		{"prefix", "hel*", []clause{{terms: []string{"hel"}, prefix: true}}},
+		{"phrase ending in a prefix", `"big dat*"`, []clause{{terms: []string{"big", "dat"}, prefix: true}}},
+		{"words and phrases", `foo "bar baz" qux`, []clause{{terms: []string{"foo"}}, {terms: []string{"bar", "baz"}}, {terms: []string{"qux"}}}},
+		{"unterminated phrase", `"unterminated phrase`, []clause{{terms: []string{"unterminated", "phrase"}}}},
+		{"punctuation splits words", "don't", []clause{{terms: []string{"don", "t"}}}},
+		{"inner star", "a*b", []clause{{terms: []string{"a", "b"}}}},
+		{"empty", "", nil},
+		{"empty phrase", `""`, nil},
+		{"lone star", "*", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseQuery(tt.in)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected parseQuery(%q) = %+v, got %+v", tt.in, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("lorem ipsum ", 20) + "needle " + strings.Repeat("dolor sit ", 20)
+	at := strings.Index(long, "needle")
+	tail := strings.Repeat("x ", 100) + "needle"
+	tests := []struct {
+		name, text string
+		spans      [][2]int
+		want       string
+	}{
+		{"short", "hello big world", [][2]int{{0, 5}, {10, 15}}, "**hello** big **world**"},
+		{"middle", long, [][2]int{{at, at + 6}}, "…ipsum lorem ipsum lorem ipsum lorem ipsum **needle** dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor sit dolor…"},
+		{"start", "needle " + strings.Repeat("x ", 100), [][2]int{{0, 6}}, "**needle** " + strings.Repeat("x ", 76) + "x…"},
+		{"end", tail, [][2]int{{len(tail) - 6, len(tail)}}, "…" + strings.Repeat("x ", 20) + "**needle**"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snippet(tt.text, tt.spans); got != tt.want {
+				t.Fatalf("expected snippet %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReindexKeepsNewMessages(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	old := post(t, s, ctx, "an old message")
+	// a word the message no longer has.
+	if err := s.index(&pb.Event{Id: old, Body: "stale"}); err != nil {
+		t.Fatal(err)
+	}
+
+	newest, err := s.redis.incr(eventSeq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.rebuildIndex(newest); err != nil {
+		t.Fatalf("could not rebuild the index: %s", err)
+	}
+	// posted while the index was rebuilt.
+	fresh := post(t, s, ctx, "a fresh message")
+	if err := s.swapIndex(newest); err != nil {
+		t.Fatalf("could not swap the index: %s", err)
+	}
+
+	search := func(query string) []string {
+		t.Helper()
+		res, err := s.SearchMessages(ctx, &pb.SearchRequest{Query: query})
+		if err != nil {
+			t.Fatalf("could not search for %q: %s", query, err)
+		}
+		var ids []string
+		for _, r := range res.GetResults() {
+			ids = append(ids, r.GetMessage().GetId())
+		}
+		return ids
+	}
+	if got := search("stale"); len(got) != 0 {
+		t.Fatalf("expected the stale word to be dropped, got %v", got)
+	}
+	if got := search("message"); !reflect.DeepEqual(got, []string{fresh, old}) {
+		t.Fatalf("expected both messages, got %v", got)
+	}
+	if got := search("fresh"); !reflect.DeepEqual(got, []string{fresh}) {
+		t.Fatalf("expected the message posted during the rebuild, got %v", got)
+	}
+	if words, _ := s.redis.rangeByLex(rebuildTerms, "-", "+", 0); len(words) != 0 {
+		t.Fatalf("expected the rebuilt index to be gone, got %v", words)
+	}
+}
+
+func TestSearchTimeBoundsComeBeforeTheCap(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	old := post(t, s, ctx, "an old needle")
+	// more newer matches than a search looks at.
+	later := timestamppb.New(time.Now().Add(time.Hour))
+	for i := 0; i <= maxSearchCandidates; i++ {
+		ev := &pb.Event{Id: strconv.Itoa(1000000 + i), Kind: pb.Event_TEXT, Room: "general", Body: "needle", Timestamp: later}
+		if err := s.index(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := s.SearchMessages(ctx, &pb.SearchRequest{Query: "needle", Before: timestamppb.New(time.Now().Add(time.Minute))})
+	if err != nil {
+		t.Fatalf("could not search: %s", err)
+	}
+	if len(found.GetResults()) != 1 || found.GetResults()[0].GetMessage().GetId() != old {
+		t.Fatalf("expected the old message, got %v", found.GetResults())
+	}
+}
@@ -2,17 +2,27 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
 	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
@@ -22,22 +32,107 @@ type Server struct {
 	grpcPort   string
 	listener   net.Listener
 	grpcServer *grpc.Server
-	// ctx        context.Context
-	// cancel     context.CancelFunc
-	// wg         sync.WaitGroup
+	directory  Directory
+	tlsConfig  *tls.Config
+	// moderators may edit and delete messages in every room.
+	moderators map[string]bool
+	// blobs keeps the content of attachments. Attachments are disabled without it.
+	blobs BlobStore
+	// retention limits enforced by the janitor, globally and per room.
+	retention     Retention
+	roomRetention map[string]Retention
+	// interceptor chain
+	rateLimits        RateLimits
+	globalLimiter     *rate.Limiter
+	userLimiter       *limiter
+	extraUnary        []grpc.UnaryServerInterceptor
+	extraStream       []grpc.StreamServerInterceptor
+	unaryInterceptor  grpc.UnaryServerInterceptor
+	streamInterceptor grpc.StreamServerInterceptor
+	// optional http/json gateway
+	httpAddr     string
+	httpListener net.Listener
+	httpServer   *http.Server
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
 }
 
-func NewServer(redisAddr, grpcPort string) *Server {
-	// ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		redisAddr: redisAddr,
-		grpcPort:  grpcPort,
-		// ctx:       ctx,
-		// cancel:    cancel,
+// reapInterval is how often the server looks for users whose presence lease has lapsed.
+const reapInterval = common.HEARTBEAT_INTERVAL
+
+// Option configures optional behaviour of the Server.
+type Option func(*Server)
+
+// WithDirectory makes Connect check the user's password against the directory. Without one any username is accepted.
+func WithDirectory(d Directory) Option {
+	return func(s *Server) {
+		s.directory = d
+	}
+}
+
+// WithTLS serves gRPC over TLS. If the config verifies client certificates, a verified certificate's common name
+// is accepted as the username at Connect.
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithModerators makes the users moderators of every room. Only use it with a user directory or client
+// certificates, otherwise anyone can connect under a moderator's name.
+func WithModerators(users ...string) Option {
+	return func(s *Server) {
+		for _, user := range users {
+			s.moderators[user] = true
+		}
+	}
+}
+
+// WithListener serves gRPC on lis instead of listening on the grpc port, like an in-memory listener in tests.
+func WithListener(lis net.Listener) Option {
+	return func(s *Server) {
+		s.listener = lis
+	}
+}
+
+// WithHTTP additionally serves the HTTP/JSON gateway on addr (host:port).
+func WithHTTP(addr string) Option {
+	return func(s *Server) {
+		s.httpAddr = addr
 	}
 }
 
+func NewServer(redisAddr, grpcPort string, opts ...Option) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		redisAddr:     redisAddr,
+		grpcPort:      grpcPort,
+		ctx:           ctx,
+		cancel:        cancel,
+		rateLimits:    DefaultRateLimits,
+		moderators:    make(map[string]bool),
+		roomRetention: make(map[string]Retention),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.initInterceptors()
+	return s
+}
+
+// Run serves until the process is interrupted.
 func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	// hold the main server routine until an interrupt occurs.
+	s.awaitShutdown()
+	return nil
+}
+
+// Start connects to redis and serves in the background until Stop.
+func (s *Server) Start() error {
 	var err error
 	s.redis, err = initRedis(s.redisAddr)
 	if err != nil {
@@ -52,22 +147,39 @@ func (s *Server) Run() error {
 	}
 	log.Println("initialized gRPC server")
 
+	if s.httpAddr != "" {
+		if err = s.startHTTPServer(); err != nil {
+			return fmt.Errorf("failed to start http server %s", err)
+		}
+		log.Println("initialized http gateway")
+	}
+
+	s.wg.Add(2)
+	go s.reapExpiredUsers()
+	go s.janitor()
+
 	// This is called on OS interrupts close anyway
 	// defer s.closeGrpcConnection()
-
-	// hold the main server routine until an interrupt occurs.
-	s.awaitShutdown()
 	return nil
 }
 
 func (s *Server) startGrpcServer() error {
 	// start grpc server
-	var err error
-	s.listener, err = net.Listen("tcp", fmt.Sprintf(":%s", s.grpcPort))
-	if err != nil {
-		return fmt.Errorf("listener failed to initialize: %s", err)
+	if s.listener == nil {
+		var err error
+		s.listener, err = net.Listen("tcp", fmt.Sprintf(":%s", s.grpcPort))
+		if err != nil {
+			return fmt.Errorf("listener failed to initialize: %s", err)
+		}
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
 	}
-	s.grpcServer = grpc.NewServer()
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	s.grpcServer = grpc.NewServer(opts...)
 	// todo: Ideally create a server of chatserviceserver
 	pb.RegisterChatServiceServer(s.grpcServer, s)
 	// run a goroutine to serve on the grpc server. You can just do a grpcServer.Serve(), but a goroutine helps in initializing other things apart from a grpc server as well and doesnt hold the main routine.
@@ -96,65 +208,202 @@ func (s *Server) awaitShutdown() {
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	// wait until you get an interrupt signal
 	<-stop
-	s.stop()
+	s.Stop()
 }
 
-func (s *Server) stop() {
+// Stop stops serving, waits for the background work to end and closes the redis client.
+func (s *Server) Stop() {
 	// call cancel for the context
 	log.Println("Stopping server..")
-	// s.cancel()
+	s.cancel()
+	s.wg.Wait()
+	s.closeHTTPServer()
 	s.closeGrpcConnection()
 	s.redis.client.Close()
 }
 
-func (s *Server) Connect(ctx context.Context, req *pb.ConnectRequest) (*google_protobuf.Empty, error) {
-	key := "active." + req.GetUser()
-	if s.redis.exists(key) {
-		return nil, errors.New("user already exists and is connected. choose another username")
+func (s *Server) Connect(ctx context.Context, req *pb.ConnectRequest) (*pb.ConnectResponse, error) {
+	user := req.GetUser()
+	identity, verified := peerIdentity(ctx)
+	if verified {
+		if user != "" && user != identity {
+			return nil, status.Errorf(codes.PermissionDenied, "client certificate is issued to %s, not %s", identity, user)
+		}
+		user = identity
+	}
+	if user == "" {
+		return nil, status.Error(codes.InvalidArgument, "username is required")
 	}
-	if !s.redis.set(key, req.GetUser()) {
-		return nil, errors.New("user already exists and is connected. choose another username")
+	if err := checkName("a username", user); err != nil {
+		return nil, err
+	}
+	// a verified client certificate already proves who the user is.
+	if s.directory != nil && !verified {
+		if err := s.directory.Authenticate(user, req.GetPassword()); err != nil {
+			log.Printf("authentication failed for %s: %s", user, err)
+			return nil, status.Error(codes.Unauthenticated, "invalid username or password")
+		}
 	}
-	if err := s.redis.publish(req.GetUser() + " connected."); err != nil {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := s.claim(user, sessionID(token), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, status.Error(codes.AlreadyExists, "user already exists and is connected. choose another username")
+	}
+	callInfoFromContext(ctx).user = user
+	if err := s.broadcast(pb.Event_JOIN, "", user, ""); err != nil {
 		return nil, errors.New("could not publish the user connected message")
 	}
-	log.Println(req.GetUser() + " connected.")
-	return &google_protobuf.Empty{}, nil
+	log.Println(user + " connected.")
+	return &pb.ConnectResponse{Token: token, User: user}, nil
 
 }
 
-func (s *Server) Chat(ctx context.Context, msg *pb.Message) (*google_protobuf.Empty, error) {
-	key := "active." + msg.GetUser()
-	if !s.redis.exists(key) {
-		return nil, errors.New("user already exists and is connected. choose another username")
+func (s *Server) Chat(ctx context.Context, msg *pb.Message) (*pb.ChatResponse, error) {
+	user, _ := UserFromContext(ctx)
+	room := msg.GetRoom()
+	if room == "" {
+		room = common.DEFAULT_ROOM
+	}
+	if err := checkName("a room name", room); err != nil {
+		return nil, err
 	}
-	pubMsg := fmt.Sprintf("> %s : %s", msg.GetUser(), msg.GetMsg())
-	if err := s.redis.publish(pubMsg); err != nil {
+	text := markup.Sanitize(msg.GetMsg())
+	// posting to a room joins it.
+	if err := s.joinRoom(user, room); err != nil {
 		return nil, err
 	}
+	if err := s.touch(user, time.Now()); err != nil {
+		return nil, err
+	}
+	attachments, err := s.attachments(msg.GetAttachments())
+	if err != nil {
+		return nil, err
+	}
+	ev, err := s.newEvent(pb.Event_TEXT, room, user, text)
+	if err != nil {
+		return nil, err
+	}
+	ev.Attachments = attachments
+	if ev.Mentions, err = s.mentions(user, text); err != nil {
+		return nil, err
+	}
+	if err := s.store(ev); err != nil {
+		return nil, err
+	}
+	if err := s.index(ev); err != nil {
+		return nil, err
+	}
+	if err := s.fileMentions(ev); err != nil {
+		return nil, err
+	}
+	if err := s.deliver(ev, ev); err != nil {
+		return nil, err
+	}
+	return &pb.ChatResponse{Id: ev.GetId()}, nil
+}
+
+func (s *Server) Disconnect(ctx context.Context, in *google_protobuf.Empty) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	released, err := s.release(user, sessionFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	// only the call that actually released the name announces it, even if the client disconnects twice.
+	if released {
+		if err := s.broadcast(pb.Event_LEAVE, "", user, ""); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("%s disconnected !", user)
 	return &google_protobuf.Empty{}, nil
 }
 
-func (s *Server) ListUsers(ctx context.Context, in *google_protobuf.Empty) (*pb.UserListResponse, error) {
-	res, err := s.redis.search("active.*")
+func (s *Server) Rename(ctx context.Context, req *pb.RenameRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	name := req.GetUser()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "username is required")
+	}
+	if err := checkName("a username", name); err != nil {
+		return nil, err
+	}
+	// the name is vouched for by the directory or the client certificate, it can't be swapped for another one.
+	if _, verified := peerIdentity(ctx); verified || s.directory != nil {
+		return nil, status.Error(codes.PermissionDenied, "usernames are managed by the server and can't be changed")
+	}
+	now := time.Now()
+	keys := []string{activeKey(user), activeKey(name), sessionKey(sessionFromContext(ctx)), leases, online, presenceKey(user), presenceKey(name), knownUsers, roomMembersKey(common.DEFAULT_ROOM), sessions}
+	n, err := s.redis.run(renameScript, keys, sessionFromContext(ctx), user, name, common.LEASE_TTL.Milliseconds(), now.Add(common.LEASE_TTL).Unix())
 	if err != nil {
 		return nil, err
 	}
-	return &pb.UserListResponse{
-		User: res,
-	}, nil
+	switch n {
+	case 0:
+		return nil, status.Error(codes.AlreadyExists, "user already exists and is connected. choose another username")
+	case -1:
+		return nil, status.Error(codes.NotFound, "presence lease expired. connect again")
+	}
+	if err := s.broadcast(pb.Event_SYSTEM, "", name, fmt.Sprintf("%s is now known as %s", user, name)); err != nil {
+		return nil, err
+	}
+	log.Printf("%s renamed to %s", user, name)
+	return &google_protobuf.Empty{}, nil
 }
 
-func (s *Server) Disconnect(ctx context.Context, req *pb.DisconnectRequest) (*google_protobuf.Empty, error) {
-	key := "active." + req.GetUser()
-	if s.redis.exists(key) {
-		if err := s.redis.publish(fmt.Sprintf("> %s, left the chat", req.GetUser())); err != nil {
-			return nil, err
-		}
-		if err := s.redis.delete(key); err != nil {
-			return nil, err
-		}
+func (s *Server) Heartbeat(ctx context.Context, in *google_protobuf.Empty) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	renewed, err := s.renew(user, sessionFromContext(ctx), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !renewed {
+		return nil, status.Error(codes.NotFound, "presence lease expired. connect again")
 	}
-	log.Printf("%s disconnected !", req.GetUser())
 	return &google_protobuf.Empty{}, nil
 }
+
+// reapExpiredUsers periodically expires users whose client stopped sending heartbeats (crashed or was killed
+// before it could disconnect) and announces that they left.
+func (s *Server) reapExpiredUsers() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			log.Println("context cancel, exiting reaper")
+			return
+		case now := <-ticker.C:
+			users, err := s.redis.expiredLeases(now)
+			if err != nil {
+				log.Printf("could not read expired leases: %s", err)
+				continue
+			}
+			for _, user := range users {
+				s.reap(user)
+			}
+		}
+	}
+}
+
+func (s *Server) reap(user string) {
+	expired, err := s.expire(user)
+	if err != nil {
+		log.Printf("could not expire %s: %s", user, err)
+		return
+	}
+	// another server instance got to it first, or a heartbeat renewed the lease in the meantime.
+	if !expired {
+		return
+	}
+	if err := s.broadcast(pb.Event_LEAVE, "", user, "timed out"); err != nil {
+		log.Printf("could not publish the user left message: %s", err)
+	}
+	log.Printf("%s timed out !", user)
+}
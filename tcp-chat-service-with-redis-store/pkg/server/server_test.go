@@ -0,0 +1,773 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	re "github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServers returns n servers sharing one in-memory redis, like replicas behind a load balancer.
+func newTestServers(t *testing.T, n int, opts ...Option) []*Server {
+	t.Helper()
+	return newTestServersOn(t, miniredis.RunT(t), n, opts...)
+}
+
+// newTestServersOn is newTestServers on a given in-memory redis, for tests that move its clock.
+func newTestServersOn(t *testing.T, mr *miniredis.Miniredis, n int, opts ...Option) []*Server {
+	t.Helper()
+	servers := make([]*Server, n)
+	for i := range servers {
+		s := NewServer(mr.Addr(), "0", opts...)
+		var err error
+		if s.redis, err = initRedis(mr.Addr()); err != nil {
+			t.Fatalf("could not connect to redis: %s", err)
+		}
+		t.Cleanup(func() { s.redis.client.Close() })
+		servers[i] = s
+	}
+	return servers
+}
+
+// sessionContext is the context the auth interceptor hands to the handlers for the session.
+func sessionContext(user, token string) context.Context {
+	ctx := context.WithValue(context.Background(), sessionCtxKey{}, sessionID(token))
+	return context.WithValue(ctx, userCtxKey{}, user)
+}
+
+func TestConcurrentConnectHasOneWinner(t *testing.T) {
+	servers := newTestServers(t, 4)
+	const attempts = 64
+
+	var wg sync.WaitGroup
+	var winners int32
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			_, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+			if err == nil {
+				atomic.AddInt32(&winners, 1)
+				return
+			}
+			if status.Code(err) != codes.AlreadyExists {
+				errs <- err
+			}
+		}(servers[i%len(servers)])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if winners != 1 {
+		t.Fatalf("expected exactly one successful connect, got %d", winners)
+	}
+	res, err := servers[0].ListUsers(context.Background(), &pb.ListUsersRequest{})
+	if err != nil {
+		t.Fatalf("could not list users: %s", err)
+	}
+	if len(res.GetUsers()) != 1 || res.GetUsers()[0].GetName() != "alice" {
+		t.Fatalf("expected only alice to be online, got %v", res.GetUsers())
+	}
+}
+
+func TestConcurrentRenameHasOneWinner(t *testing.T) {
+	servers := newTestServers(t, 4)
+	const sessions = 16
+
+	ctxs := make([]context.Context, sessions)
+	for i := range ctxs {
+		user := fmt.Sprintf("user%d", i)
+		res, err := servers[0].Connect(context.Background(), &pb.ConnectRequest{User: user})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", user, err)
+		}
+		ctxs[i] = sessionContext(user, res.GetToken())
+	}
+
+	var wg sync.WaitGroup
+	var winners int32
+	for i, ctx := range ctxs {
+		wg.Add(1)
+		go func(s *Server, ctx context.Context) {
+			defer wg.Done()
+			_, err := s.Rename(ctx, &pb.RenameRequest{User: "bob"})
+			if err == nil {
+				atomic.AddInt32(&winners, 1)
+			} else if status.Code(err) != codes.AlreadyExists {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(servers[i%len(servers)], ctx)
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Fatalf("expected exactly one successful rename, got %d", winners)
+	}
+	res, err := servers[0].ListUsers(context.Background(), &pb.ListUsersRequest{PageSize: sessions + 1})
+	if err != nil {
+		t.Fatalf("could not list users: %s", err)
+	}
+	if len(res.GetUsers()) != sessions {
+		t.Fatalf("expected %d users online, got %d", sessions, len(res.GetUsers()))
+	}
+}
+
+func TestDisconnectReleasesOnce(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+
+	released, err := s.release("alice", sessionID(res.GetToken()))
+	if err != nil || !released {
+		t.Fatalf("expected the first release to succeed, got %v %v", released, err)
+	}
+	released, err = s.release("alice", sessionID(res.GetToken()))
+	if err != nil || released {
+		t.Fatalf("expected the second release to be a no-op, got %v %v", released, err)
+	}
+	if _, err := s.Disconnect(ctx, nil); err != nil {
+		t.Fatalf("disconnecting a released session should not fail: %s", err)
+	}
+	if _, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"}); err != nil {
+		t.Fatalf("the name should be free again: %s", err)
+	}
+}
+
+func TestHeartbeatKeepsTheLease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestServersOn(t, mr, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+
+	// every heartbeat buys another lease.
+	for i := 0; i < 3; i++ {
+		mr.FastForward(common.LEASE_TTL - time.Second)
+		if _, err := s.Heartbeat(ctx, nil); err != nil {
+			t.Fatalf("could not send a heartbeat: %s", err)
+		}
+	}
+	if expired, err := s.expire("alice"); err != nil || expired {
+		t.Fatalf("expected the lease to hold, got expired=%v %v", expired, err)
+	}
+	if users := onlineNames(t, s); !reflect.DeepEqual(users, []string{"alice"}) {
+		t.Fatalf("expected alice to be online, got %v", users)
+	}
+}
+
+func TestMissedLeaseIsReapedOnce(t *testing.T) {
+	mr := miniredis.RunT(t)
+	servers := newTestServersOn(t, mr, 2)
+	res, err := servers[0].Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	sub := servers[0].redis.subscribe(common.CHANNEL)
+	defer sub.Close()
+	if _, err := sub.Receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.FastForward(common.LEASE_TTL + time.Second)
+	users, err := servers[0].redis.expiredLeases(time.Now().Add(common.LEASE_TTL + time.Second))
+	if err != nil || !reflect.DeepEqual(users, []string{"alice"}) {
+		t.Fatalf("expected the lease of alice to have lapsed, got %v %v", users, err)
+	}
+	// both servers reap, one of them announces it.
+	for _, s := range servers {
+		s.reap("alice")
+	}
+	if err := servers[0].broadcast(pb.Event_SYSTEM, "", "", "done"); err != nil {
+		t.Fatal(err)
+	}
+	leaves := 0
+	for ev := range sub.Channel() {
+		var e pb.Event
+		if err := proto.Unmarshal([]byte(ev.Payload), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.GetKind() == pb.Event_SYSTEM {
+			break
+		}
+		if e.GetKind() == pb.Event_LEAVE && e.GetSender() == "alice" {
+			leaves++
+		}
+	}
+	if leaves != 1 {
+		t.Fatalf("expected one LEAVE event, got %d", leaves)
+	}
+	if users := onlineNames(t, servers[0]); len(users) != 0 {
+		t.Fatalf("expected nobody online, got %v", users)
+	}
+
+	// a late heartbeat doesn't bring the user back.
+	if _, err := servers[1].Heartbeat(ctx, nil); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a heartbeat after the reap, got %v", err)
+	}
+	if users, _ := servers[0].redis.expiredLeases(time.Now().Add(time.Hour)); len(users) != 0 {
+		t.Fatalf("expected no lease after the reap, got %v", users)
+	}
+}
+
+// onlineNames lists the names of the online users.
+func onlineNames(t *testing.T, s *Server) []string {
+	t.Helper()
+	res, err := s.ListUsers(context.Background(), &pb.ListUsersRequest{})
+	if err != nil {
+		t.Fatalf("could not list users: %s", err)
+	}
+	var names []string
+	for _, u := range res.GetUsers() {
+		names = append(names, u.GetName())
+	}
+	return names
+}
+
+// connectAll opens a session for each user and returns their contexts.
+func connectAll(t *testing.T, s *Server, users ...string) map[string]context.Context {
+	t.Helper()
+	ctxs := make(map[string]context.Context)
+	for _, name := range users {
+		res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: name})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", name, err)
+		}
+		ctxs[name] = sessionContext(name, res.GetToken())
+	}
+	return ctxs
+}
+
+// listener collects the events published on some channels of the bus.
+type listener struct {
+	t        *testing.T
+	s        *Server
+	sub      *re.PubSub
+	channels []string
+}
+
+func listen(t *testing.T, s *Server, channels ...string) *listener {
+	t.Helper()
+	sub := s.redis.subscribe(channels...)
+	t.Cleanup(func() { sub.Close() })
+	for range channels {
+		if _, err := sub.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &listener{t: t, s: s, sub: sub, channels: channels}
+}
+
+// delivery is an event published on a channel.
+type delivery struct {
+	channel string
+	ev      *pb.Event
+}
+
+// deliveries returns what was published since the last call, read up to a marker it publishes.
+func (l *listener) deliveries() []delivery {
+	l.t.Helper()
+	marker := &pb.Event{Kind: pb.Event_SYSTEM, Id: "marker"}
+	if err := l.s.publishEvent(l.channels[0], marker); err != nil {
+		l.t.Fatal(err)
+	}
+	var got []delivery
+	for msg := range l.sub.Channel() {
+		ev := &pb.Event{}
+		if err := proto.Unmarshal([]byte(msg.Payload), ev); err != nil {
+			l.t.Fatal(err)
+		}
+		if ev.GetKind() == pb.Event_SYSTEM && ev.GetId() == "marker" {
+			return got
+		}
+		got = append(got, delivery{msg.Channel, ev})
+	}
+	l.t.Fatal("the subscription closed")
+	return nil
+}
+
+// kinds lists the kinds of events published since the last call.
+func (l *listener) kinds() []pb.Event_Kind {
+	l.t.Helper()
+	var kinds []pb.Event_Kind
+	for _, d := range l.deliveries() {
+		kinds = append(kinds, d.ev.GetKind())
+	}
+	return kinds
+}
+
+func TestSessionTokenIsNotStored(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	keys, err := s.redis.client.Keys("*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, res.GetToken()) {
+			t.Fatalf("expected no key to hold the token, got %s", key)
+		}
+		if value, err := s.redis.client.Get(key).Result(); err == nil && strings.Contains(value, res.GetToken()) {
+			t.Fatalf("expected no value to hold the token, got %s in %s", value, key)
+		}
+	}
+
+	// the token still opens the session.
+	md := metadata.Pairs(common.AUTH_METADATA, common.AUTH_SCHEME+res.GetToken())
+	ctx, err := s.authenticate(metadata.NewIncomingContext(context.Background(), md))
+	if err != nil {
+		t.Fatalf("could not authenticate with the token: %s", err)
+	}
+	if user, _ := UserFromContext(ctx); user != "alice" {
+		t.Fatalf("expected the session of alice, got %q", user)
+	}
+}
+
+// post sends text to the general room as the session in ctx and returns the message id.
+func post(t *testing.T, s *Server, ctx context.Context, text string, attachments ...string) string {
+	t.Helper()
+	res, err := s.Chat(ctx, &pb.Message{Msg: text, Attachments: attachments})
+	if err != nil {
+		t.Fatalf("could not post %q: %s", text, err)
+	}
+	return res.GetId()
+}
+
+func TestPurgeKeepsSharedAttachments(t *testing.T) {
+	blobs, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServers(t, 1, WithBlobStore(blobs), WithRetention(Retention{MaxCount: 1}))[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	id := upload(t, s, blobs, time.Now())
+
+	post(t, s, ctx, "first", id)
+	post(t, s, ctx, "second", id)
+	if _, err := s.clean(time.Now(), false); err != nil {
+		t.Fatalf("could not purge: %s", err)
+	}
+	// the second message still shares it.
+	if _, err := s.attachment(id); err != nil {
+		t.Fatalf("expected the attachment to outlive the first message: %s", err)
+	}
+	if r, err := blobs.Open(id); err != nil {
+		t.Fatalf("expected the content to outlive the first message: %s", err)
+	} else {
+		r.Close()
+	}
+
+	post(t, s, ctx, "third")
+	if _, err := s.clean(time.Now(), false); err != nil {
+		t.Fatalf("could not purge: %s", err)
+	}
+	if _, err := s.attachment(id); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected the attachment to go with the last message, got %v", err)
+	}
+	if _, err := blobs.Open(id); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the content to go with the last message, got %v", err)
+	}
+}
+
+// upload stores an attachment uploaded at now and returns its id.
+func upload(t *testing.T, s *Server, blobs BlobStore, now time.Time) string {
+	t.Helper()
+	id, _ := newAttachmentID()
+	w, err := blobs.Create(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	w.Close()
+	a := &pb.Attachment{Id: id, Filename: "a.txt", Size: 5, MimeType: "text/plain", Uploader: "alice"}
+	if err := s.saveAttachment(a, now); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestSweepUnsharedAttachments(t *testing.T) {
+	blobs, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServers(t, 1, WithBlobStore(blobs))[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	now := time.Now()
+	shared, unshared := upload(t, s, blobs, now), upload(t, s, blobs, now)
+	post(t, s, sessionContext("alice", res.GetToken()), "look", shared)
+
+	clean := func(at time.Time, dryRun bool) int64 {
+		t.Helper()
+		report, err := s.clean(at, dryRun)
+		if err != nil {
+			t.Fatalf("could not clean: %s", err)
+		}
+		return report.GetAttachments()
+	}
+	if n := clean(now, false); n != 0 {
+		t.Fatalf("expected fresh uploads to be kept, %d were swept", n)
+	}
+	later := now.Add(unsharedAttachmentTTL + time.Minute)
+	if n := clean(later, true); n != 1 {
+		t.Fatalf("expected a dry run to report one unshared upload, got %d", n)
+	}
+	if _, err := s.attachment(unshared); err != nil {
+		t.Fatalf("expected a dry run to keep the upload: %s", err)
+	}
+	if n := clean(later, false); n != 1 {
+		t.Fatalf("expected one unshared upload to be swept, got %d", n)
+	}
+	if _, err := s.attachment(unshared); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected the unshared upload to be gone, got %v", err)
+	}
+	if _, err := blobs.Open(unshared); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the content of the unshared upload to be gone, got %v", err)
+	}
+	if _, err := s.attachment(shared); err != nil {
+		t.Fatalf("expected the shared attachment to stay: %s", err)
+	}
+}
+
+func TestPurgeDropsRevisedWords(t *testing.T) {
+	s := newTestServers(t, 1, WithRetention(Retention{MaxCount: 1}))[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	id := post(t, s, ctx, "original words")
+	if _, err := s.EditMessage(ctx, &pb.EditMessageRequest{Id: id, Body: "revised words"}); err != nil {
+		t.Fatalf("could not edit: %s", err)
+	}
+	post(t, s, ctx, "newer")
+	if _, err := s.clean(time.Now(), false); err != nil {
+		t.Fatalf("could not purge: %s", err)
+	}
+	for _, term := range []string{"original", "revised", "words"} {
+		if n, err := s.redis.count(searchTermKey(term)); err != nil || n != 0 {
+			t.Fatalf("expected %q to be dropped from the index, got %d entries %v", term, n, err)
+		}
+	}
+}
+
+func TestPurgeByteLimit(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	key := roomHistoryKey("general")
+	post(t, s, ctx, "one")
+	post(t, s, ctx, "two")
+
+	// the first janitor counts the history, the counter follows it from then on.
+	size, err := s.historySize(key)
+	if err != nil {
+		t.Fatalf("could not size the history: %s", err)
+	}
+	last := post(t, s, ctx, "three")
+	if _, err := s.EditMessage(ctx, &pb.EditMessageRequest{Id: last, Body: "three, edited at length"}); err != nil {
+		t.Fatalf("could not edit: %s", err)
+	}
+	ev, raw, err := s.load(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastSize := messageSize(ev, raw)
+	if got, _ := s.historySize(key); got <= size {
+		t.Fatalf("expected the history to grow from %d bytes, got %d", size, got)
+	}
+
+	s.retention = Retention{MaxBytes: lastSize}
+	report, err := s.clean(time.Now(), false)
+	if err != nil {
+		t.Fatalf("could not purge: %s", err)
+	}
+	if len(report.GetHistories()) != 1 || report.GetHistories()[0].GetMessages() != 2 {
+		t.Fatalf("expected the two oldest messages to be purged, got %v", report.GetHistories())
+	}
+	if got, _ := s.historySize(key); got != lastSize {
+		t.Fatalf("expected %d bytes left, got %d", lastSize, got)
+	}
+	events, err := s.history("alice", key, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].GetId() != last {
+		t.Fatalf("expected only the newest message to be kept, got %v", events)
+	}
+}
+
+func TestCleanMimeType(t *testing.T) {
+	tests := []struct {
+		claimed, want string
+	}{
+		{"text/plain", "text/plain"},
+		{"Text/HTML; Charset=UTF-8", "text/html; charset=UTF-8"},
+		{"", ""},
+		{"text", ""},
+		{"a/b/c", ""},
+		{"image/png\x1b[2J", ""},
+		{"text/plain; name=\"a\x1bb\"", "text/plain; name*=utf-8''a%1Bb"},
+	}
+	for _, tt := range tests {
+		if got := cleanMimeType(tt.claimed); got != tt.want {
+			t.Errorf("expected cleanMimeType(%q) = %q, got %q", tt.claimed, tt.want, got)
+		}
+	}
+}
+
+func TestCatchUpQueries(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	ctxs := make(map[string]context.Context)
+	for _, user := range []string{"alice", "bob", "carol"} {
+		res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: user})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", user, err)
+		}
+		ctxs[user] = sessionContext(user, res.GetToken())
+	}
+	direct := func(from, to, text string) {
+		t.Helper()
+		if _, err := s.SendDirect(ctxs[from], &pb.DirectMessage{To: to, Msg: text}); err != nil {
+			t.Fatalf("could not send a direct message: %s", err)
+		}
+	}
+	bodies := func(events []*pb.Event) []string {
+		var bodies []string
+		for _, ev := range events {
+			bodies = append(bodies, ev.GetBody())
+		}
+		return bodies
+	}
+
+	before := post(t, s, ctxs["alice"], "before")
+	direct("carol", "alice", "old dm")
+	if _, err := s.Chat(ctxs["bob"], &pb.Message{Room: "ops", Msg: "in ops"}); err != nil {
+		t.Fatal(err)
+	}
+	direct("bob", "alice", "new dm")
+	post(t, s, ctxs["bob"], "in general")
+	direct("bob", "carol", "not for alice")
+
+	rooms, err := s.GetHistory(ctxs["alice"], &pb.HistoryRequest{AllRooms: true, AfterId: before})
+	if err != nil {
+		t.Fatalf("could not fetch the history of every room: %s", err)
+	}
+	if got, want := bodies(rooms.GetEvents()), []string{"in ops", "in general"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v after %s, got %v", want, before, got)
+	}
+	newest, err := s.GetHistory(ctxs["alice"], &pb.HistoryRequest{AllRooms: true, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(newest.GetEvents()); !reflect.DeepEqual(got, []string{"in general"}) {
+		t.Fatalf("expected the newest message of every room, got %v", got)
+	}
+
+	dms, err := s.GetDirectHistory(ctxs["alice"], &pb.DirectHistoryRequest{AfterId: before})
+	if err != nil {
+		t.Fatalf("could not fetch the direct messages: %s", err)
+	}
+	if got, want := bodies(dms.GetEvents()), []string{"old dm", "new dm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v in every conversation of alice, got %v", want, got)
+	}
+	dms, err = s.GetDirectHistory(ctxs["alice"], &pb.DirectHistoryRequest{AfterId: dms.GetEvents()[0].GetId(), Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(dms.GetEvents()); !reflect.DeepEqual(got, []string{"new dm"}) {
+		t.Fatalf("expected to page forwards, got %v", got)
+	}
+}
+
+func TestListUsersInRoom(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if _, err := s.Connect(context.Background(), &pb.ConnectRequest{User: name}); err != nil {
+			t.Fatalf("could not connect %s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"bob", "dave", "mallory"} {
+		if _, err := s.redis.addMember(roomMembersKey("ops"), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the members are picked out across the pages of online users.
+	var got []string
+	req := &pb.ListUsersRequest{Room: "ops", PageSize: 1}
+	for page := 0; page < 5; page++ {
+		res, err := s.ListUsers(context.Background(), req)
+		if err != nil {
+			t.Fatalf("could not list users: %s", err)
+		}
+		for _, u := range res.GetUsers() {
+			got = append(got, u.GetName())
+		}
+		if req.PageToken = res.GetNextPageToken(); req.PageToken == "" {
+			break
+		}
+	}
+	if want := []string{"bob", "dave"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the online members %v, got %v", want, got)
+	}
+}
+
+func TestModerators(t *testing.T) {
+	s := newTestServers(t, 1, WithModerators("root"))[0]
+	ctxs := make(map[string]context.Context)
+	for _, name := range []string{"alice", "bob", "root"} {
+		res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: name})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", name, err)
+		}
+		ctxs[name] = sessionContext(name, res.GetToken())
+	}
+	edit := func(user, id string) error {
+		_, err := s.EditMessage(ctxs[user], &pb.EditMessageRequest{Id: id, Body: "edited by " + user})
+		return err
+	}
+
+	// nobody created general, the first to post in it doesn't moderate it.
+	post(t, s, ctxs["alice"], "first")
+	general := post(t, s, ctxs["bob"], "hello")
+	if err := edit("alice", general); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for alice in general, got %v", err)
+	}
+	if err := edit("root", general); err != nil {
+		t.Fatalf("expected the server moderator to edit in general, got %s", err)
+	}
+
+	// whoever creates a room moderates it.
+	if _, err := s.Chat(ctxs["alice"], &pb.Message{Room: "ops", Msg: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Chat(ctxs["bob"], &pb.Message{Room: "ops", Msg: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := edit("alice", res.GetId()); err != nil {
+		t.Fatalf("expected the creator of ops to edit in it, got %s", err)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	s := newTestServers(t, 1, WithModerators("root"))[0]
+	ctxs := make(map[string]context.Context)
+	for _, name := range []string{"alice", "bob", "root"} {
+		res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: name})
+		if err != nil {
+			t.Fatalf("could not connect %s: %s", name, err)
+		}
+		ctxs[name] = sessionContext(name, res.GetToken())
+	}
+	id := post(t, s, ctxs["alice"], "one")
+	for _, body := range []string{"two", "three"} {
+		if _, err := s.EditMessage(ctxs["alice"], &pb.EditMessageRequest{Id: id, Body: body}); err != nil {
+			t.Fatalf("could not edit: %s", err)
+		}
+	}
+	if _, err := s.DeleteMessage(ctxs["root"], &pb.DeleteMessageRequest{Id: id}); err != nil {
+		t.Fatalf("could not delete: %s", err)
+	}
+
+	// the author and the moderators read them, even once the message is deleted.
+	for _, user := range []string{"alice", "root"} {
+		res, err := s.GetRevisions(ctxs[user], &pb.RevisionsRequest{Id: id})
+		if err != nil {
+			t.Fatalf("%s could not read the revisions: %s", user, err)
+		}
+		var bodies []string
+		for _, rev := range res.GetRevisions() {
+			bodies = append(bodies, rev.GetBody())
+		}
+		if want := []string{"one", "two", "three"}; !reflect.DeepEqual(bodies, want) {
+			t.Fatalf("%s: expected the revisions %v, got %v", user, want, bodies)
+		}
+	}
+	if _, err := s.GetRevisions(ctxs["bob"], &pb.RevisionsRequest{Id: id}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for bob, got %v", err)
+	}
+
+	// direct messages are only for their author.
+	if _, err := s.SendDirect(ctxs["alice"], &pb.DirectMessage{To: "bob", Msg: "psst"}); err != nil {
+		t.Fatalf("could not send a direct message: %s", err)
+	}
+	dms, err := s.GetDirectHistory(ctxs["alice"], &pb.DirectHistoryRequest{Peer: "bob"})
+	if err != nil || len(dms.GetEvents()) != 1 {
+		t.Fatalf("expected one direct message, got %v %v", dms.GetEvents(), err)
+	}
+	dm := dms.GetEvents()[0].GetId()
+	if _, err := s.GetRevisions(ctxs["root"], &pb.RevisionsRequest{Id: dm}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a moderator on a direct message, got %v", err)
+	}
+	if _, err := s.GetRevisions(ctxs["alice"], &pb.RevisionsRequest{Id: dm}); err != nil {
+		t.Fatalf("expected the author to read the revisions of a direct message, got %s", err)
+	}
+}
+
+func TestSealedMessageCannotBeEdited(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	res, err := s.Connect(context.Background(), &pb.ConnectRequest{User: "alice"})
+	if err != nil {
+		t.Fatalf("could not connect: %s", err)
+	}
+	ctx := sessionContext("alice", res.GetToken())
+	id := post(t, s, ctx, "hello")
+	ev, _, err := s.load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.Body, ev.Sealed = "", &pb.Sealed{Ciphertext: []byte("sealed")}
+	b, _ := proto.Marshal(ev)
+	if err := s.redis.setValue(messageKey(id), string(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.EditMessage(ctx, &pb.EditMessageRequest{Id: id, Body: "in the clear"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition editing a sealed message, got %v", err)
+	}
+	if stored, _, _ := s.load(id); stored.GetBody() != "" || stored.GetSealed() == nil {
+		t.Fatalf("expected the sealed message to stay as it was, got %v", stored)
+	}
+	if _, err := s.DeleteMessage(ctx, &pb.DeleteMessageRequest{Id: id}); err != nil {
+		t.Fatalf("expected a sealed message to be deletable, got %s", err)
+	}
+}
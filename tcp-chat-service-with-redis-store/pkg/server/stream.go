@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	re "github.com/go-redis/redis"
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Clients get their events from the server, never from redis: only the server talks to redis, so nobody can read
+// another user's direct messages off the bus or publish events in someone else's name. A stream carries the shared
+// channel and the direct messages of the session's user. It follows the session: after a rename it carries the
+// direct messages of the new name, and it ends once the session does.
+
+// sessionCheckInterval is how often a stream makes sure its session is still open.
+const sessionCheckInterval = common.HEARTBEAT_INTERVAL
+
+func (s *Server) Subscribe(_ *google_protobuf.Empty, stream pb.ChatService_SubscribeServer) error {
+	ready := func() error {
+		return stream.SendHeader(metadata.MD{})
+	}
+	return s.streamEvents(stream.Context(), ready, stream.Send)
+}
+
+// streamEvents hands the events of the session in ctx to send until ctx is done, the server stops or the session
+// ends. ready is called once the subscription is in place.
+func (s *Server) streamEvents(ctx context.Context, ready func() error, send func(*pb.Event) error) error {
+	user, _ := UserFromContext(ctx)
+	session := sessionFromContext(ctx)
+	sub := s.redis.subscribe(common.CHANNEL, common.UserChannel(user))
+	defer sub.Close()
+	// both channels are subscribed by one command, the first confirmation covers them.
+	if _, err := sub.Receive(); err != nil {
+		return status.Errorf(codes.Unavailable, "could not subscribe: %s", err)
+	}
+	if err := ready(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	msgs := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.ctx.Done():
+			return status.Error(codes.Unavailable, "the server is stopping")
+		case <-ticker.C:
+			var err error
+			if user, err = s.follow(sub, session, user); err != nil {
+				return err
+			}
+		case msg, ok := <-msgs:
+			if !ok {
+				return status.Error(codes.Unavailable, "lost the connection to redis")
+			}
+			// left over from the name before a rename.
+			if msg.Channel != common.CHANNEL && msg.Channel != common.UserChannel(user) {
+				continue
+			}
+			ev := &pb.Event{}
+			if err := proto.Unmarshal([]byte(msg.Payload), ev); err != nil {
+				log.Printf("could not decode message from redis: %s", err)
+				continue
+			}
+			// renames are announced as system events, switch to the new name's direct messages right away.
+			if ev.GetKind() == pb.Event_SYSTEM {
+				var err error
+				if user, err = s.follow(sub, session, user); err != nil {
+					return err
+				}
+			}
+			if err := send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// follow moves a subscription to the direct messages of the session's current user. It returns the user, or an error
+// once the session is gone.
+func (s *Server) follow(sub *re.PubSub, session, user string) (string, error) {
+	current, err := s.redis.get(sessionKey(session))
+	if err == re.Nil {
+		return "", status.Error(codes.Unauthenticated, "the session ended. connect again")
+	}
+	if err != nil {
+		return "", status.Errorf(codes.Unavailable, "could not check the session: %s", err)
+	}
+	if current == user {
+		return user, nil
+	}
+	if err := sub.Subscribe(common.UserChannel(current)); err != nil {
+		return "", err
+	}
+	if err := sub.Unsubscribe(common.UserChannel(user)); err != nil {
+		return "", err
+	}
+	return current, nil
+}
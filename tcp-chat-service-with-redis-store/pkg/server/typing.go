@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	google_protobuf "github.com/golang/protobuf/ptypes/empty"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Typing indicators only live on the bus and in the sorted set typing, scored by when they run out. Its members are
+// "<room>\n<user>" for a room and "\n<peer>\n<user>" for a direct message: room names have no control characters and
+// are never empty, so the two can't be mistaken for each other. The janitor drops the ones that ran out. Nothing about
+// them is stored in any history.
+const typing = "typing"
+
+func typingMember(room, to, user string) string {
+	if to != "" {
+		return "\n" + to + "\n" + user
+	}
+	return room + "\n" + user
+}
+
+func (s *Server) SetTyping(ctx context.Context, req *pb.TypingRequest) (*google_protobuf.Empty, error) {
+	user, _ := UserFromContext(ctx)
+	if err := s.setTyping(user, req, time.Now()); err != nil {
+		return nil, err
+	}
+	return &google_protobuf.Empty{}, nil
+}
+
+// setTyping marks the user typing, or not, in a room or to a direct message peer, and tells the room or the peer. It
+// renews the indicator at most every half TYPING_TTL, and says the user stopped only if the indicator was still on.
+func (s *Server) setTyping(user string, req *pb.TypingRequest, now time.Time) error {
+	room, to := req.GetRoom(), req.GetTo()
+	channel := common.CHANNEL
+	if to != "" {
+		known, err := s.redis.isMember(knownUsers, to)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return status.Errorf(codes.NotFound, "user %s does not exist", to)
+		}
+		room, channel = "", common.UserChannel(to)
+	} else {
+		if room == "" {
+			room = common.DEFAULT_ROOM
+		}
+		if err := checkName("a room name", room); err != nil {
+			return err
+		}
+	}
+	member := typingMember(room, to, user)
+	expires := now
+	if req.GetTyping() {
+		expires = now.Add(common.TYPING_TTL)
+		renewAfter := float64(now.Add(common.TYPING_TTL/2).UnixNano()) / float64(time.Second)
+		marked, err := s.redis.run(typingScript, []string{typing}, member, expires.Unix(), renewAfter)
+		if err != nil {
+			return err
+		}
+		if marked == 0 {
+			return nil
+		}
+	} else {
+		// nobody was told the user is typing, or it ran out already.
+		wasTyping, err := s.redis.removeScored(typing, member)
+		if err != nil {
+			return err
+		}
+		if !wasTyping {
+			return nil
+		}
+	}
+	ev := &pb.Event{
+		Room:      room,
+		Sender:    user,
+		Recipient: to,
+		Timestamp: timestamppb.New(now),
+		Kind:      pb.Event_TYPING,
+		Expires:   timestamppb.New(expires),
+	}
+	return s.publishEvent(channel, ev)
+}
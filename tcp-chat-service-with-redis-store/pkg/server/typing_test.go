@@ -0,0 +1,138 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTypingThrottle(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	bus := listen(t, s, common.CHANNEL)
+	start := time.Now()
+	steps := []struct {
+		name     string
+		after    time.Duration
+		typing   bool
+		announce bool
+	}{
+		{"starts typing", 0, true, true},
+		{"renews right away", time.Second, true, false},
+		{"renews before half the ttl", common.TYPING_TTL/2 - time.Second, true, false},
+		{"renews after half the ttl", common.TYPING_TTL/2 + time.Second, true, true},
+		{"stops", common.TYPING_TTL/2 + 2*time.Second, false, true},
+		{"stops again", common.TYPING_TTL/2 + 3*time.Second, false, false},
+		{"starts again", common.TYPING_TTL/2 + 4*time.Second, true, true},
+	}
+	for _, step := range steps {
+		now := start.Add(step.after)
+		if err := s.setTyping("alice", &pb.TypingRequest{Typing: step.typing}, now); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		got := bus.deliveries()
+		if announced := len(got) == 1; announced != step.announce || len(got) > 1 {
+			t.Fatalf("%s: expected announced to be %t, got %d events", step.name, step.announce, len(got))
+		}
+		if !step.announce {
+			continue
+		}
+		want := now
+		if step.typing {
+			want = now.Add(common.TYPING_TTL)
+		}
+		if ev := got[0].ev; ev.GetKind() != pb.Event_TYPING || !ev.GetExpires().AsTime().Equal(want) {
+			t.Fatalf("%s: expected TYPING until %s, got %s until %s", step.name, want, ev.GetKind(), ev.GetExpires().AsTime())
+		}
+	}
+}
+
+func TestTypingExpires(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	connectAll(t, s, "bob")
+	bus := listen(t, s, common.CHANNEL)
+	now := time.Now()
+	for _, req := range []*pb.TypingRequest{{Typing: true}, {Room: "ops", Typing: true}, {To: "bob", Typing: true}} {
+		if err := s.setTyping("alice", req, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err := s.redis.expired(typing, now.Add(common.TYPING_TTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"\nbob\nalice", "general\nalice", "ops\nalice"}; !reflect.DeepEqual(members, want) {
+		t.Fatalf("expected the indicators %q, got %q", want, members)
+	}
+
+	// the janitor leaves the indicators running and drops the ones that ran out.
+	if report, err := s.clean(now, false); err != nil || report.GetTyping() != 0 {
+		t.Fatalf("expected no indicator to have run out, got %v %v", report.GetTyping(), err)
+	}
+	later := now.Add(common.TYPING_TTL + time.Second)
+	if report, err := s.clean(later, true); err != nil || report.GetTyping() != 3 {
+		t.Fatalf("expected a dry run to count 3 indicators, got %v %v", report.GetTyping(), err)
+	}
+	if report, err := s.clean(later, false); err != nil || report.GetTyping() != 3 {
+		t.Fatalf("expected 3 indicators purged, got %v %v", report.GetTyping(), err)
+	}
+	if n, err := s.redis.count(typing); err != nil || n != 0 {
+		t.Fatalf("expected no indicator left, got %d %v", n, err)
+	}
+
+	// stopping after it ran out tells nobody, they stopped showing it already.
+	bus.deliveries()
+	if err := s.setTyping("alice", &pb.TypingRequest{Typing: false}, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := bus.deliveries(); len(got) != 0 {
+		t.Fatalf("expected no event once the indicator ran out, got %d", len(got))
+	}
+}
+
+func TestTypingRouting(t *testing.T) {
+	s := newTestServers(t, 1)[0]
+	connectAll(t, s, "alice", "bob", "carol")
+	bus := listen(t, s, common.CHANNEL, common.UserChannel("alice"), common.UserChannel("bob"), common.UserChannel("carol"))
+	now := time.Now()
+	tests := []struct {
+		name      string
+		req       *pb.TypingRequest
+		channel   string
+		room      string
+		recipient string
+	}{
+		{"default room", &pb.TypingRequest{Typing: true}, common.CHANNEL, common.DEFAULT_ROOM, ""},
+		{"room", &pb.TypingRequest{Room: "ops", Typing: true}, common.CHANNEL, "ops", ""},
+		{"direct message", &pb.TypingRequest{To: "bob", Typing: true}, common.UserChannel("bob"), "", "bob"},
+		{"direct message over a room", &pb.TypingRequest{Room: "ops", To: "carol", Typing: true}, common.UserChannel("carol"), "", "carol"},
+		{"stopping a direct message", &pb.TypingRequest{To: "bob"}, common.UserChannel("bob"), "", "bob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.setTyping("alice", tt.req, now); err != nil {
+				t.Fatal(err)
+			}
+			got := bus.deliveries()
+			if len(got) != 1 {
+				t.Fatalf("expected one event, got %d", len(got))
+			}
+			ev := got[0].ev
+			if got[0].channel != tt.channel || ev.GetRoom() != tt.room || ev.GetRecipient() != tt.recipient || ev.GetSender() != "alice" {
+				t.Fatalf("expected alice typing in %q to %q on %s, got %s typing in %q to %q on %s",
+					tt.room, tt.recipient, tt.channel, ev.GetSender(), ev.GetRoom(), ev.GetRecipient(), got[0].channel)
+			}
+		})
+	}
+
+	if err := s.setTyping("alice", &pb.TypingRequest{To: "nobody", Typing: true}, now); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound typing to an unknown user, got %v", err)
+	}
+	if err := s.setTyping("alice", &pb.TypingRequest{Room: "o\x1bps", Typing: true}, now); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a room name with control characters, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+)
+
+// Input starting with "/" is a client command, anything else is chat text. "//" sends a message starting with "/".
+
+// command is a client command entered as "/<name> <args>".
+type command struct {
+	name string
+	// usage describes the arguments, help what the command does. Both are shown by /help.
+	usage string
+	help  string
+	run   func(c *chat, args string) error
+}
+
+// errUsage is returned by a command run with the wrong arguments, its usage is shown.
+var errUsage = errors.New("usage")
+
+// commands is in the order /help lists them. It is filled in init, /help refers to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"help", "", "list the commands", (*chat).cmdHelp},
+		{"users", "", "list the online users", (*chat).cmdUsers},
+		{"nick", "<name>", "change your username", (*chat).cmdNick},
+		{"dm", "<user> <message>", "send a direct message that only that user (and your own sessions) receive", (*chat).cmdDirect},
+		{"fingerprint", "[user]", "show the fingerprint of your encryption key, or of a user's, to compare them", (*chat).cmdFingerprint},
+		{"trust", "<user>", "accept the new encryption key of a user once the fingerprints match", (*chat).cmdTrust},
+		{"edit", "<id> <message>", "change one of your messages", (*chat).cmdEdit},
+		{"delete", "<id>", "delete one of your messages", (*chat).cmdDelete},
+		{"react", "<id> <emoji>", "react to a message", (*chat).cmdReact},
+		{"unreact", "<id> <emoji>", "take back a reaction", (*chat).cmdUnreact},
+		{"read", "", "mark the room read up to the newest message", (*chat).cmdRead},
+		{"search", "<query>", "search the history", (*chat).cmdSearch},
+		{"mentions", "", "list the latest messages mentioning you", (*chat).cmdMentions},
+		{"upload", "<path>", "share a file in the room", (*chat).cmdUpload},
+		{"download", "<id>", "save a shared file to the current directory", (*chat).cmdDownload},
+		{"clear", "", "clear the screen", (*chat).cmdClear},
+		{"quit", "", "disconnect and exit", (*chat).cmdQuit},
+	}
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// parseCommand splits "/<name> <args>" input into the command name and its arguments. It reports false for chat
+// text, which is returned with a "//" escape undone.
+func parseCommand(input string) (name, args string, ok bool) {
+	if strings.HasPrefix(input, "//") {
+		return "", input[1:], false
+	}
+	if !strings.HasPrefix(input, "/") {
+		return "", input, false
+	}
+	name, args, _ = strings.Cut(strings.TrimPrefix(input, "/"), " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// handleInput runs a command, or sends the input to the room.
+func (c *chat) handleInput(input string) {
+	name, args, ok := parseCommand(input)
+	if !ok {
+		if strings.TrimSpace(args) == "" {
+			return
+		}
+		c.send(args)
+		return
+	}
+	cmd, found := lookupCommand(name)
+	if !found {
+		c.show(fmt.Sprintf("unknown command /%s, /help lists the commands. Start a message with // to send it as is", name))
+		return
+	}
+	err := cmd.run(c, args)
+	if errors.Is(err, errUsage) {
+		c.show(fmt.Sprintf("usage: /%s %s", cmd.name, cmd.usage))
+		return
+	}
+	if err != nil {
+		c.show(err.Error())
+	}
+}
+
+// splitArg splits the first word off the arguments. Message ids may be given as shown, with a leading "#".
+func splitArg(args string) (string, string, bool) {
+	first, rest, _ := strings.Cut(args, " ")
+	first = strings.TrimPrefix(first, "#")
+	rest = strings.TrimSpace(rest)
+	return first, rest, first != "" && rest != ""
+}
+
+func (c *chat) cmdHelp(string) error {
+	for _, cmd := range commands {
+		usage := "/" + cmd.name
+		if cmd.usage != "" {
+			usage += " " + cmd.usage
+		}
+		c.show(fmt.Sprintf("  %-28s %s", usage, cmd.help))
+	}
+	c.show("  //<message>                  send a message starting with /")
+	return nil
+}
+
+func (c *chat) cmdUsers(string) error {
+	users, err := c.conn.Users(c.ctx)
+	if err != nil {
+		return err
+	}
+	c.show(fmt.Sprintf("%d online", len(users)))
+	for _, u := range users {
+		c.show(fmt.Sprintf("  %-20s connected %s, last seen %s", u.GetName(),
+			u.GetConnectedSince().AsTime().Local().Format("Jan 2 15:04"), u.GetLastSeen().AsTime().Local().Format("15:04:05")))
+	}
+	return nil
+}
+
+func (c *chat) cmdNick(args string) error {
+	if args == "" || strings.Contains(args, " ") {
+		return errUsage
+	}
+	if err := c.conn.Rename(c.ctx, args); err != nil {
+		return err
+	}
+	c.ui.setTitle(c.title())
+	return nil
+}
+
+func (c *chat) cmdDirect(args string) error {
+	to, text, ok := splitArg(args)
+	if !ok {
+		return errUsage
+	}
+	err := c.conn.SendDirect(c.ctx, to, text)
+	var changed *client.KeyChangedError
+	if errors.As(err, &changed) {
+		c.keyWarning(changed)
+		return nil
+	}
+	return err
+}
+
+func (c *chat) cmdEdit(args string) error {
+	id, text, ok := splitArg(args)
+	if !ok {
+		return errUsage
+	}
+	return c.conn.Edit(c.ctx, id, text)
+}
+
+func (c *chat) cmdDelete(args string) error {
+	id := strings.TrimPrefix(args, "#")
+	if id == "" {
+		return errUsage
+	}
+	return c.conn.Delete(c.ctx, id)
+}
+
+func (c *chat) cmdReact(args string) error {
+	id, emoji, ok := splitArg(args)
+	if !ok {
+		return errUsage
+	}
+	return c.conn.React(c.ctx, id, emoji)
+}
+
+func (c *chat) cmdUnreact(args string) error {
+	id, emoji, ok := splitArg(args)
+	if !ok {
+		return errUsage
+	}
+	return c.conn.Unreact(c.ctx, id, emoji)
+}
+
+func (c *chat) cmdRead(string) error {
+	if c.lastSeen == "" {
+		return nil
+	}
+	return c.conn.MarkRead(c.ctx, c.room, c.lastSeen)
+}
+
+// cmdSearch shows the messages matching the query, newest first.
+func (c *chat) cmdSearch(query string) error {
+	if query == "" {
+		return errUsage
+	}
+	results, err := c.conn.Search(c.ctx, query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		c.show("no messages found")
+		return nil
+	}
+	for _, r := range results {
+		c.show(renderResult(r))
+	}
+	return nil
+}
+
+func (c *chat) cmdUpload(path string) error {
+	if path == "" {
+		return errUsage
+	}
+	_, err := c.conn.Upload(c.ctx, c.room, path)
+	return err
+}
+
+func (c *chat) cmdDownload(args string) error {
+	id := strings.TrimPrefix(args, "#")
+	if id == "" {
+		return errUsage
+	}
+	name, err := c.conn.Download(c.ctx, id, ".")
+	if err != nil {
+		return err
+	}
+	c.show("saved " + name)
+	return nil
+}
+
+func (c *chat) cmdClear(string) error {
+	c.ui.clear()
+	return nil
+}
+
+func (c *chat) cmdQuit(string) error {
+	c.requestQuit()
+	return nil
+}
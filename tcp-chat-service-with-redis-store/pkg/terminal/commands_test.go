@@ -0,0 +1,64 @@
+package terminal
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantName  string
+		wantArgs  string
+		wantOK    bool
+		wantKnown bool
+	}{
+		{"chat text", "hello", "", "hello", false, false},
+		{"text with a slash inside", "and/or", "", "and/or", false, false},
+		{"escaped slash", "//shrug", "", "/shrug", false, false},
+		{"escape of an escape", "///", "", "//", false, false},
+		{"escaped command", "//nick bob", "", "/nick bob", false, false},
+		{"no arguments", "/users", "users", "", true, true},
+		{"arguments", "/dm bob hi there", "dm", "bob hi there", true, true},
+		{"spaces around the arguments", "/search   two  words  ", "search", "two  words", true, true},
+		{"name is case insensitive", "/NICK Bob", "nick", "Bob", true, true},
+		{"quotes are kept", `/dm bob "hi there"`, "dm", `bob "hi there"`, true, true},
+		{"quoted path", `/upload "my file.txt"`, "upload", `"my file.txt"`, true, true},
+		{"unknown command", "/shout hello", "shout", "hello", true, false},
+		{"lone slash", "/", "", "", true, false},
+		{"slash and a space", "/ hello", "", "hello", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, args, ok := parseCommand(tt.input)
+			if name != tt.wantName || args != tt.wantArgs || ok != tt.wantOK {
+				t.Fatalf("expected (%q, %q, %t), got (%q, %q, %t)", tt.wantName, tt.wantArgs, tt.wantOK, name, args, ok)
+			}
+			if _, known := lookupCommand(name); ok && known != tt.wantKnown {
+				t.Fatalf("expected /%s known to be %t", name, tt.wantKnown)
+			}
+		})
+	}
+}
+
+func TestSplitArg(t *testing.T) {
+	tests := []struct {
+		args      string
+		wantFirst string
+		wantRest  string
+		wantOK    bool
+	}{
+		{"42 new text", "42", "new text", true},
+		{"#42 :+1:", "42", ":+1:", true},
+		{"bob   hi", "bob", "hi", true},
+		{"42", "42", "", false},
+		{"#", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			first, rest, ok := splitArg(tt.args)
+			if first != tt.wantFirst || rest != tt.wantRest || ok != tt.wantOK {
+				t.Fatalf("expected (%q, %q, %t), got (%q, %q, %t)", tt.wantFirst, tt.wantRest, tt.wantOK, first, rest, ok)
+			}
+		})
+	}
+}
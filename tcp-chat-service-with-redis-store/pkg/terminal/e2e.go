@@ -0,0 +1,65 @@
+package terminal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// open decrypts an encrypted direct message in place, warning first if the sender's key changed.
+func (c *chat) open(ev *pb.Event) {
+	if ev.GetSealed() == nil {
+		return
+	}
+	text, err := c.conn.Decrypt(ev)
+	var changed *client.KeyChangedError
+	switch {
+	case errors.As(err, &changed):
+		c.keyWarning(changed)
+	case err != nil:
+		text = fmt.Sprintf("(could not decrypt: %s)", err)
+	}
+	ev.Body = text
+}
+
+// keyWarning tells the user a peer's key changed, which is what it looks like when someone poses as them.
+func (c *chat) keyWarning(err *client.KeyChangedError) {
+	c.show(fmt.Sprintf("!!! WARNING: the encryption key of %s changed. Someone, even the server, may be posing as them.", err.User))
+	c.show("!!!   was  " + client.Fingerprint(err.Pinned))
+	c.show("!!!   now  " + client.Fingerprint(err.Received))
+	c.show(fmt.Sprintf("!!! Compare the new fingerprint with %s in person or on another channel, then /trust %s. Until then direct messages to them are not sent.", err.User, err.User))
+}
+
+// cmdFingerprint shows the fingerprint of the user's own key, or of a peer's.
+func (c *chat) cmdFingerprint(user string) error {
+	if user == "" {
+		c.show("your key: " + client.Fingerprint(c.conn.IdentityKey()))
+		return nil
+	}
+	key, err := c.conn.PeerKey(c.ctx, user)
+	var changed *client.KeyChangedError
+	if errors.As(err, &changed) {
+		c.keyWarning(changed)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.show(fmt.Sprintf("%s: %s", user, client.Fingerprint(key)))
+	return nil
+}
+
+// cmdTrust accepts the key a user publishes now.
+func (c *chat) cmdTrust(user string) error {
+	if user == "" {
+		return errUsage
+	}
+	key, err := c.conn.Trust(c.ctx, user)
+	if err != nil {
+		return err
+	}
+	c.show(fmt.Sprintf("trusting the key of %s: %s", user, client.Fingerprint(key)))
+	return nil
+}
@@ -0,0 +1,75 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+)
+
+// mentionsPage is how many mentions are fetched at a time.
+const mentionsPage = 50
+
+// mentionsMe reports whether an event mentions the user.
+func (c *chat) mentionsMe(ev *pb.Event) bool {
+	user := c.conn.User()
+	for _, m := range ev.GetMentions() {
+		if m == user {
+			return true
+		}
+	}
+	return false
+}
+
+// display shows an event. One that mentions the user is highlighted with a bell, and read once shown.
+func (c *chat) display(ev *pb.Event) {
+	if !c.mentionsMe(ev) {
+		c.ui.showSpans(render(ev, c.markup), false, false)
+		return
+	}
+	c.ui.showSpans(render(ev, c.markup), true, true)
+	go func() {
+		if _, _, err := c.conn.ListMentions(c.ctx, &pb.ListMentionsRequest{Limit: 1, MarkRead: true}); err != nil {
+			log.Printf("could not mark the mention read: %s", err)
+		}
+	}()
+}
+
+// showUnreadMentions shows the mentions the user has not seen yet, those posted while it was away.
+func (c *chat) showUnreadMentions() {
+	first := true
+	for {
+		events, unread, err := c.conn.ListMentions(c.ctx, &pb.ListMentionsRequest{Limit: mentionsPage, UnreadOnly: true, MarkRead: true})
+		if err != nil {
+			c.show("could not fetch your mentions: " + err.Error())
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+		if first {
+			c.ui.showSpans([]markup.Span{{Text: fmt.Sprintf("you were mentioned %d times while away:", int64(len(events))+unread)}}, true, true)
+			first = false
+		}
+		for _, ev := range events {
+			c.ui.showSpans(render(ev, c.markup), true, false)
+		}
+	}
+}
+
+// cmdMentions shows the latest mentions of the user.
+func (c *chat) cmdMentions(string) error {
+	events, _, err := c.conn.ListMentions(c.ctx, &pb.ListMentionsRequest{Limit: 20, MarkRead: true})
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		c.show("nobody mentioned you yet")
+		return nil
+	}
+	for _, ev := range events {
+		c.ui.showSpans(render(ev, c.markup), true, false)
+	}
+	return nil
+}
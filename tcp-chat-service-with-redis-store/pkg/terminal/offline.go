@@ -0,0 +1,145 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// While the client is offline messages typed are queued. Once it is back process catches up on the messages of every
+// room and the direct messages newer than the last event received, then sends the queued messages.
+
+const (
+	// maxPending bounds the messages queued while offline.
+	maxPending = 100
+	// catchUpPage is how many missed messages are fetched at a time.
+	catchUpPage = 100
+)
+
+// connectionChanged is the client's connection handler. It hands the change to process, which may be busy.
+func (c *chat) connectionChanged(online bool, detail string) {
+	c.mu.Lock()
+	c.resumed = c.resumed || (online && !c.online)
+	c.online, c.detail = online, detail
+	c.mu.Unlock()
+	select {
+	case c.connection <- struct{}{}:
+	default:
+	}
+}
+
+// catchUp shows the room and direct messages missed while offline, in the order they were sent.
+func (c *chat) catchUp() {
+	c.caughtUp = make(map[string]bool)
+	rooms, err := c.missed(func(after string) ([]*pb.Event, error) {
+		return c.conn.History(c.ctx, &pb.HistoryRequest{AllRooms: true, AfterId: after, Limit: catchUpPage})
+	})
+	if err != nil {
+		c.show("could not fetch the missed messages: " + err.Error())
+		return
+	}
+	direct, err := c.missed(func(after string) ([]*pb.Event, error) {
+		return c.conn.DirectHistory(c.ctx, &pb.DirectHistoryRequest{AfterId: after, Limit: catchUpPage})
+	})
+	if err != nil {
+		c.show("could not fetch the missed direct messages: " + err.Error())
+		return
+	}
+	events := append(rooms, direct...)
+	sort.Slice(events, func(i, j int) bool { return newerID(events[j].GetId(), events[i].GetId()) })
+	for _, ev := range events {
+		c.caughtUp[ev.GetId()] = true
+		c.seen(ev)
+		c.open(ev)
+		c.display(ev)
+	}
+}
+
+// missed pages through the messages newer than the last event received.
+func (c *chat) missed(page func(after string) ([]*pb.Event, error)) ([]*pb.Event, error) {
+	after := c.lastEvent
+	// nothing was stored when the chat started.
+	if after == "" {
+		after = "0"
+	}
+	var events []*pb.Event
+	for {
+		batch, err := page(after)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, batch...)
+		if len(batch) < catchUpPage {
+			return events, nil
+		}
+		after = batch[len(batch)-1].GetId()
+	}
+}
+
+// newestMessage returns the id of the newest message stored in a room or a conversation of the user, "" if there is
+// none.
+func (c *chat) newestMessage() string {
+	rooms, err := c.conn.History(c.ctx, &pb.HistoryRequest{AllRooms: true, Limit: 1})
+	if err != nil {
+		c.show("could not fetch the newest message: " + err.Error())
+		return ""
+	}
+	direct, err := c.conn.DirectHistory(c.ctx, &pb.DirectHistoryRequest{Limit: 1})
+	if err != nil {
+		c.show("could not fetch the newest direct message: " + err.Error())
+		return ""
+	}
+	var newest string
+	for _, ev := range append(rooms, direct...) {
+		if newerID(ev.GetId(), newest) {
+			newest = ev.GetId()
+		}
+	}
+	return newest
+}
+
+// seen keeps track of the newest event received and of the newest message shown in the room.
+func (c *chat) seen(ev *pb.Event) {
+	if newerID(ev.GetId(), c.lastEvent) {
+		c.lastEvent = ev.GetId()
+	}
+	if ev.GetKind() == pb.Event_TEXT && ev.GetRecipient() == "" && ev.GetRoom() == c.room {
+		c.lastSeen = ev.GetId()
+	}
+}
+
+// newerID reports whether the event id a was handed out after b. Ids are increasing decimal numbers, "" is older
+// than any of them.
+func newerID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// queue keeps a message typed while offline.
+func (c *chat) queue(text string) {
+	if len(c.pending) >= maxPending {
+		c.show("offline, too many messages queued. not sent: " + text)
+		return
+	}
+	c.pending = append(c.pending, text)
+	c.show(fmt.Sprintf("offline, message queued (%d)", len(c.pending)))
+}
+
+// flush sends the messages queued while offline, in order.
+func (c *chat) flush() {
+	pending := c.pending
+	c.pending = nil
+	for i, text := range pending {
+		_, err := c.conn.Send(c.ctx, c.room, text)
+		if err != nil && !c.conn.Online() {
+			c.pending = append(c.pending, pending[i:]...)
+			return
+		}
+		if err != nil {
+			c.show(fmt.Sprintf("could not send %q: %s", text, err))
+		}
+	}
+}
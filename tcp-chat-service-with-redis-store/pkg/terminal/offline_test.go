@@ -0,0 +1,191 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/server"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// timeout bounds how long a test waits for the server or for an event.
+const timeout = 5 * time.Second
+
+// newServer starts a server on an in-memory listener and returns a function connecting users to it.
+func newServer(t *testing.T) func(user string) *client.Client {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := server.NewServer(miniredis.RunT(t).Addr(), "", server.WithListener(lis))
+	if err := s.Start(); err != nil {
+		t.Fatalf("could not start the server: %s", err)
+	}
+	t.Cleanup(s.Stop)
+	return func(user string) *client.Client {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		c, err := client.Dial(ctx,
+			client.WithServerAddr("bufconn"),
+			client.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+			client.WithUser(user),
+			client.WithPlaintextDirect())
+		if err != nil {
+			t.Fatalf("could not connect as %s: %s", user, err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+}
+
+// newChat is a chat on conn writing plain lines to the buffer returned.
+func newChat(conn *client.Client) (*chat, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &chat{
+		ctx:    context.Background(),
+		conn:   conn,
+		room:   common.DEFAULT_ROOM,
+		typing: make(map[string]time.Time),
+		ui:     newLineUI(nil, out, false),
+		online: true,
+	}, out
+}
+
+// texts reads the text events of c until it has n of them.
+func texts(t *testing.T, c *client.Client, n int) []*pb.Event {
+	t.Helper()
+	var events []*pb.Event
+	deadline := time.After(timeout)
+	for len(events) < n {
+		select {
+		case ev := <-c.Messages():
+			if ev.GetKind() == pb.Event_TEXT {
+				events = append(events, ev)
+			}
+		case <-deadline:
+			t.Fatalf("%s: got %d of %d messages", c.User(), len(events), n)
+		}
+	}
+	return events
+}
+
+func TestNewerID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "1", true},
+		{"1", "2", false},
+		{"10", "9", true},
+		{"9", "10", false},
+		{"123", "123", false},
+		{"1", "", true},
+		{"", "1", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q after %q", tt.a, tt.b), func(t *testing.T) {
+			if got := newerID(tt.a, tt.b); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestQueueIsBounded(t *testing.T) {
+	c, out := newChat(nil)
+	for i := 0; i < maxPending+1; i++ {
+		c.queue(fmt.Sprintf("message %d", i))
+	}
+	if len(c.pending) != maxPending {
+		t.Fatalf("expected %d messages queued, got %d", maxPending, len(c.pending))
+	}
+	if c.pending[0] != "message 0" || c.pending[maxPending-1] != fmt.Sprintf("message %d", maxPending-1) {
+		t.Fatalf("expected the first messages to be kept in order, got %q ... %q", c.pending[0], c.pending[maxPending-1])
+	}
+	if !strings.Contains(out.String(), fmt.Sprintf("not sent: message %d", maxPending)) {
+		t.Fatalf("expected the message over the bound to be reported, got %q", out.String())
+	}
+}
+
+func TestFlushSendsInOrder(t *testing.T) {
+	connect := newServer(t)
+	alice, bob := connect("alice"), connect("bob")
+	c, _ := newChat(alice)
+	for _, text := range []string{"one", "two", "three"} {
+		c.queue(text)
+	}
+	c.flush()
+	if len(c.pending) != 0 {
+		t.Fatalf("expected the queue to be empty, got %q", c.pending)
+	}
+	var got []string
+	for _, ev := range texts(t, bob, 3) {
+		got = append(got, ev.GetBody())
+	}
+	if strings.Join(got, ",") != "one,two,three" {
+		t.Fatalf("expected the messages in the order typed, got %q", got)
+	}
+}
+
+func TestCatchUpAfterReconnect(t *testing.T) {
+	connect := newServer(t)
+	alice, bob := connect("alice"), connect("bob")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := bob.Send(ctx, "", "before"); err != nil {
+		t.Fatal(err)
+	}
+	texts(t, alice, 1)
+	c, out := newChat(alice)
+	c.lastEvent = c.newestMessage()
+
+	// what alice missed while offline: messages in the room and a direct message in between.
+	if _, err := bob.Send(ctx, "", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.SendDirect(ctx, "alice", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Send(ctx, "", "three"); err != nil {
+		t.Fatal(err)
+	}
+	live := texts(t, alice, 3)
+
+	c.catchUp()
+	shown := out.String()
+	if strings.Contains(shown, "before") {
+		t.Fatalf("expected only the messages after the last event, got %q", shown)
+	}
+	one, two, three := strings.Index(shown, ": one"), strings.Index(shown, ": two"), strings.Index(shown, ": three")
+	if one < 0 || !(one < two && two < three) {
+		t.Fatalf("expected the missed messages in the order sent, got %q", shown)
+	}
+	if c.lastEvent != live[2].GetId() {
+		t.Fatalf("expected the last event to be %s, got %s", live[2].GetId(), c.lastEvent)
+	}
+
+	// the same messages still arrive on the stream after the catch up, they are not shown twice.
+	out.Reset()
+	for _, ev := range live {
+		c.receive(ev)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected the messages caught up on to be shown once, got %q", out.String())
+	}
+	if len(c.caughtUp) != 0 {
+		t.Fatalf("expected the caught up ids to be dropped once received, got %v", c.caughtUp)
+	}
+	c.receive(&pb.Event{Kind: pb.Event_TEXT, Id: "999", Room: common.DEFAULT_ROOM, Sender: "bob", Body: "four"})
+	if !strings.Contains(out.String(), ": four") {
+		t.Fatalf("expected a new message to be shown, got %q", out.String())
+	}
+}
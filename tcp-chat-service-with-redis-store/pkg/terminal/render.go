@@ -0,0 +1,111 @@
+package terminal
+
+import (
+	"fmt"
+
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+)
+
+// Render formats an event from the bus as a line for the terminal. Control characters in it are escaped.
+func Render(ev *pb.Event) string {
+	return markup.Sanitize(markup.Plain(render(ev, false)))
+}
+
+// render formats an event as a line of spans. Names in messages are coloured and, with rich, the text of messages is
+// styled by its markup.
+func render(ev *pb.Event, rich bool) []markup.Span {
+	ts := ev.GetTimestamp().AsTime().Local().Format("15:04")
+	line := func(format string, args ...interface{}) []markup.Span {
+		return []markup.Span{{Text: fmt.Sprintf(format, args...)}}
+	}
+	switch ev.GetKind() {
+	case pb.Event_JOIN:
+		return line("[%s] * %s joined the chat", ts, ev.GetSender())
+	case pb.Event_LEAVE:
+		if ev.GetBody() != "" {
+			return line("[%s] * %s left the chat (%s)", ts, ev.GetSender(), ev.GetBody())
+		}
+		return line("[%s] * %s left the chat", ts, ev.GetSender())
+	case pb.Event_SYSTEM:
+		return line("[%s] * %s", ts, ev.GetBody())
+	case pb.Event_EDIT:
+		return line("[%s] * %s edited #%s : %s", ts, ev.GetSender(), ev.GetRef(), ev.GetBody())
+	case pb.Event_DELETE:
+		return line("[%s] * %s deleted #%s", ts, ev.GetSender(), ev.GetRef())
+	case pb.Event_REACTION:
+		return line("[%s] * %s reacted %s to #%s", ts, ev.GetSender(), ev.GetBody(), ev.GetRef())
+	case pb.Event_UNREACTION:
+		return line("[%s] * %s took back %s on #%s", ts, ev.GetSender(), ev.GetBody(), ev.GetRef())
+	case pb.Event_READ:
+		return line("[%s] * %s has read [%s] up to #%s", ts, ev.GetSender(), ev.GetRoom(), ev.GetRef())
+	}
+	var spans []markup.Span
+	if ev.GetRecipient() != "" {
+		kind := "dm"
+		if ev.GetSealed() != nil {
+			kind = "dm e2e"
+		}
+		spans = line("[%s] #%s [%s] ", ts, ev.GetId(), kind)
+		spans = append(spans, nick(ev.GetSender(), rich), markup.Span{Text: " -> "}, nick(ev.GetRecipient(), rich))
+	} else {
+		spans = line("[%s] #%s [%s] ", ts, ev.GetId(), ev.GetRoom())
+		spans = append(spans, nick(ev.GetSender(), rich))
+	}
+	spans = append(spans, markup.Span{Text: " : "})
+	body := ev.GetBody()
+	switch {
+	case ev.GetDeleted():
+		body = "(deleted)"
+	case ev.GetSealed() != nil && body == "":
+		body = "(encrypted)"
+	}
+	if rich {
+		spans = append(spans, markup.Parse(body)...)
+	} else {
+		spans = append(spans, markup.Span{Text: body})
+	}
+	var rest string
+	if ev.GetEdited() && !ev.GetDeleted() {
+		rest = " (edited)"
+	}
+	for _, a := range ev.GetAttachments() {
+		if body != "" || rest != "" {
+			rest += " "
+		}
+		rest += fmt.Sprintf("[%s, %s, %s : /download %s]", a.GetFilename(), formatSize(a.GetSize()), a.GetMimeType(), a.GetId())
+	}
+	if rest != "" {
+		spans = append(spans, markup.Span{Text: rest})
+	}
+	return spans
+}
+
+// nick is a name in a message, coloured with rich.
+func nick(name string, rich bool) markup.Span {
+	if !rich {
+		return markup.Span{Text: name}
+	}
+	return markup.Nick(name)
+}
+
+// renderResult formats a search result with its snippet in place of the message.
+func renderResult(r *pb.SearchResult) string {
+	ev := r.GetMessage()
+	ts := ev.GetTimestamp().AsTime().Local().Format("Jan 2 15:04")
+	return fmt.Sprintf("[%s] #%s [%s] %s : %s", ts, ev.GetId(), ev.GetRoom(), ev.GetSender(), r.GetSnippet())
+}
+
+// formatSize prints a byte count in the largest unit that keeps it above 1.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
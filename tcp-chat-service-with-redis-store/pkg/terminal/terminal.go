@@ -0,0 +1,268 @@
+// Package terminal is the interactive chat program, a full screen terminal ui, or plain lines for pipes, on top of
+// the client SDK.
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/client"
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chat is one run of the program: what is shown, the user's input and the session it goes to.
+type chat struct {
+	ctx        context.Context
+	conn       *client.Client
+	rcvChannel chan string
+	room       string
+	// lastSeen is the id of the newest message shown in room, /read marks the room read up to it. lastEvent is the
+	// id of the newest event received, of any kind, catching up after a reconnect starts after it.
+	lastSeen  string
+	lastEvent string
+	// typing holds who is typing in room, or a direct message to the user, and until when. typingSent is when the user
+	// was last said to be typing, typingTo to whom: "" for the room.
+	typing     map[string]time.Time
+	typingSent time.Time
+	typingTo   string
+	// ui shows the chat, lineMode keeps the plain line ui even on a terminal. markup styles the messages.
+	ui       ui
+	lineMode bool
+	markup   bool
+	sidebar  bool
+	quit     chan struct{}
+	quitOnce sync.Once
+	// connection signals that the client went offline or came back, mu guards the state it went to.
+	connection chan struct{}
+	mu         sync.Mutex
+	online     bool
+	detail     string
+	resumed    bool
+	// pending holds the messages typed while offline, caughtUp the ids of the missed messages shown after it.
+	pending  []string
+	caughtUp map[string]bool
+	writer   io.Writer
+}
+
+// Settings are how the chat is shown.
+type Settings struct {
+	// LineMode reads and writes plain lines even on a terminal.
+	LineMode bool
+	// Markup shows *bold*, _italics_ and `code` in messages styled and names in colour, see package markup.
+	Markup bool
+}
+
+// Run connects with the client options and runs the chat on stdin and stdout until ctx is done, the user quits or
+// the input ends. Without a username in the options it asks for one, and again when the server refuses it.
+func Run(ctx context.Context, settings Settings, opts ...client.Option) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := &chat{
+		ctx:        ctx,
+		rcvChannel: make(chan string, 1),
+		room:       common.DEFAULT_ROOM,
+		typing:     make(map[string]time.Time),
+		lineMode:   settings.LineMode,
+		markup:     settings.Markup,
+		quit:       make(chan struct{}),
+		connection: make(chan struct{}, 1),
+		online:     true,
+		writer:     os.Stdout,
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	opts = append(opts, client.WithLogger(log.Default()), client.WithConnectionHandler(c.connectionChanged))
+	conn, err := c.dial(scanner, opts)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	log.Printf("connected as %s", conn.User())
+
+	if err := c.initUI(scanner); err != nil {
+		conn.Close()
+		return err
+	}
+	// read what the user enters.
+	go c.ui.run(c)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.process()
+	}()
+	// wait until the context ends, or the user quits.
+	select {
+	case <-ctx.Done():
+	case <-c.quit:
+	}
+	c.ui.close()
+	log.SetOutput(os.Stderr)
+	log.Println("Stopping client service..")
+	cancel()
+	<-done
+	if err := conn.Close(); err != nil {
+		log.Printf("could not disconnect the user: %s", err)
+	}
+	return nil
+}
+
+// dial opens the session, asking for a username until the server takes one. With a client certificate the first
+// attempt may go without a username.
+func (c *chat) dial(scanner *bufio.Scanner, opts []client.Option) (*client.Client, error) {
+	for {
+		conn, err := client.Dial(c.ctx, opts...)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, client.ErrNoUser) {
+			switch status.Code(err) {
+			case codes.AlreadyExists, codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied:
+				c.write(err.Error() + "\n")
+			default:
+				return nil, err
+			}
+		}
+		c.write("> Enter a username: ")
+		if !scanner.Scan() {
+			return nil, errors.New("no username entered")
+		}
+		opts = append(opts, client.WithUser(scanner.Text()))
+	}
+}
+
+// initUI starts the full screen ui when both ends are a terminal, and plain lines otherwise.
+func (c *chat) initUI(scanner *bufio.Scanner) error {
+	if c.lineMode || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		c.ui = newLineUI(scanner, c.writer, isTerminal(os.Stdout))
+		return nil
+	}
+	t, err := newTUI(c.title())
+	if err != nil {
+		return fmt.Errorf("could not start the terminal ui: %w", err)
+	}
+	// anything logged would garble the screen, show it as a message instead.
+	log.SetOutput(t)
+	c.ui = t
+	c.sidebar = true
+	return nil
+}
+
+func (c *chat) process() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	usersTicker := time.NewTicker(common.HEARTBEAT_INTERVAL)
+	defer usersTicker.Stop()
+	c.lastEvent = c.newestMessage()
+	c.refreshUsers()
+	c.showUnreadMentions()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case msg := <-c.rcvChannel:
+			c.handleInput(msg)
+		case <-c.connection:
+			c.mu.Lock()
+			online, detail, resumed := c.online, c.detail, c.resumed
+			c.resumed = false
+			c.mu.Unlock()
+			c.ui.setConnection(online, detail)
+			if resumed {
+				c.catchUp()
+				c.flush()
+				c.refreshUsers()
+			}
+		case ev := <-c.conn.Messages():
+			c.receive(ev)
+		case <-usersTicker.C:
+			c.refreshUsers()
+		case now := <-ticker.C:
+			if len(c.typing) > 0 {
+				c.expireTyping(now)
+				c.drawTyping()
+			}
+		}
+	}
+}
+
+// receive shows an event from the server.
+func (c *chat) receive(ev *pb.Event) {
+	// shown already when catching up after a reconnect.
+	if ev.GetKind() == pb.Event_TEXT && c.caughtUp[ev.GetId()] {
+		delete(c.caughtUp, ev.GetId())
+		return
+	}
+	c.seen(ev)
+	c.open(ev)
+	c.observeTyping(ev)
+	if ev.GetKind() == pb.Event_TYPING {
+		c.drawTyping()
+		return
+	}
+	c.display(ev)
+	switch ev.GetKind() {
+	case pb.Event_JOIN, pb.Event_LEAVE, pb.Event_SYSTEM:
+		c.refreshUsers()
+	}
+}
+
+// send posts a message to the room.
+func (c *chat) send(text string) {
+	if !c.conn.Online() {
+		c.queue(text)
+		return
+	}
+	_, err := c.conn.Send(c.ctx, c.room, text)
+	if err != nil && !c.conn.Online() {
+		c.queue(text)
+		return
+	}
+	if err != nil {
+		c.show("could not send message: " + err.Error())
+	}
+}
+
+// show adds a line to the messages on screen.
+func (c *chat) show(line string) {
+	c.ui.show(line)
+}
+
+// refreshUsers updates the online users in the sidebar.
+func (c *chat) refreshUsers() {
+	if !c.sidebar || !c.conn.Online() {
+		return
+	}
+	users, err := c.conn.Users(c.ctx)
+	if err != nil {
+		log.Printf("could not list users: %s", err)
+		return
+	}
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		names = append(names, u.GetName())
+	}
+	c.ui.setUsers(names)
+}
+
+// title names the user and the room in the ui.
+func (c *chat) title() string {
+	return c.conn.User() + " @ " + c.room
+}
+
+// requestQuit stops the chat as if it was interrupted.
+func (c *chat) requestQuit() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+func (c *chat) write(msg string) {
+	c.writer.Write([]byte(msg))
+}
@@ -0,0 +1,545 @@
+package terminal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+)
+
+// tui is the full screen terminal ui: the messages on top with the online users on the right, a status bar and
+// the input line at the bottom.
+//
+//	PgUp / PgDn, shift+up / shift+down, mouse wheel   scroll the messages
+//	up / down                                          input history
+//	left / right, home / end, ctrl+a / ctrl+e           move in the input
+//	ctrl+u / ctrl+k / ctrl+w                            delete to start / to end / the word before the cursor
+//	ctrl+l                                              redraw
+//	ctrl+c, ctrl+d on an empty line                     quit
+type tui struct {
+	screen tcell.Screen
+	title  string
+
+	mu     sync.Mutex
+	closed bool
+	lines  []shownLine
+	// scroll is how many rows the messages are scrolled up from the bottom.
+	scroll int
+	users  []string
+	typing string
+	// offline is set while the client reconnects, connection tells how it is going.
+	offline    bool
+	connection string
+
+	input  []rune
+	cursor int
+	// history holds the lines entered, historyPos the one shown while browsing it (len(history) for a new line).
+	history    []string
+	historyPos int
+	draft      []rune
+}
+
+const (
+	maxScrollback = 5000
+	maxHistory    = 500
+	sidebarWidth  = 20
+	// sidebarMinWidth is the narrowest screen that still shows the users.
+	sidebarMinWidth = 60
+	wheelLines      = 3
+	prompt          = "> "
+)
+
+var (
+	statusStyle  = tcell.StyleDefault.Reverse(true)
+	sidebarStyle = tcell.StyleDefault.Dim(true)
+	systemStyle  = tcell.StyleDefault.Dim(true)
+	mentionStyle = tcell.StyleDefault.Bold(true).Foreground(tcell.ColorYellow)
+	// nickColors are the colours of names, the same as 31 to 36 of the line ui.
+	nickColors = [markup.NickColors]tcell.Color{tcell.ColorMaroon, tcell.ColorGreen, tcell.ColorOlive, tcell.ColorNavy, tcell.ColorPurple, tcell.ColorTeal}
+)
+
+// shownLine is a line of the messages. highlighted lines concern the user.
+type shownLine struct {
+	spans       []markup.Span
+	highlighted bool
+}
+
+// text is the line without its styles.
+func (l shownLine) text() []rune {
+	return []rune(markup.Plain(l.spans))
+}
+
+// cells returns the characters of the line and the style of each, the spans' styles on top of base.
+func (l shownLine) cells(base tcell.Style) ([]rune, []tcell.Style) {
+	var runes []rune
+	var styles []tcell.Style
+	for _, span := range l.spans {
+		style := base
+		if span.Style&markup.Bold != 0 {
+			style = style.Bold(true)
+		}
+		if span.Style&markup.Italic != 0 {
+			style = style.Italic(true)
+		}
+		if span.Style&markup.Code != 0 {
+			style = style.Reverse(true)
+		}
+		if span.Color > 0 && span.Color <= len(nickColors) {
+			style = style.Foreground(nickColors[span.Color-1])
+		}
+		for _, r := range span.Text {
+			runes = append(runes, r)
+			styles = append(styles, style)
+		}
+	}
+	return runes, styles
+}
+
+func newTUI(title string) (*tui, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	screen.EnableMouse()
+	t := &tui{screen: screen, title: title}
+	t.mu.Lock()
+	t.draw()
+	t.mu.Unlock()
+	return t, nil
+}
+
+func (t *tui) run(c *chat) {
+	for {
+		ev := t.screen.PollEvent()
+		if ev == nil {
+			// the screen was closed.
+			return
+		}
+		line, send, quit := t.handle(ev)
+		switch {
+		case quit:
+			c.requestQuit()
+			return
+		case send:
+			c.stopTyping()
+			c.rcvChannel <- line
+		case line != "":
+			c.sendTyping(line)
+		}
+	}
+}
+
+// handle applies an event to the ui. It returns the line to send if the user entered one, the input if the user is
+// typing, and whether the user wants to quit.
+func (t *tui) handle(ev tcell.Event) (line string, send bool, quit bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return "", false, false
+	}
+	defer t.draw()
+	switch ev := ev.(type) {
+	case *tcell.EventResize:
+		t.screen.Sync()
+	case *tcell.EventMouse:
+		switch ev.Buttons() {
+		case tcell.WheelUp:
+			t.scroll += wheelLines
+		case tcell.WheelDown:
+			t.scroll -= wheelLines
+		}
+	case *tcell.EventKey:
+		return t.key(ev)
+	}
+	return "", false, false
+}
+
+func (t *tui) key(ev *tcell.EventKey) (string, bool, bool) {
+	page := t.paneHeight() - 1
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		return "", false, true
+	case tcell.KeyCtrlD:
+		if len(t.input) == 0 {
+			return "", false, true
+		}
+		t.deleteAt(t.cursor)
+	case tcell.KeyEnter:
+		line := string(t.input)
+		t.input, t.cursor, t.draft = nil, 0, nil
+		if strings.TrimSpace(line) == "" {
+			return "", false, false
+		}
+		if len(t.history) == 0 || t.history[len(t.history)-1] != line {
+			t.history = append(t.history, line)
+			if len(t.history) > maxHistory {
+				t.history = t.history[1:]
+			}
+		}
+		t.historyPos = len(t.history)
+		t.scroll = 0
+		return line, true, false
+	case tcell.KeyPgUp:
+		t.scroll += page
+	case tcell.KeyPgDn:
+		t.scroll -= page
+	case tcell.KeyUp:
+		if ev.Modifiers()&tcell.ModShift != 0 {
+			t.scroll++
+			break
+		}
+		t.browseHistory(-1)
+	case tcell.KeyDown:
+		if ev.Modifiers()&tcell.ModShift != 0 {
+			t.scroll--
+			break
+		}
+		t.browseHistory(1)
+	case tcell.KeyLeft:
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case tcell.KeyRight:
+		if t.cursor < len(t.input) {
+			t.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		t.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		t.cursor = len(t.input)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if t.cursor > 0 {
+			t.cursor--
+			t.deleteAt(t.cursor)
+		}
+	case tcell.KeyDelete:
+		t.deleteAt(t.cursor)
+	case tcell.KeyCtrlU:
+		t.input, t.cursor = append([]rune{}, t.input[t.cursor:]...), 0
+	case tcell.KeyCtrlK:
+		t.input = t.input[:t.cursor]
+	case tcell.KeyCtrlW:
+		start := t.cursor
+		for start > 0 && t.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && t.input[start-1] != ' ' {
+			start--
+		}
+		t.input, t.cursor = append(t.input[:start], t.input[t.cursor:]...), start
+	case tcell.KeyCtrlL:
+		t.screen.Sync()
+	case tcell.KeyRune:
+		t.input = append(t.input[:t.cursor], append([]rune{ev.Rune()}, t.input[t.cursor:]...)...)
+		t.cursor++
+		return string(t.input), false, false
+	}
+	return "", false, false
+}
+
+func (t *tui) deleteAt(i int) {
+	if i < len(t.input) {
+		t.input = append(t.input[:i], t.input[i+1:]...)
+	}
+}
+
+// browseHistory moves through the lines entered before. The line being edited is kept to come back to.
+func (t *tui) browseHistory(delta int) {
+	pos := t.historyPos + delta
+	if pos < 0 || pos > len(t.history) {
+		return
+	}
+	if t.historyPos == len(t.history) {
+		t.draft = t.input
+	}
+	t.historyPos = pos
+	if pos == len(t.history) {
+		t.input = t.draft
+	} else {
+		t.input = []rune(t.history[pos])
+	}
+	t.cursor = len(t.input)
+}
+
+func (t *tui) show(line string) {
+	for _, l := range strings.Split(strings.TrimRight(line, "\n"), "\n") {
+		t.showSpans([]markup.Span{{Text: l}}, false, false)
+	}
+}
+
+func (t *tui) showSpans(spans []markup.Span, highlighted, bell bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	line := shownLine{highlighted: highlighted}
+	for _, span := range spans {
+		span.Text = markup.Sanitize(span.Text)
+		line.spans = append(line.spans, span)
+	}
+	t.lines = append(t.lines, line)
+	// stay on the messages being read while new ones come in.
+	if t.scroll > 0 {
+		t.scroll += len(wrap(line.text(), t.paneWidth()))
+	}
+	if len(t.lines) > maxScrollback {
+		t.lines = t.lines[len(t.lines)-maxScrollback:]
+	}
+	if bell {
+		t.screen.Beep()
+	}
+	t.draw()
+}
+
+func (t *tui) setTyping(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.typing = markup.Sanitize(line)
+	t.draw()
+}
+
+func (t *tui) setUsers(users []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.users = make([]string, len(users))
+	for i, user := range users {
+		t.users[i] = markup.Sanitize(user)
+	}
+	t.draw()
+}
+
+func (t *tui) setTitle(title string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.title = markup.Sanitize(title)
+	t.draw()
+}
+
+func (t *tui) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines, t.scroll = nil, 0
+	t.draw()
+}
+
+func (t *tui) setConnection(online bool, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.offline, t.connection = !online, markup.Sanitize(detail)
+	t.draw()
+}
+
+// Write shows log output as messages while the screen is up.
+func (t *tui) Write(p []byte) (int, error) {
+	t.show("! " + strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+func (t *tui) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.mu.Unlock()
+	t.screen.Fini()
+}
+
+func (t *tui) sidebar() int {
+	if w, _ := t.screen.Size(); w >= sidebarMinWidth {
+		return sidebarWidth
+	}
+	return 0
+}
+
+func (t *tui) paneWidth() int {
+	w, _ := t.screen.Size()
+	if s := t.sidebar(); s > 0 {
+		// one column separates the users from the messages.
+		return w - s - 1
+	}
+	return w
+}
+
+func (t *tui) paneHeight() int {
+	_, h := t.screen.Size()
+	// the status bar and the input line.
+	return h - 2
+}
+
+// draw renders the whole screen. The caller holds the lock.
+func (t *tui) draw() {
+	if t.closed {
+		return
+	}
+	s := t.screen
+	s.Clear()
+	w, h := s.Size()
+	paneW, paneH := t.paneWidth(), t.paneHeight()
+	if paneW <= 0 || paneH <= 0 {
+		s.Show()
+		return
+	}
+
+	var rows [][]rune
+	var styles [][]tcell.Style
+	for _, line := range t.lines {
+		style := tcell.StyleDefault
+		switch {
+		case line.highlighted:
+			style = mentionStyle
+		case isSystemLine(string(line.text())):
+			style = systemStyle
+		}
+		runes, cellStyles := line.cells(style)
+		for _, row := range wrap(runes, paneW) {
+			rows = append(rows, runes[row[0]:row[1]])
+			styles = append(styles, cellStyles[row[0]:row[1]])
+		}
+	}
+	maxScroll := len(rows) - paneH
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if t.scroll > maxScroll {
+		t.scroll = maxScroll
+	}
+	if t.scroll < 0 {
+		t.scroll = 0
+	}
+	end := len(rows) - t.scroll
+	start := end - paneH
+	if start < 0 {
+		start = 0
+	}
+	// the newest messages sit right above the status bar.
+	y := paneH - (end - start)
+	for i := start; i < end; i++ {
+		drawCells(s, 0, y, paneW, rows[i], styles[i])
+		y++
+	}
+
+	if side := t.sidebar(); side > 0 {
+		x := w - side
+		for y := 0; y < paneH; y++ {
+			s.SetContent(x-1, y, '│', nil, sidebarStyle)
+		}
+		drawText(s, x, 0, side, fmt.Sprintf("online (%d)", len(t.users)), sidebarStyle.Bold(true))
+		for i, user := range t.users {
+			if i+1 >= paneH {
+				break
+			}
+			drawText(s, x, i+1, side, user, tcell.StyleDefault)
+		}
+	}
+
+	status := " ● " + t.title
+	if t.offline {
+		status = " ○ offline, " + t.connection + " │ " + t.title
+	}
+	if t.typing != "" {
+		status += " │ " + t.typing
+	}
+	if t.scroll > 0 {
+		status += fmt.Sprintf(" │ ↓ %d more", t.scroll)
+	}
+	for x := 0; x < w; x++ {
+		s.SetContent(x, h-2, ' ', nil, statusStyle)
+	}
+	drawText(s, 0, h-2, w, status, statusStyle)
+
+	// scroll the input sideways so the cursor stays visible.
+	before := runewidth.StringWidth(string(t.input[:t.cursor]))
+	room := w - len(prompt) - 1
+	offset := 0
+	if room > 0 && before > room {
+		offset = before - room
+	}
+	drawText(s, 0, h-1, len(prompt), prompt, tcell.StyleDefault.Bold(true))
+	x := len(prompt)
+	skipped := 0
+	for _, r := range t.input {
+		rw := runewidth.RuneWidth(r)
+		if skipped < offset {
+			skipped += rw
+			continue
+		}
+		if x+rw > w {
+			break
+		}
+		s.SetContent(x, h-1, r, nil, tcell.StyleDefault)
+		x += rw
+	}
+	s.ShowCursor(len(prompt)+before-offset, h-1)
+	s.Show()
+}
+
+// isSystemLine reports whether a rendered line is a notice (join, leave, edits ...) rather than a message.
+func isSystemLine(line string) bool {
+	_, rest, ok := strings.Cut(line, "] ")
+	return strings.HasPrefix(line, "!") || (ok && strings.HasPrefix(rest, "* "))
+}
+
+// drawText draws text from x to at most x+width, cutting off what does not fit.
+func drawText(s tcell.Screen, x, y, width int, text string, style tcell.Style) {
+	end := x + width
+	for _, r := range text {
+		rw := runewidth.RuneWidth(r)
+		if x+rw > end {
+			return
+		}
+		s.SetContent(x, y, r, nil, style)
+		x += rw
+	}
+}
+
+// drawCells draws characters in their styles from x to at most x+width, cutting off what does not fit.
+func drawCells(s tcell.Screen, x, y, width int, runes []rune, styles []tcell.Style) {
+	end := x + width
+	for i, r := range runes {
+		rw := runewidth.RuneWidth(r)
+		if x+rw > end {
+			return
+		}
+		s.SetContent(x, y, r, nil, styles[i])
+		x += rw
+	}
+}
+
+// wrap breaks a line into rows of at most width columns, preferring to break at spaces. It returns where each row
+// starts and ends in the line, a space the line is broken at belongs to neither row.
+func wrap(line []rune, width int) [][2]int {
+	if width <= 0 || runewidth.StringWidth(string(line)) <= width {
+		return [][2]int{{0, len(line)}}
+	}
+	var rows [][2]int
+	start, rowWidth, lastSpace := 0, 0, -1
+	for i, r := range line {
+		rw := runewidth.RuneWidth(r)
+		if rowWidth+rw > width && i > start {
+			if lastSpace > start {
+				rows = append(rows, [2]int{start, lastSpace})
+				start = lastSpace + 1
+			} else {
+				rows = append(rows, [2]int{start, i})
+				start = i
+			}
+			// the rest of the row has no space, the last one was before it.
+			lastSpace = -1
+			rowWidth = runewidth.StringWidth(string(line[start:i]))
+		}
+		if r == ' ' {
+			lastSpace = i
+		}
+		rowWidth += rw
+	}
+	return append(rows, [2]int{start, len(line)})
+}
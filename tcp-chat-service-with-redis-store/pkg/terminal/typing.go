@@ -0,0 +1,135 @@
+package terminal
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+)
+
+// observeTyping keeps track of who is typing in the client's room, or a direct message to the user.
+func (c *chat) observeTyping(ev *pb.Event) {
+	if ev.GetSender() == c.conn.User() {
+		return
+	}
+	who := ev.GetSender()
+	switch {
+	case ev.GetRecipient() != "":
+		if ev.GetRecipient() != c.conn.User() {
+			return
+		}
+		who += " (dm)"
+	case ev.GetRoom() != c.room:
+		return
+	}
+	switch ev.GetKind() {
+	case pb.Event_TYPING:
+		if expires := ev.GetExpires().AsTime(); expires.After(time.Now()) {
+			c.typing[who] = expires
+		} else {
+			delete(c.typing, who)
+		}
+	case pb.Event_TEXT:
+		// posting the message ends typing it.
+		delete(c.typing, who)
+	}
+}
+
+// expireTyping forgets the users whose typing indicator ran out.
+func (c *chat) expireTyping(now time.Time) {
+	for user, expires := range c.typing {
+		if !expires.After(now) {
+			delete(c.typing, user)
+		}
+	}
+}
+
+// drawTyping shows who is typing in the room.
+func (c *chat) drawTyping() {
+	if len(c.typing) == 0 {
+		c.ui.setTyping("")
+		return
+	}
+	c.ui.setTyping(typingLine(c.typing))
+}
+
+// sendTyping tells the room, or the peer of a /dm, that the user is typing the input, renewing it at most every half
+// TYPING_TTL. Nobody is told about other commands.
+func (c *chat) sendTyping(input string) {
+	to, ok := typingTarget(input)
+	now := time.Now()
+	if ok && to == c.typingTo && now.Sub(c.typingSent) < common.TYPING_TTL/2 {
+		return
+	}
+	// whoever was told before is not who the input is for anymore.
+	if !ok || to != c.typingTo {
+		c.stopTyping()
+	}
+	if !ok {
+		return
+	}
+	c.typingSent, c.typingTo = now, to
+	c.setTyping(to, true)
+}
+
+// stopTyping tells whoever was told the user is typing that it stopped.
+func (c *chat) stopTyping() {
+	if c.typingSent.IsZero() {
+		return
+	}
+	to := c.typingTo
+	c.typingSent, c.typingTo = time.Time{}, ""
+	c.setTyping(to, false)
+}
+
+func (c *chat) setTyping(to string, typing bool) {
+	room := c.room
+	go func() {
+		var err error
+		if to != "" {
+			err = c.conn.SetTypingDirect(c.ctx, to, typing)
+		} else {
+			err = c.conn.SetTyping(c.ctx, room, typing)
+		}
+		if err != nil {
+			log.Printf("could not send typing state: %s", err)
+		}
+	}()
+}
+
+// typingTarget returns who the input is for: "" for the room, the peer for a /dm once the name is complete. ok is
+// false for other commands.
+func typingTarget(input string) (to string, ok bool) {
+	if _, _, command := parseCommand(input); !command {
+		return "", true
+	}
+	rest, ok := strings.CutPrefix(input, "/dm ")
+	if !ok {
+		return "", false
+	}
+	to, _, ok = strings.Cut(strings.TrimLeft(rest, " "), " ")
+	if !ok || to == "" {
+		return "", false
+	}
+	return to, true
+}
+
+// typingLine describes who is typing, e.g. "alice and bob are typing…".
+func typingLine(typing map[string]time.Time) string {
+	users := make([]string, 0, len(typing))
+	for user := range typing {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	switch len(users) {
+	case 1:
+		return users[0] + " is typing…"
+	case 2, 3:
+		return strings.Join(users[:len(users)-1], ", ") + " and " + users[len(users)-1] + " are typing…"
+	}
+	return fmt.Sprintf("%d people are typing…", len(users))
+}
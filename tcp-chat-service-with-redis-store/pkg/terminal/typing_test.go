@@ -0,0 +1,63 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/common"
+	pb "github.com/shameerb/tcp-chat-redis/pkg/grpcapi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTypingTarget(t *testing.T) {
+	tests := []struct {
+		input  string
+		wantTo string
+		wantOK bool
+	}{
+		{"hello", "", true},
+		{"//shrug", "", true},
+		{"/dm", "", false},
+		{"/dm bo", "", false},
+		{"/dm bob ", "bob", true},
+		{"/dm  bob hi", "bob", true},
+		{"/nick alice", "", false},
+		{"/", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			to, ok := typingTarget(tt.input)
+			if to != tt.wantTo || ok != tt.wantOK {
+				t.Fatalf("expected (%q, %t), got (%q, %t)", tt.wantTo, tt.wantOK, to, ok)
+			}
+		})
+	}
+}
+
+func TestObserveTyping(t *testing.T) {
+	connect := newServer(t)
+	c, _ := newChat(connect("alice"))
+	expires := timestamppb.New(time.Now().Add(common.TYPING_TTL))
+	for _, ev := range []*pb.Event{
+		{Kind: pb.Event_TYPING, Room: common.DEFAULT_ROOM, Sender: "bob", Expires: expires},
+		{Kind: pb.Event_TYPING, Room: "ops", Sender: "carol", Expires: expires},
+		{Kind: pb.Event_TYPING, Sender: "dave", Recipient: "alice", Expires: expires},
+		{Kind: pb.Event_TYPING, Sender: "erin", Recipient: "bob", Expires: expires},
+		{Kind: pb.Event_TYPING, Room: common.DEFAULT_ROOM, Sender: "alice", Expires: expires},
+	} {
+		c.observeTyping(ev)
+	}
+	if got, want := typingLine(c.typing), "bob and dave (dm) are typing…"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// posting the message ends typing it.
+	c.observeTyping(&pb.Event{Kind: pb.Event_TEXT, Sender: "dave", Recipient: "alice"})
+	if got, want := typingLine(c.typing), "bob is typing…"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	c.expireTyping(expires.AsTime())
+	if len(c.typing) != 0 {
+		t.Fatalf("expected the indicators to run out, got %v", c.typing)
+	}
+}
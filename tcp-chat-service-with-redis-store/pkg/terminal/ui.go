@@ -0,0 +1,181 @@
+package terminal
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shameerb/tcp-chat-redis/pkg/markup"
+)
+
+// ui is how the client talks to the user: a full screen terminal UI, or plain lines for pipes and dumb terminals.
+type ui interface {
+	// run hands every line the user enters to the client until the input ends or the ui is closed. It blocks.
+	run(c *chat)
+	// show adds a line to the messages.
+	show(line string)
+	// showSpans adds a line of styled spans to the messages. A highlighted line concerns the user and stands out,
+	// ringing the bell if asked to. Control characters in the text are escaped, whatever the server let through.
+	showSpans(spans []markup.Span, highlighted, bell bool)
+	// setTyping shows who is typing. Empty hides it.
+	setTyping(line string)
+	// setUsers shows the online users, if the ui has room for them.
+	setUsers(users []string)
+	// setConnection shows whether the client is online, or what it is doing to get back.
+	setConnection(online bool, detail string)
+	// setTitle names the user and the room, if the ui shows a title.
+	setTitle(title string)
+	// clear removes the messages shown so far.
+	clear()
+	close()
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// lineUI reads lines from a scanner and writes lines to a writer. On a terminal who is typing is shown on a status
+// line below the messages, redrawn in place and cleared before anything else is written so it never ends up between
+// messages. Without a terminal it is not shown at all.
+type lineUI struct {
+	scanner     *bufio.Scanner
+	writer      io.Writer
+	interactive bool
+	mu          sync.Mutex
+	typing      string
+	statusShown bool
+	offline     bool
+}
+
+func newLineUI(scanner *bufio.Scanner, writer io.Writer, interactive bool) *lineUI {
+	return &lineUI{scanner: scanner, writer: writer, interactive: interactive}
+}
+
+func (l *lineUI) run(c *chat) {
+	for l.scanner.Scan() {
+		c.rcvChannel <- l.scanner.Text()
+	}
+	// end of input (ctrl-d, or the end of a pipe).
+	c.requestQuit()
+}
+
+func (l *lineUI) show(line string) {
+	l.showSpans([]markup.Span{{Text: line}}, false, false)
+}
+
+// showSpans styles the spans with escape sequences on a terminal, making highlighted lines bold. Pipes get the
+// text as is.
+func (l *lineUI) showSpans(spans []markup.Span, highlighted, bell bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clearStatus()
+	if !l.interactive {
+		l.writer.Write([]byte(markup.Sanitize(markup.Plain(spans)) + "\n"))
+		return
+	}
+	if bell {
+		l.writer.Write([]byte("\a"))
+	}
+	var b strings.Builder
+	for _, span := range spans {
+		text := markup.Sanitize(span.Text)
+		codes := sgr(span)
+		if highlighted && span.Style&markup.Bold == 0 {
+			codes = append(codes, "1")
+		}
+		if len(codes) == 0 {
+			b.WriteString(text)
+			continue
+		}
+		b.WriteString("\033[" + strings.Join(codes, ";") + "m" + text + "\033[0m")
+	}
+	b.WriteString("\n")
+	l.writer.Write([]byte(b.String()))
+	l.drawStatus()
+}
+
+// sgr returns the parameters of the escape sequence that styles a span: names in colours 31 to 36, code spans in
+// reverse video.
+func sgr(span markup.Span) []string {
+	var codes []string
+	if span.Style&markup.Bold != 0 {
+		codes = append(codes, "1")
+	}
+	if span.Style&markup.Italic != 0 {
+		codes = append(codes, "3")
+	}
+	if span.Style&markup.Code != 0 {
+		codes = append(codes, "7")
+	}
+	if span.Color > 0 {
+		codes = append(codes, strconv.Itoa(30+span.Color))
+	}
+	return codes
+}
+
+func (l *lineUI) setTyping(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.typing = markup.Sanitize(line)
+	l.drawStatus()
+}
+
+func (l *lineUI) setUsers(users []string) {}
+
+func (l *lineUI) setTitle(title string) {}
+
+// setConnection writes a line when the client goes offline or comes back, not on every attempt in between.
+func (l *lineUI) setConnection(online bool, detail string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if online == !l.offline {
+		return
+	}
+	l.offline = !online
+	l.clearStatus()
+	if online {
+		l.writer.Write([]byte("* reconnected\n"))
+	} else {
+		l.writer.Write([]byte("* connection lost, " + markup.Sanitize(detail) + "\n"))
+	}
+	l.drawStatus()
+}
+
+func (l *lineUI) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.interactive {
+		return
+	}
+	l.clearStatus()
+	// move to the top left corner and clear the screen.
+	l.writer.Write([]byte("\033[H\033[2J"))
+	l.drawStatus()
+}
+
+func (l *lineUI) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clearStatus()
+}
+
+func (l *lineUI) clearStatus() {
+	if l.statusShown {
+		l.writer.Write([]byte("\r\033[K"))
+		l.statusShown = false
+	}
+}
+
+func (l *lineUI) drawStatus() {
+	l.clearStatus()
+	if !l.interactive || l.typing == "" {
+		return
+	}
+	l.writer.Write([]byte(l.typing))
+	l.statusShown = true
+}